@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	client "github.com/testbook/app-search-client"
+)
+
+const (
+	appSearchDeleteBatchSize = 100
+	appSearchIndexBatchSize  = 100
+	appSearchRequestTimeout  = 30 * time.Second
+)
+
+// appSearchClient extends the indexing client of app-search-client with the
+// engine, schema and document endpoints the sync needs. app-search-client only
+// exposes Index and Close, neither its requests nor its transport, so these
+// endpoints are called with an http client of their own. Both clients are
+// built from GetHTTPConfig, which must stay the one place the address, api key
+// and user agent are set.
+type appSearchClient struct {
+	client.Client
+	baseURL    string
+	apiKey     string
+	userAgent  string
+	httpClient *http.Client
+}
+
+type appSearchError struct {
+	Status int
+	Errors []string `json:"errors"`
+}
+
+func (e *appSearchError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("app search responded with status %d", e.Status)
+	}
+	return fmt.Sprintf("app search responded with status %d: %s", e.Status, strings.Join(e.Errors, ", "))
+}
+
+func newAppSearchClient(config *configOptions) (*appSearchClient, error) {
+	httpConfig := config.GetHTTPConfig()
+	indexClient, err := client.NewHTTPClient(httpConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &appSearchClient{
+		Client:    indexClient,
+		baseURL:   strings.TrimSuffix(httpConfig.Addr, "/"),
+		apiKey:    httpConfig.APIKey,
+		userAgent: httpConfig.UserAgent,
+		httpClient: &http.Client{
+			Timeout: appSearchRequestTimeout,
+		},
+	}, nil
+}
+
+func (c *appSearchClient) enginePath(engine string, parts ...string) string {
+	return "/api/as/v1/engines/" + url.PathEscape(engine) + strings.Join(parts, "")
+}
+
+func (c *appSearchClient) do(method, path string, body, result interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", c.userAgent)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		apiErr := &appSearchError{Status: resp.StatusCode}
+		json.Unmarshal(data, apiErr)
+		return apiErr
+	}
+	if result != nil && len(data) > 0 {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+func (c *appSearchClient) deleteDocuments(engine string, ids []string) error {
+	for start := 0; start < len(ids); start += appSearchDeleteBatchSize {
+		end := start + appSearchDeleteBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := c.do(http.MethodDelete, c.enginePath(engine, "/documents"), ids[start:end], nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type appSearchIndexResult struct {
+	ID     string   `json:"id"`
+	Errors []string `json:"errors"`
+}
+
+// postDocuments indexes docs through the documents endpoint, returning the
+// result of each doc since App Search rejects invalid docs one by one.
+func (c *appSearchClient) postDocuments(engine string, docs []interface{}) ([]*appSearchIndexResult, error) {
+	var results []*appSearchIndexResult
+	for start := 0; start < len(docs); start += appSearchIndexBatchSize {
+		end := start + appSearchIndexBatchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		var batch []*appSearchIndexResult
+		if err := c.do(http.MethodPost, c.enginePath(engine, "/documents"), docs[start:end], &batch); err != nil {
+			return results, err
+		}
+		results = append(results, batch...)
+	}
+	return results, nil
+}
+
+type appSearchEngine struct {
+	Name          string   `json:"name"`
+	Type          string   `json:"type,omitempty"`
+	Language      *string  `json:"language"`
+	DocumentCount int      `json:"document_count,omitempty"`
+	SourceEngines []string `json:"source_engines,omitempty"`
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*appSearchError)
+	return ok && apiErr.Status == http.StatusNotFound
+}
+
+// isPermanent reports whether App Search rejected a request in a way retrying
+// cannot fix: a 4xx status other than a timeout or rate limiting.
+func isPermanent(err error) bool {
+	apiErr, ok := err.(*appSearchError)
+	return ok && apiErr.Status >= 400 && apiErr.Status < 500 &&
+		apiErr.Status != http.StatusRequestTimeout && apiErr.Status != http.StatusTooManyRequests
+}
+
+// getEngine returns nil without error when the engine does not exist.
+func (c *appSearchClient) getEngine(name string) (*appSearchEngine, error) {
+	engine := &appSearchEngine{}
+	if err := c.do(http.MethodGet, c.enginePath(name), nil, engine); err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return engine, nil
+}
+
+func (c *appSearchClient) createEngine(engine *appSearchEngine) error {
+	return c.do(http.MethodPost, "/api/as/v1/engines", engine, nil)
+}
+
+func (c *appSearchClient) getSchema(engine string) (map[string]string, error) {
+	schema := make(map[string]string)
+	err := c.do(http.MethodGet, c.enginePath(engine, "/schema"), nil, &schema)
+	return schema, err
+}
+
+// updateSchema adds or changes the given fields; fields not listed are kept.
+func (c *appSearchClient) updateSchema(engine string, fields map[string]string) error {
+	return c.do(http.MethodPost, c.enginePath(engine, "/schema"), fields, nil)
+}
+
+func (c *appSearchClient) deleteEngine(name string) error {
+	return c.do(http.MethodDelete, c.enginePath(name), nil, nil)
+}
+
+func (c *appSearchClient) addSourceEngines(metaEngine string, sources []string) error {
+	return c.do(http.MethodPost, c.enginePath(metaEngine, "/source_engines"), sources, nil)
+}
+
+func (c *appSearchClient) removeSourceEngines(metaEngine string, sources []string) error {
+	return c.do(http.MethodDelete, c.enginePath(metaEngine, "/source_engines"), sources, nil)
+}
+
+type appSearchPage struct {
+	Current      int `json:"current"`
+	TotalPages   int `json:"total_pages"`
+	TotalResults int `json:"total_results"`
+	Size         int `json:"size"`
+}
+
+type appSearchDocumentList struct {
+	Meta struct {
+		Page appSearchPage `json:"page"`
+	} `json:"meta"`
+	Results []map[string]interface{} `json:"results"`
+}
+
+// listDocuments pages through the documents of an engine. App Search only
+// lists the first 10000 documents.
+func (c *appSearchClient) listDocuments(engine string, page, size int) (*appSearchDocumentList, error) {
+	list := &appSearchDocumentList{}
+	path := c.enginePath(engine, fmt.Sprintf("/documents/list?page[current]=%d&page[size]=%d", page, size))
+	err := c.do(http.MethodGet, path, nil, list)
+	return list, err
+}
+
+// getDocuments returns the documents with the given ids, with nil entries for
+// ids that are not indexed.
+func (c *appSearchClient) getDocuments(engine string, ids []string) ([]map[string]interface{}, error) {
+	var docs []map[string]interface{}
+	err := c.do(http.MethodGet, c.enginePath(engine, "/documents"), ids, &docs)
+	return docs, err
+}
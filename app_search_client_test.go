@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	client "github.com/testbook/app-search-client"
+)
+
+// documentsIndexer stands in for the indexer of app-search-client, indexing
+// through the documents endpoint of c.
+type documentsIndexer struct {
+	client.Client
+	c *appSearchClient
+}
+
+func (i *documentsIndexer) Index(engine string, docs []interface{}) error {
+	_, err := i.c.postDocuments(engine, docs)
+	return err
+}
+
+type fakeEngine struct {
+	engine appSearchEngine
+	schema map[string]string
+	docs   map[string]map[string]interface{}
+}
+
+// fakeEngines keeps engines, schemas and documents in memory and serves them
+// through the App Search endpoints of appSearchClient. Requests listed in
+// fail, as "METHOD path", are answered with the given status instead.
+type fakeEngines struct {
+	mutex    sync.Mutex
+	engines  map[string]*fakeEngine
+	fail     map[string]int
+	requests []string // method and path of each request
+}
+
+func newFakeEngines() *fakeEngines {
+	return &fakeEngines{engines: make(map[string]*fakeEngine), fail: make(map[string]int)}
+}
+
+func (f *fakeEngines) add(engine appSearchEngine, docs ...map[string]interface{}) *fakeEngine {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	e := &fakeEngine{engine: engine, schema: make(map[string]string), docs: make(map[string]map[string]interface{})}
+	for _, doc := range docs {
+		e.docs[doc["id"].(string)] = doc
+	}
+	f.engines[engine.Name] = e
+	return e
+}
+
+func (f *fakeEngines) engine(name string) *fakeEngine {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.engines[name]
+}
+
+func (f *fakeEngines) setFail(request string, status int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if status == 0 {
+		delete(f.fail, request)
+	} else {
+		f.fail[request] = status
+	}
+}
+
+func (f *fakeEngines) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	request := req.Method + " " + req.URL.Path
+	f.requests = append(f.requests, request)
+	if status := f.fail[request]; status != 0 {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"errors":["failed"]}`))
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/api/as/v1/engines")
+	if path == "" && req.Method == http.MethodPost {
+		var engine appSearchEngine
+		json.NewDecoder(req.Body).Decode(&engine)
+		f.engines[engine.Name] = &fakeEngine{engine: engine, schema: make(map[string]string), docs: make(map[string]map[string]interface{})}
+		json.NewEncoder(w).Encode(engine)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	e := f.engines[parts[0]]
+	if e == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":["Could not find engine."]}`))
+		return
+	}
+	endpoint := ""
+	if len(parts) > 1 {
+		endpoint = parts[1]
+	}
+	switch req.Method + " " + endpoint {
+	case "GET ":
+		engine := e.engine
+		engine.DocumentCount = len(e.docs)
+		json.NewEncoder(w).Encode(engine)
+	case "DELETE ":
+		delete(f.engines, e.engine.Name)
+		w.Write([]byte(`{"deleted":true}`))
+	case "GET schema":
+		json.NewEncoder(w).Encode(e.schema)
+	case "POST schema":
+		var fields map[string]string
+		json.NewDecoder(req.Body).Decode(&fields)
+		for field, typ := range fields {
+			e.schema[field] = typ
+		}
+		json.NewEncoder(w).Encode(e.schema)
+	case "POST source_engines", "DELETE source_engines":
+		var sources []string
+		json.NewDecoder(req.Body).Decode(&sources)
+		for _, source := range sources {
+			e.engine.SourceEngines = removeString(e.engine.SourceEngines, source)
+			if req.Method == http.MethodPost {
+				e.engine.SourceEngines = append(e.engine.SourceEngines, source)
+			}
+		}
+		json.NewEncoder(w).Encode(e.engine)
+	case "POST documents":
+		var docs []map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&docs)
+		results := []*appSearchIndexResult{}
+		for _, doc := range docs {
+			id, _ := doc["id"].(string)
+			e.docs[id] = doc
+			results = append(results, &appSearchIndexResult{ID: id, Errors: []string{}})
+		}
+		json.NewEncoder(w).Encode(results)
+	case "DELETE documents":
+		var ids []string
+		json.NewDecoder(req.Body).Decode(&ids)
+		for _, id := range ids {
+			delete(e.docs, id)
+		}
+		w.Write([]byte(`[]`))
+	case "GET documents":
+		var ids []string
+		json.NewDecoder(req.Body).Decode(&ids)
+		docs := make([]map[string]interface{}, len(ids))
+		for i, id := range ids {
+			docs[i] = e.docs[id]
+		}
+		json.NewEncoder(w).Encode(docs)
+	case "GET documents/list":
+		current, _ := strconv.Atoi(req.URL.Query().Get("page[current]"))
+		size, _ := strconv.Atoi(req.URL.Query().Get("page[size]"))
+		ids := make([]string, 0, len(e.docs))
+		for id := range e.docs {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		list := &appSearchDocumentList{Results: []map[string]interface{}{}}
+		list.Meta.Page = appSearchPage{Current: current, Size: size, TotalResults: len(ids), TotalPages: (len(ids) + size - 1) / size}
+		for i := (current - 1) * size; i < current*size && i < len(ids); i++ {
+			list.Results = append(list.Results, e.docs[ids[i]])
+		}
+		json.NewEncoder(w).Encode(list)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func removeString(values []string, s string) []string {
+	var kept []string
+	for _, v := range values {
+		if v != s {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
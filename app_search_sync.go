@@ -1,18 +1,6 @@
 package main
 
-import (
-	"context"
-	"log"
-	"os"
-	"os/signal"
-	"sync"
-	"syscall"
-
-	"github.com/rwynn/gtm"
-	client "github.com/testbook/app-search-client"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-)
+import "os"
 
 const (
 	Name                     = "app-search-sync"
@@ -24,62 +12,18 @@ const (
 	defaultHttpAddr          = ":8010"
 	gtmChannelSizeDefault    = 512
 	defaultConfigFile        = "config.go"
+	idSeparatorDefault       = "_"
+	versionStorePathDefault  = "app-search-sync.versions.jsonl"
+	versionMaxDocsDefault    = 1000000
+	resumeStoreFileDefault   = "app-search-sync.resume.json"
+	resumeStoreDirDefault    = "app-search-sync.resume"
+	tracingEndpointDefault   = "http://localhost:4318/v1/traces"
+	auditCollectionDefault   = "audit"
+	auditMaxSizeDefault      = 64 << 20
+	spillDirDefault          = "app-search-sync.spill"
+	spillMaxSizeDefault      = 1024 // megabytes
 )
 
 func main() {
-	config := &configOptions{
-		GtmSettings: GtmDefaultSettings(),
-		InfoLogger:  log.New(os.Stdout, "INFO ", log.Flags()),
-		ErrorLogger: log.New(os.Stdout, "ERROR ", log.Flags()),
-	}
-	config.ParseCommandLineFlags()
-	config.LoadConfigFile().SetDefaults().LoadPlugin()
-
-	if len(config.EngineConfig) == 0 {
-		config.ErrorLogger.Fatalln("No engine configuration found")
-	}
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-
-	coreMongo, learnMongo, engagementMongo, testMongo, err := config.DialMongo()
-	if err != nil {
-		config.ErrorLogger.Fatalf("Unable to connect to mongodb: %s", err)
-	}
-	defer coreMongo.Disconnect(context.Background())
-	defer learnMongo.Disconnect(context.Background())
-	defer engagementMongo.Disconnect(context.Background())
-	defer testMongo.Disconnect(context.Background())
-
-	client, err := client.NewHTTPClient(config.GetHTTPConfig())
-	if err != nil {
-		config.ErrorLogger.Fatalf("Unable to create client: %s", err)
-	}
-	defer client.Close()
-
-	gtmCtx := gtm.StartMulti([]*mongo.Client{coreMongo, learnMongo, testMongo}, config.buildGtmOptions())
-	defer gtmCtx.Stop()
-	ic := &indexClient{
-		indexMutex:      &sync.Mutex{},
-		tokens:          bson.M{},
-		client:          client,
-		config:          config,
-		gtmCtx:          gtmCtx,
-		coreMongo:       coreMongo,
-		learnMongo:      learnMongo,
-		engagementMongo: engagementMongo,
-		testMongo:       testMongo,
-		stats: &bulkProcessorStats{
-			Enabled: config.Stats,
-		},
-	}
-	if err = ic.setupEngines(); err != nil {
-		config.ErrorLogger.Fatalf("Error to setup engines: %s", err)
-	}
-	ic.start()
-	go startHTTPServer(&httpServerCtx{indexConfig: ic})
-
-	<-c
-	ic.config.InfoLogger.Println("Stopping all workers and shutting down")
-	ic.batchIndex()
+	os.Exit(execute(os.Args[1:]))
 }
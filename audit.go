@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rwynn/gtm"
+	"github.com/testbook/app-search-sync/plugin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	auditQueueSize     = 4096 // entries waiting to be written, more are dropped
+	auditBatchSize     = 256
+	auditWriteInterval = time.Second
+	auditWriteTimeout  = 10 * time.Second
+	auditQueryLimit    = 100
+)
+
+// stages of an op recorded in the audit trail
+const (
+	auditReceived = "received" // read from mongo by gtm
+	auditFiltered = "filtered" // rejected by the filter named in detail
+	auditSkipped  = "skipped"  // skipped by the plugin
+	auditDropped  = "dropped"  // not indexed, detail is invalid, schema or stale
+	auditMapped   = "mapped"   // buffered for indexing
+	auditIndexed  = "indexed"  // accepted by App Search
+	auditDeleted  = "deleted"  // removed from App Search
+	auditSpilled  = "spilled"  // kept on disk while the engine is disabled
+	auditFailed   = "failed"   // detail is plugin, index, delete or spill
+)
+
+type auditSettings struct {
+	Enabled     bool     `toml:"enabled"`
+	Namespaces  []string `toml:"namespaces"`   // audit every doc of these namespaces
+	IDs         []string `toml:"ids"`          // audit the docs with these ids in any namespace
+	SampleRatio float64  `toml:"sample-ratio"` // share of the other doc ids audited
+	Cluster     string   `toml:"cluster"`      // mongo cluster holding the audit trail, core by default
+	Database    string   `toml:"database"`
+	Collection  string   `toml:"collection"`
+	MaxSize     int64    `toml:"max-size"` // bytes of the capped collection
+	MaxDocs     int64    `toml:"max-docs"` // entries of the capped collection, unlimited when unset
+}
+
+type auditEntry struct {
+	Time      time.Time `bson:"time" json:"time"`
+	DocID     string    `bson:"docId" json:"docId"`
+	Namespace string    `bson:"namespace" json:"namespace"`
+	Engine    string    `bson:"engine,omitempty" json:"engine,omitempty"`
+	Operation string    `bson:"op" json:"op"`
+	Source    string    `bson:"source" json:"source"`
+	Stage     string    `bson:"stage" json:"stage"`
+	Detail    string    `bson:"detail,omitempty" json:"detail,omitempty"`
+	Error     string    `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// auditedOp is an op buffered for an engine waiting for the outcome of the
+// flush, stage being indexed or deleted.
+type auditedOp struct {
+	op    *gtm.Op
+	stage string
+}
+
+// auditLog records the stages of the audited ops in a capped collection. The
+// entries are written in batches in the background. A nil auditLog audits
+// nothing.
+type auditLog struct {
+	settings   auditSettings
+	namespaces map[string]bool
+	ids        map[string]bool
+	col        *mongo.Collection
+	log        *logger
+	entries    chan *auditEntry
+	stop       chan struct{}
+	wg         sync.WaitGroup
+	dropped    int64
+}
+
+// newAuditLog creates the capped audit collection when missing and starts
+// writing entries to it. It returns nil when auditing is disabled.
+func newAuditLog(settings auditSettings, clients *plugin.MongoClients, log *logger) (*auditLog, error) {
+	if !settings.Enabled {
+		return nil, nil
+	}
+	client, err := clusterClient(clients, settings.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	db := client.Database(settings.Database)
+	ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+	defer cancel()
+	names, err := db.ListCollectionNames(ctx, bson.M{"name": settings.Collection})
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		opts := options.CreateCollection().SetCapped(true).SetSizeInBytes(settings.MaxSize)
+		if settings.MaxDocs > 0 {
+			opts.SetMaxDocuments(settings.MaxDocs)
+		}
+		if err = db.CreateCollection(ctx, settings.Collection, opts); err != nil {
+			return nil, fmt.Errorf("unable to create capped collection %s: %s", settings.Collection, err)
+		}
+	}
+	col := db.Collection(settings.Collection)
+	if _, err = col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "docId", Value: 1}, {Key: "time", Value: 1}},
+	}); err != nil {
+		return nil, fmt.Errorf("unable to index collection %s: %s", settings.Collection, err)
+	}
+	a := &auditLog{
+		settings:   settings,
+		namespaces: make(map[string]bool),
+		ids:        make(map[string]bool),
+		col:        col,
+		log:        log,
+		entries:    make(chan *auditEntry, auditQueueSize),
+		stop:       make(chan struct{}),
+	}
+	for _, ns := range settings.Namespaces {
+		a.namespaces[ns] = true
+	}
+	for _, id := range settings.IDs {
+		a.ids[id] = true
+	}
+	a.wg.Add(1)
+	go a.run()
+	return a, nil
+}
+
+// auditDocID stringifies a mongo _id the way it is queried on /audit.
+func auditDocID(id interface{}) string {
+	switch id := id.(type) {
+	case string:
+		return id
+	case primitive.ObjectID:
+		return id.Hex()
+	}
+	return fmt.Sprint(id)
+}
+
+// audited reports whether the stages of op are recorded. Ids are sampled by
+// hash so that every op of a sampled doc is audited.
+func (a *auditLog) audited(op *gtm.Op) bool {
+	if a == nil {
+		return false
+	}
+	if a.namespaces[op.Namespace] {
+		return true
+	}
+	id := auditDocID(op.Id)
+	if a.ids[id] {
+		return true
+	}
+	if a.settings.SampleRatio <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return float64(h.Sum32()%10000) < a.settings.SampleRatio*10000
+}
+
+// record adds a stage of op to the audit trail when op is audited.
+func (a *auditLog) record(op *gtm.Op, engine, stage, detail string, err error) {
+	if !a.audited(op) {
+		return
+	}
+	e := &auditEntry{
+		Time:      time.Now().UTC(),
+		DocID:     auditDocID(op.Id),
+		Namespace: op.Namespace,
+		Engine:    engine,
+		Operation: op.Operation,
+		Source:    opSource(op),
+		Stage:     stage,
+		Detail:    detail,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	select {
+	case a.entries <- e:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+	}
+}
+
+func (a *auditLog) run() {
+	defer a.wg.Done()
+	ticker := time.NewTicker(auditWriteInterval)
+	defer ticker.Stop()
+	var batch []interface{}
+	for {
+		select {
+		case e := <-a.entries:
+			if batch = append(batch, e); len(batch) < auditBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-a.stop:
+			for {
+				select {
+				case e := <-a.entries:
+					batch = append(batch, e)
+				default:
+					a.write(batch)
+					return
+				}
+			}
+		}
+		a.write(batch)
+		batch = nil
+	}
+}
+
+func (a *auditLog) write(batch []interface{}) {
+	if len(batch) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+		defer cancel()
+		if _, err := a.col.InsertMany(ctx, batch, options.InsertMany().SetOrdered(false)); err != nil {
+			a.log.Warn("Unable to write audit entries", "entries", len(batch), "error", err)
+		}
+	}
+	if dropped := atomic.SwapInt64(&a.dropped, 0); dropped > 0 {
+		a.log.Warn("Dropped audit entries, the write queue is full", "entries", dropped)
+	}
+}
+
+// shutdown writes the entries already recorded.
+func (a *auditLog) shutdown() {
+	if a == nil {
+		return
+	}
+	close(a.stop)
+	a.wg.Wait()
+}
+
+// find returns the latest entries of a doc in time order, limited to a
+// namespace when set.
+func (a *auditLog) find(docID, namespace string, limit int64) ([]*auditEntry, error) {
+	if limit <= 0 {
+		limit = auditQueryLimit
+	}
+	query := bson.M{"docId": docID}
+	if namespace != "" {
+		query["namespace"] = namespace
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+	defer cancel()
+	cursor, err := a.col.Find(ctx, query, options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	entries := []*auditEntry{}
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// auditBuffered remembers an audited op buffered for the engine until the
+// outcome of the flush is known. The caller must hold indexMutex.
+func (ic *indexClient) auditBuffered(engine *indexEngineCtx, op *gtm.Op, stage string) {
+	if ic.config.audit.audited(op) {
+		engine.audits = append(engine.audits, &auditedOp{op: op, stage: stage})
+	}
+}
+
+// finishAudits records the outcome of the flush for the audited ops of the
+// engine. The caller must hold indexMutex.
+func (ic *indexClient) finishAudits(engine *indexEngineCtx, indexErr, deleteErr error) {
+	for _, a := range engine.audits {
+		err, operation := indexErr, "index"
+		if a.stage == auditDeleted {
+			err, operation = deleteErr, "delete"
+		}
+		if err != nil {
+			ic.config.audit.record(a.op, engine.name, auditFailed, operation, err)
+		} else {
+			ic.config.audit.record(a.op, engine.name, a.stage, "", nil)
+		}
+	}
+	engine.audits = nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestAuditLog returns an audit log queueing up to size entries without
+// writing them.
+func newTestAuditLog(settings auditSettings, size int) *auditLog {
+	a := &auditLog{
+		settings:   settings,
+		namespaces: make(map[string]bool),
+		ids:        make(map[string]bool),
+		entries:    make(chan *auditEntry, size),
+	}
+	for _, ns := range settings.Namespaces {
+		a.namespaces[ns] = true
+	}
+	for _, id := range settings.IDs {
+		a.ids[id] = true
+	}
+	return a
+}
+
+func TestAuditDocID(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5f8f8c44b54764421b7156c3")
+	tests := []struct {
+		id   interface{}
+		want string
+	}{
+		{"abc", "abc"},
+		{oid, "5f8f8c44b54764421b7156c3"},
+		{int32(42), "42"},
+	}
+	for _, tt := range tests {
+		if got := auditDocID(tt.id); got != tt.want {
+			t.Errorf("auditDocID(%v) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestAudited(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings auditSettings
+		op       *gtm.Op
+		want     bool
+	}{
+		{"namespace", auditSettings{Namespaces: []string{"db.courses"}}, &gtm.Op{Id: "1", Namespace: "db.courses"}, true},
+		{"other namespace", auditSettings{Namespaces: []string{"db.courses"}}, &gtm.Op{Id: "1", Namespace: "db.tests"}, false},
+		{"id", auditSettings{IDs: []string{"7"}}, &gtm.Op{Id: int64(7), Namespace: "db.tests"}, true},
+		{"no sampling", auditSettings{}, &gtm.Op{Id: "1", Namespace: "db.tests"}, false},
+		{"every id sampled", auditSettings{SampleRatio: 1}, &gtm.Op{Id: "1", Namespace: "db.tests"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newTestAuditLog(tt.settings, 0).audited(tt.op); got != tt.want {
+				t.Errorf("audited() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	var a *auditLog
+	if a.audited(&gtm.Op{Id: "1"}) {
+		t.Error("a nil audit log audited an op")
+	}
+}
+
+func TestAuditSampling(t *testing.T) {
+	a := newTestAuditLog(auditSettings{SampleRatio: 0.1}, 0)
+	var sampled int
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprint(i)
+		got := a.audited(&gtm.Op{Id: id, Namespace: "db.courses", Operation: "i"})
+		// every op of a doc is audited or none is, whatever its namespace
+		for _, op := range []*gtm.Op{
+			{Id: id, Namespace: "db.courses", Operation: "u"},
+			{Id: id, Namespace: "db.tests", Operation: "d"},
+		} {
+			if a.audited(op) != got {
+				t.Fatalf("ops of doc %s audited differently", id)
+			}
+		}
+		if got {
+			sampled++
+		}
+	}
+	if sampled < 800 || sampled > 1200 {
+		t.Errorf("sampled %d of 10000 ids, want about 1000", sampled)
+	}
+}
+
+func TestAuditRecord(t *testing.T) {
+	a := newTestAuditLog(auditSettings{Namespaces: []string{"db.courses"}}, 1)
+	op := &gtm.Op{Id: "1", Namespace: "db.courses", Operation: "i", Source: gtm.OplogQuerySource}
+	a.record(&gtm.Op{Id: "2", Namespace: "db.tests"}, "tests", auditMapped, "", nil)
+	a.record(op, "courses", auditFailed, "index", errors.New("boom"))
+	a.record(op, "courses", auditFailed, "index", errors.New("boom"))
+	if len(a.entries) != 1 || a.dropped != 1 {
+		t.Fatalf("queued %d entries and dropped %d, want 1 and 1", len(a.entries), a.dropped)
+	}
+	e := <-a.entries
+	if e.DocID != "1" || e.Engine != "courses" || e.Stage != auditFailed || e.Detail != "index" || e.Error != "boom" || e.Operation != "i" {
+		t.Errorf("entry = %+v", e)
+	}
+}
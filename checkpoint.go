@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	heartbeatInterval = 10 * time.Second
+	heartbeatExpiry   = 3 * heartbeatInterval
+)
+
+var errSyncRunning = errors.New("a sync is running with this resume name, stop it first or force the change")
+
+type streamCheckpoint struct {
+	StreamID   string               `json:"streamID"`
+	Timestamp  *primitive.Timestamp `json:"timestamp,omitempty"`
+	Time       *time.Time           `json:"time,omitempty"`
+	LagSeconds *int64               `json:"lagSeconds,omitempty"`
+}
+
+type checkpoint struct {
+	ResumeName string               `json:"resumeName"`
+	Strategy   string               `json:"strategy"`
+	Timestamp  *primitive.Timestamp `json:"timestamp,omitempty"`
+	Time       *time.Time           `json:"time,omitempty"`
+	LagSeconds *int64               `json:"lagSeconds,omitempty"`
+	Streams    []*streamCheckpoint  `json:"streams,omitempty"` // streams with a saved resume token
+	Running    bool                 `json:"running"`
+	Heartbeat  *time.Time           `json:"heartbeat,omitempty"`
+	Host       string               `json:"host,omitempty"`
+}
+
+func (s resumeStrategy) name() string {
+	if s == tokenResumeStrategy {
+		return "token"
+	}
+	return "timestamp"
+}
+
+// tokenTimestamp extracts the cluster time encoded at the start of a change
+// stream resume token. Tokens in other formats yield false.
+func tokenTimestamp(token interface{}) (primitive.Timestamp, bool) {
+	var ts primitive.Timestamp
+	m, ok := toMap(token)
+	if !ok {
+		return ts, false
+	}
+	data, ok := m["_data"].(string)
+	if !ok || len(data) < 18 {
+		return ts, false
+	}
+	b, err := hex.DecodeString(data[:18])
+	if err != nil || b[0] != 0x82 {
+		return ts, false
+	}
+	ts.T = uint32(b[1])<<24 | uint32(b[2])<<16 | uint32(b[3])<<8 | uint32(b[4])
+	ts.I = uint32(b[5])<<24 | uint32(b[6])<<16 | uint32(b[7])<<8 | uint32(b[8])
+	return ts, true
+}
+
+// oplogNamespace returns the database and collection of the oplog, which gtm
+// defaults to local.oplog.rs as well.
+func (config *configOptions) oplogNamespace() (db, col string) {
+	db, col = config.MongoOpLogDatabaseName, config.MongoOpLogCollectionName
+	if db == "" {
+		db = "local"
+	}
+	if col == "" {
+		col = "oplog.rs"
+	}
+	return
+}
+
+// oplogHead returns the timestamp of the latest entry in the oplog of the cluster.
+func (config *configOptions) oplogHead(client *mongo.Client) (ts primitive.Timestamp, err error) {
+	db, col := config.oplogNamespace()
+	opts := options.FindOne().SetSort(bson.M{"$natural": -1}).SetProjection(bson.M{"ts": 1})
+	result := client.Database(db).Collection(col).FindOne(context.Background(), bson.M{}, opts)
+	if err = result.Err(); err != nil {
+		return
+	}
+	var doc struct {
+		Ts primitive.Timestamp `bson:"ts"`
+	}
+	if err = result.Decode(&doc); err != nil {
+		return
+	}
+	return doc.Ts, nil
+}
+
+func checkpointLag(head, ts primitive.Timestamp) *int64 {
+	if head.T == 0 {
+		return nil
+	}
+	lag := int64(head.T) - int64(ts.T)
+	if lag < 0 {
+		lag = 0
+	}
+	return &lag
+}
+
+func checkpointTime(ts primitive.Timestamp) *time.Time {
+	t := time.Unix(int64(ts.T), 0)
+	return &t
+}
+
+// loadCheckpoint reads the resume state saved under the configured resume name
+// and measures how far it trails the head of the oplog.
+func (ic *indexClient) loadCheckpoint() (*checkpoint, error) {
+	config := ic.config
+	cp := &checkpoint{
+		ResumeName: config.ResumeName,
+		Strategy:   config.ResumeStrategy.name(),
+	}
+	ts, err := config.resume.LoadTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	if ts.T > 0 {
+		head, _ := config.oplogHead(ic.coreMongo)
+		cp.Timestamp = &ts
+		cp.Time = checkpointTime(ts)
+		cp.LagSeconds = checkpointLag(head, ts)
+	}
+	tokens, err := config.resume.LoadTokens()
+	if err != nil {
+		return nil, err
+	}
+	streamIDs := make([]string, 0, len(tokens))
+	for streamID := range tokens {
+		streamIDs = append(streamIDs, streamID)
+	}
+	sort.Strings(streamIDs)
+	for _, streamID := range streamIDs {
+		stream := &streamCheckpoint{StreamID: streamID}
+		if ts, ok := tokenTimestamp(tokens[streamID]); ok {
+			head, _ := config.oplogHead(ic.getMongoClient(streamID))
+			stream.Timestamp = &ts
+			stream.Time = checkpointTime(ts)
+			stream.LagSeconds = checkpointLag(head, ts)
+		}
+		cp.Streams = append(cp.Streams, stream)
+	}
+	if hb, err := config.resume.LoadHeartbeat(); err == nil && hb != nil {
+		cp.Heartbeat = &hb.Heartbeat
+		cp.Host = hb.Host
+		cp.Running = time.Since(hb.Heartbeat) < heartbeatExpiry
+	}
+	return cp, nil
+}
+
+// checkpointBefore returns the checkpoint of a sync that indexed every op
+// before the second t. The saved timestamp is that of the last op indexed, so
+// it is the last possible op of the previous second for the resume to start
+// with the first op of t.
+func checkpointBefore(t uint32) primitive.Timestamp {
+	return primitive.Timestamp{T: t - 1, I: math.MaxUint32}
+}
+
+// nextTimestamp returns the timestamp following ts.
+func nextTimestamp(ts primitive.Timestamp) primitive.Timestamp {
+	if ts.I == math.MaxUint32 {
+		return primitive.Timestamp{T: ts.T + 1}
+	}
+	return primitive.Timestamp{T: ts.T, I: ts.I + 1}
+}
+
+// setCheckpoint replaces the saved timestamp so that the sync resumes with the
+// first op of the unix second from. Resume tokens cannot be derived from a
+// timestamp, so the token strategy only supports deleting the checkpoint.
+func (config *configOptions) setCheckpoint(from uint32) error {
+	if config.ResumeStrategy == tokenResumeStrategy {
+		return errors.New("resume tokens cannot be set to a timestamp, reset the checkpoint instead")
+	}
+	if from <= 1 {
+		return fmt.Errorf("cannot resume from %d, at or before the epoch", from)
+	}
+	return config.resume.SaveTimestamp(checkpointBefore(from))
+}
+
+// rewindCheckpoint moves the saved timestamp back by the given duration and
+// returns the time the sync resumes from.
+func (config *configOptions) rewindCheckpoint(by time.Duration) (from time.Time, err error) {
+	if by <= 0 {
+		return from, errors.New("rewind duration must be positive")
+	}
+	saved, err := config.resume.LoadTimestamp()
+	if err != nil {
+		return
+	}
+	if saved.T == 0 {
+		return from, fmt.Errorf("no checkpoint saved for %s", config.ResumeName)
+	}
+	secs := int64(by / time.Second)
+	if secs >= int64(saved.T)-1 {
+		return from, fmt.Errorf("cannot rewind %s before the epoch", by)
+	}
+	t := saved.T - uint32(secs)
+	if err = config.setCheckpoint(t); err != nil {
+		return
+	}
+	return time.Unix(int64(t), 0), nil
+}
+
+// deleteCheckpoint removes the saved timestamp and resume tokens so that the
+// next run starts from the head of the oplog.
+func (config *configOptions) deleteCheckpoint() error {
+	return config.resume.Delete()
+}
+
+type heartbeat struct {
+	ResumeName string    `bson:"_id" json:"-"`
+	Host       string    `bson:"host" json:"host"`
+	Pid        int       `bson:"pid" json:"pid"`
+	Heartbeat  time.Time `bson:"heartbeat" json:"heartbeat"`
+}
+
+// checkNotRunning returns errSyncRunning when another process has recently
+// reported that it is syncing under the configured resume name.
+func (config *configOptions) checkNotRunning() error {
+	hb, err := config.resume.LoadHeartbeat()
+	if err != nil {
+		return err
+	}
+	if hb != nil && time.Since(hb.Heartbeat) < heartbeatExpiry {
+		return fmt.Errorf("%w (%s pid %d, last seen %s)", errSyncRunning, hb.Host, hb.Pid, hb.Heartbeat.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// heartbeat records that this process is syncing under the resume name so that
+// checkpoint changes from other processes can be refused.
+func (ic *indexClient) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	host, _ := os.Hostname()
+	for {
+		hb := &heartbeat{Host: host, Pid: os.Getpid(), Heartbeat: time.Now()}
+		if err := ic.config.resume.SaveHeartbeat(hb); err != nil {
+			ic.config.log(resumeComponent).Error("Unable to save heartbeat", "resume_name", ic.config.ResumeName, "error", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (ic *indexClient) startHeartbeat() {
+	if ic.config.Resume {
+		go ic.heartbeat()
+	}
+}
+
+// holdCheckpoint stops this process from saving its own checkpoint so that a
+// checkpoint changed while running survives until the next start or release.
+func (ic *indexClient) holdCheckpoint() {
+	ic.indexMutex.Lock()
+	ic.checkpointHeld = true
+	ic.lastTs = primitive.Timestamp{}
+	ic.tokens = bson.M{}
+	ic.indexMutex.Unlock()
+	ic.config.log(resumeComponent).Warn("Checkpoint changed while running, saving of checkpoints is suspended until restart or release", "resume_name", ic.config.ResumeName)
+}
+
+// releaseCheckpoint lets this process save its checkpoint again, which
+// overwrites the changed checkpoint with its position once it indexes ops.
+func (ic *indexClient) releaseCheckpoint() {
+	ic.indexMutex.Lock()
+	held := ic.checkpointHeld
+	ic.checkpointHeld = false
+	ic.indexMutex.Unlock()
+	if held {
+		ic.config.log(resumeComponent).Info("Saving of checkpoints resumed", "resume_name", ic.config.ResumeName)
+	}
+}
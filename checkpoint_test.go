@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newCheckpointTestConfig returns a config saving its checkpoint to a file.
+func newCheckpointTestConfig(t *testing.T) *configOptions {
+	t.Helper()
+	config := newConfig()
+	config.ResumeName = "default"
+	config.ResumeStore = resumeStoreSettings{Type: fileResumeStoreType, Path: filepath.Join(tempDir(t), "resume.json")}
+	var err error
+	if config.resume, err = config.newResumeStore(nil); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestTokenTimestamp(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  interface{}
+		want   primitive.Timestamp
+		wantOK bool
+	}{
+		{"token", bson.M{"_data": "82603E0F2B00000003" + "2B022C0100296E5A1004"}, primitive.Timestamp{T: 0x603E0F2B, I: 3}, true},
+		{"large increment", bson.M{"_data": "82603E0F2BFFFFFFFF"}, primitive.Timestamp{T: 0x603E0F2B, I: math.MaxUint32}, true},
+		{"map", map[string]interface{}{"_data": "82000000010000000200"}, primitive.Timestamp{T: 1, I: 2}, true},
+		{"other format", bson.M{"_data": "83603E0F2B00000003"}, primitive.Timestamp{}, false},
+		{"too short", bson.M{"_data": "82603E0F2B"}, primitive.Timestamp{}, false},
+		{"invalid hex", bson.M{"_data": "82603E0F2B0000000Z"}, primitive.Timestamp{}, false},
+		{"no data", bson.M{"other": "82603E0F2B00000003"}, primitive.Timestamp{}, false},
+		{"not a document", "82603E0F2B00000003", primitive.Timestamp{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tokenTimestamp(tt.token)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("tokenTimestamp() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNextTimestamp(t *testing.T) {
+	tests := []struct {
+		ts   primitive.Timestamp
+		want primitive.Timestamp
+	}{
+		{primitive.Timestamp{T: 5, I: 3}, primitive.Timestamp{T: 5, I: 4}},
+		{primitive.Timestamp{T: 5, I: math.MaxUint32}, primitive.Timestamp{T: 6, I: 0}},
+		// a resume from a checkpoint set to the second 100 reads ops after
+		// (100, 0), starting with the first op of that second
+		{checkpointBefore(100), primitive.Timestamp{T: 100, I: 0}},
+	}
+	for _, tt := range tests {
+		if got := nextTimestamp(tt.ts); got != tt.want {
+			t.Errorf("nextTimestamp(%+v) = %+v, want %+v", tt.ts, got, tt.want)
+		}
+	}
+}
+
+func TestSetCheckpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     uint32
+		strategy resumeStrategy
+		want     primitive.Timestamp
+		wantErr  bool
+	}{
+		{"second", 1000, timestampResumeStrategy, primitive.Timestamp{T: 999, I: math.MaxUint32}, false},
+		{"epoch", 1, timestampResumeStrategy, primitive.Timestamp{}, true},
+		{"zero", 0, timestampResumeStrategy, primitive.Timestamp{}, true},
+		{"token strategy", 1000, tokenResumeStrategy, primitive.Timestamp{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newCheckpointTestConfig(t)
+			config.ResumeStrategy = tt.strategy
+			if err := config.setCheckpoint(tt.from); (err != nil) != tt.wantErr {
+				t.Fatalf("setCheckpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got, _ := config.resume.LoadTimestamp(); got != tt.want {
+				t.Errorf("saved timestamp = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewindCheckpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		saved    primitive.Timestamp
+		by       time.Duration
+		wantFrom int64
+		want     primitive.Timestamp
+		wantErr  bool
+	}{
+		{"rewind", primitive.Timestamp{T: 1000, I: 7}, 30 * time.Second, 970, primitive.Timestamp{T: 969, I: math.MaxUint32}, false},
+		{"partial seconds", primitive.Timestamp{T: 1000, I: 7}, 1500 * time.Millisecond, 999, primitive.Timestamp{T: 998, I: math.MaxUint32}, false},
+		{"to the second after the epoch", primitive.Timestamp{T: 1000, I: 7}, 998 * time.Second, 2, primitive.Timestamp{T: 1, I: math.MaxUint32}, false},
+		{"to the epoch", primitive.Timestamp{T: 1000, I: 7}, 999 * time.Second, 0, primitive.Timestamp{T: 1000, I: 7}, true},
+		{"before the epoch", primitive.Timestamp{T: 1000, I: 7}, time.Hour, 0, primitive.Timestamp{T: 1000, I: 7}, true},
+		{"not positive", primitive.Timestamp{T: 1000, I: 7}, 0, 0, primitive.Timestamp{T: 1000, I: 7}, true},
+		{"nothing saved", primitive.Timestamp{}, time.Minute, 0, primitive.Timestamp{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newCheckpointTestConfig(t)
+			if tt.saved.T > 0 {
+				if err := config.resume.SaveTimestamp(tt.saved); err != nil {
+					t.Fatal(err)
+				}
+			}
+			from, err := config.rewindCheckpoint(tt.by)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rewindCheckpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && from.Unix() != tt.wantFrom {
+				t.Errorf("rewindCheckpoint() = %v, want %v", from.Unix(), tt.wantFrom)
+			}
+			if got, _ := config.resume.LoadTimestamp(); got != tt.want {
+				t.Errorf("saved timestamp = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckNotRunning(t *testing.T) {
+	tests := []struct {
+		name    string
+		beat    time.Duration // age of the heartbeat, none when zero
+		wantErr bool
+	}{
+		{"no heartbeat", 0, false},
+		{"recent heartbeat", heartbeatInterval, true},
+		{"expired heartbeat", heartbeatExpiry + time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := newCheckpointTestConfig(t)
+			if tt.beat > 0 {
+				hb := &heartbeat{Host: "sync-1", Pid: 42, Heartbeat: time.Now().Add(-tt.beat)}
+				if err := config.resume.SaveHeartbeat(hb); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := config.checkNotRunning()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkNotRunning() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errSyncRunning) {
+				t.Errorf("checkNotRunning() error = %v, want %v", err, errSyncRunning)
+			}
+		})
+	}
+}
+
+func TestOplogNamespace(t *testing.T) {
+	config := newConfig()
+	if db, col := config.oplogNamespace(); db != "local" || col != "oplog.rs" {
+		t.Errorf("oplogNamespace() = %s.%s, want local.oplog.rs", db, col)
+	}
+	config.MongoOpLogDatabaseName, config.MongoOpLogCollectionName = "replica", "oplog.custom"
+	if db, col := config.oplogNamespace(); db != "replica" || col != "oplog.custom" {
+		t.Errorf("oplogNamespace() = %s.%s, want replica.oplog.custom", db, col)
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rwynn/gtm"
+	"github.com/testbook/app-search-sync/plugin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// exit codes of the commands
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitDifferences = 3 // verify found docs differing between mongo and App Search
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+func commands() []*command {
+	return []*command{
+		{"run", "Sync mongo to App Search until interrupted (default)", runCommand},
+		{"backfill", "Direct read the configured namespaces into App Search and exit", backfillCommand},
+		{"verify", "Compare mongo with App Search and optionally repair the differences", verifyCommand},
+		{"resync", "Re-index specific documents of a namespace", resyncCommand},
+		{"checkpoint", "Show, set, rewind or reset the saved resume checkpoint (show|set|rewind|reset)", checkpointCommand},
+		{"config", "Validate the configuration file (validate)", configCommand},
+		{"engines", "List the configured engines and their App Search state (list)", enginesCommand},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", Name)
+	for _, cmd := range commands() {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", Name)
+}
+
+// execute runs the command named by the first argument. Flags without a
+// command run the sync as before commands existed.
+func execute(args []string) int {
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd.run(args)
+		}
+	}
+	if name != "help" {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n", name)
+	}
+	usage()
+	return exitUsage
+}
+
+func newConfig() *configOptions {
+	return &configOptions{
+		GtmSettings: GtmDefaultSettings(),
+		Normalize:   defaultNormalizeSettings(),
+		logs:        newLogOutput(),
+	}
+}
+
+// parseFlags parses the command line and loads the config file. It returns
+// false when the command must exit, e.g. on -h or -v.
+func (config *configOptions) parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	if config.Version {
+		fmt.Printf("%s v%s\n", Name, Version)
+		return exitOK, false
+	}
+	config.LoadConfigFile().SetDefaults()
+	return exitOK, true
+}
+
+// syncCtx holds the clients shared by the commands that index documents.
+type syncCtx struct {
+	ic      *indexClient
+	cleanup []func()
+}
+
+func (ctx *syncCtx) close() {
+	for i := len(ctx.cleanup) - 1; i >= 0; i-- {
+		ctx.cleanup[i]()
+	}
+}
+
+// newSyncCtx connects to mongo and App Search, initialises the plugin and
+// sets up the engines.
+func newSyncCtx(config *configOptions) (*syncCtx, error) {
+	ctx := &syncCtx{}
+	config.LoadPlugin()
+	if len(config.EngineConfig) == 0 {
+		return ctx, fmt.Errorf("no engine configuration found")
+	}
+	if config.tracer = newTracer(config.Tracing, config.log(traceComponent)); config.tracer != nil {
+		ctx.cleanup = append(ctx.cleanup, config.tracer.shutdown)
+	}
+	coreMongo, learnMongo, engagementMongo, testMongo, err := config.DialMongo()
+	if err != nil {
+		return ctx, fmt.Errorf("unable to connect to mongodb: %s", err)
+	}
+	for _, c := range []*mongo.Client{coreMongo, learnMongo, engagementMongo, testMongo} {
+		c := c
+		ctx.cleanup = append(ctx.cleanup, func() { c.Disconnect(context.Background()) })
+	}
+
+	clients := &plugin.MongoClients{
+		CoreMongo:       coreMongo,
+		LearnMongo:      learnMongo,
+		EngagementMongo: engagementMongo,
+		TestMongo:       testMongo,
+	}
+	if config.resume, err = config.newResumeStore(clients); err != nil {
+		return ctx, fmt.Errorf("unable to open resume store: %s", err)
+	}
+	if config.audit, err = newAuditLog(config.Audit, clients, config.log(auditComponent)); err != nil {
+		return ctx, fmt.Errorf("unable to open audit trail: %s", err)
+	}
+	if config.audit != nil {
+		ctx.cleanup = append(ctx.cleanup, config.audit.shutdown)
+	}
+	if err = config.InitPlugin(clients); err != nil {
+		return ctx, fmt.Errorf("unable to initialise plugin: %s", err)
+	}
+	ctx.cleanup = append(ctx.cleanup, config.ShutdownPlugin)
+
+	client, err := newAppSearchClient(config)
+	if err != nil {
+		return ctx, fmt.Errorf("unable to create client: %s", err)
+	}
+	ctx.cleanup = append(ctx.cleanup, func() { client.Close() })
+
+	ic := &indexClient{
+		indexMutex:         &sync.Mutex{},
+		tokens:             bson.M{},
+		client:             client,
+		config:             config,
+		coreMongo:          coreMongo,
+		learnMongo:         learnMongo,
+		engagementMongo:    engagementMongo,
+		testMongo:          testMongo,
+		directReadsDone:    make(chan struct{}),
+		directReadsIndexed: make(chan struct{}),
+		schemaRefresh:      make(chan struct{}, 1),
+		stats: &bulkProcessorStats{
+			Enabled: config.Stats,
+		},
+		metrics: newSyncMetrics(),
+		lag:     newLagTracker(),
+		live:    newLiveness(),
+		pause:   newPauseGate(),
+	}
+	ctx.ic = ic
+	if config.StaleWriteProtection {
+		if ic.versions, err = newVersionStore(config.VersionStorePath, config.VersionStoreMaxDocs); err != nil {
+			return ctx, fmt.Errorf("unable to load document versions: %s", err)
+		}
+	}
+	if err = ic.resolveMetaEngines(); err != nil {
+		return ctx, fmt.Errorf("unable to resolve meta engines: %s", err)
+	}
+	if config.ProvisionEngines {
+		if err = ic.provisionEngines(); err != nil {
+			return ctx, fmt.Errorf("unable to provision engines: %s", err)
+		}
+	}
+	if err = ic.setupEngines(); err != nil {
+		return ctx, fmt.Errorf("error to setup engines: %s", err)
+	}
+	return ctx, nil
+}
+
+func runCommand(args []string) int {
+	config := newConfig()
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	config.registerFlags(fs)
+	config.registerSyncFlags(fs)
+	if code, ok := config.parseFlags(fs, args); !ok {
+		return code
+	}
+	return runSync(config)
+}
+
+func backfillCommand(args []string) int {
+	config := newConfig()
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	config.registerFlags(fs)
+	config.registerSyncFlags(fs)
+	engines := fs.String("engines", "", "Comma separated names of the engines to backfill. Defaults to all engines")
+	if code, ok := config.parseFlags(fs, args); !ok {
+		return code
+	}
+	config.Backfill = true
+	config.DirectReads = true
+	config.ExitAfterDirectReads = true
+	config.BackfillEngines = splitList(*engines)
+	return runSync(config)
+}
+
+// runSync runs the sync until it is interrupted or, with exit-after-direct-reads,
+// until the direct reads have been indexed.
+func runSync(config *configOptions) int {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go config.reopenLogsOn(hup)
+
+	ctx, err := newSyncCtx(config)
+	defer ctx.close()
+	if err != nil {
+		config.log(mainComponent).Error(err.Error())
+		return exitFailure
+	}
+	ic := ctx.ic
+	if config.Resume {
+		if err = config.checkNotRunning(); err != nil {
+			config.log(mainComponent).Warn("Checkpoint may be shared", "resume_name", config.ResumeName, "error", err)
+		}
+		defer config.resume.DeleteHeartbeat()
+	}
+	if config.Reindex {
+		if err = ic.startReindex(); err != nil {
+			config.log(mainComponent).Error("Unable to start reindex", "error", err)
+			return exitFailure
+		}
+	}
+	ic.gtmCtx = gtm.StartMulti([]*mongo.Client{ic.coreMongo, ic.learnMongo, ic.testMongo}, config.buildGtmOptions())
+	defer ic.gtmCtx.Stop()
+	ic.start()
+	go startHTTPServer(&httpServerCtx{indexConfig: ic})
+
+	select {
+	case <-c:
+		config.log(mainComponent).Info("Stopping all workers and shutting down")
+	case <-ic.directReadsDone:
+		config.log(mainComponent).Info("Direct reads indexed, shutting down")
+	}
+	if err = ic.batchIndex(); err != nil {
+		config.log(mainComponent).Error("Unable to flush on shutdown", "error", err)
+	}
+	if err = ic.saveTs(); err != nil {
+		config.log(mainComponent).Error("Unable to save checkpoint", "error", err)
+	}
+	ic.saveVersions()
+	return exitOK
+}
+
+func verifyCommand(args []string) int {
+	config := newConfig()
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	config.registerFlags(fs)
+	engine := fs.String("engine", "", "The name of the engine to verify. Defaults to all engines")
+	repair := fs.Bool("repair", false, "True to re-index and delete the differences found")
+	if code, ok := config.parseFlags(fs, args); !ok {
+		return code
+	}
+	ctx, err := newSyncCtx(config)
+	defer ctx.close()
+	if err != nil {
+		config.log(mainComponent).Error(err.Error())
+		return exitFailure
+	}
+	reports := ctx.ic.verify(*engine, *repair)
+	ctx.ic.saveVersions()
+	return verifyExitCode(reports)
+}
+
+// verifyExitCode fails verify when an engine could not be checked, and
+// reports the differences found otherwise.
+func verifyExitCode(reports []*verifyReport) int {
+	code := exitOK
+	for _, r := range reports {
+		if r.Error != "" {
+			return exitFailure
+		}
+		if !r.ok() {
+			code = exitDifferences
+		}
+	}
+	return code
+}
+
+func resyncCommand(args []string) int {
+	config := newConfig()
+	fs := flag.NewFlagSet("resync", flag.ContinueOnError)
+	config.registerFlags(fs)
+	namespace := fs.String("namespace", "", "The namespace to resync")
+	ids := fs.String("ids", "", "Comma separated _ids to resync")
+	filter := fs.String("filter", "", "Mongo extended json filter of the docs to resync")
+	if code, ok := config.parseFlags(fs, args); !ok {
+		return code
+	}
+	req, err := parseResyncRequest(*namespace, *ids, *filter)
+	if err != nil {
+		config.log(mainComponent).Error(err.Error())
+		return exitUsage
+	}
+	ctx, err := newSyncCtx(config)
+	defer ctx.close()
+	if err != nil {
+		config.log(mainComponent).Error(err.Error())
+		return exitFailure
+	}
+	results, err := ctx.ic.resync(req)
+	ctx.ic.saveVersions()
+	if err != nil {
+		config.log(mainComponent).Error("Unable to resync", "error", err)
+		return exitFailure
+	}
+	code := exitOK
+	for _, r := range results {
+		detail := r.Error
+		if detail == "" {
+			detail = r.Reason
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", r.ID, r.AppSearchID, r.Status, detail)
+		if r.Status == resyncFailed {
+			code = exitFailure
+		}
+	}
+	return code
+}
+
+func checkpointCommand(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintf(os.Stderr, "Usage: %s checkpoint show|set|rewind|reset [flags]\n", Name)
+		return exitUsage
+	}
+	action, args := args[0], args[1:]
+	config := newConfig()
+	fs := flag.NewFlagSet("checkpoint "+action, flag.ContinueOnError)
+	config.registerFlags(fs)
+	var ts *int64
+	var by *time.Duration
+	var force *bool
+	switch action {
+	case "set":
+		ts = fs.Int64("ts", 0, "The unix timestamp (in seconds) to resume from")
+	case "rewind":
+		by = fs.Duration("by", 0, "How far to move the checkpoint back, e.g. 30m")
+	}
+	if action != "show" {
+		force = fs.Bool("force", false, "True to change the checkpoint even though a sync with this resume name is running")
+	}
+	if code, ok := config.parseFlags(fs, args); !ok {
+		return code
+	}
+	core, learn, engagement, test, err := config.DialMongo()
+	if err != nil {
+		config.log(mainComponent).Error("Unable to connect to mongodb", "error", err)
+		return exitFailure
+	}
+	defer func() {
+		for _, c := range []*mongo.Client{core, learn, engagement, test} {
+			c.Disconnect(context.Background())
+		}
+	}()
+	ic := &indexClient{
+		config:          config,
+		coreMongo:       core,
+		learnMongo:      learn,
+		engagementMongo: engagement,
+		testMongo:       test,
+	}
+	if config.resume, err = config.newResumeStore(&plugin.MongoClients{
+		CoreMongo:       core,
+		LearnMongo:      learn,
+		EngagementMongo: engagement,
+		TestMongo:       test,
+	}); err != nil {
+		config.log(mainComponent).Error("Unable to open resume store", "error", err)
+		return exitFailure
+	}
+	if force != nil && !*force {
+		if err = config.checkNotRunning(); err != nil {
+			config.log(mainComponent).Error("Refusing to change checkpoint", "error", err)
+			return exitFailure
+		}
+	}
+
+	switch action {
+	case "show":
+		cp, err := ic.loadCheckpoint()
+		if err != nil {
+			config.log(mainComponent).Error("Unable to load checkpoint", "error", err)
+			return exitFailure
+		}
+		out, _ := json.MarshalIndent(cp, "", "    ")
+		fmt.Println(string(out))
+	case "set":
+		if *ts <= 0 {
+			config.log(mainComponent).Error("checkpoint set requires -ts")
+			return exitUsage
+		}
+		if err = config.setCheckpoint(uint32(*ts)); err != nil {
+			config.log(mainComponent).Error("Unable to save checkpoint", "error", err)
+			return exitFailure
+		}
+		fmt.Printf("Checkpoint %s set to %s\n", config.ResumeName, time.Unix(*ts, 0))
+	case "rewind":
+		if *by <= 0 {
+			config.log(mainComponent).Error("checkpoint rewind requires -by")
+			return exitUsage
+		}
+		from, err := config.rewindCheckpoint(*by)
+		if err != nil {
+			config.log(mainComponent).Error("Unable to rewind checkpoint", "error", err)
+			return exitFailure
+		}
+		fmt.Printf("Checkpoint %s rewound to %s\n", config.ResumeName, from)
+	case "reset":
+		if err = config.deleteCheckpoint(); err != nil {
+			config.log(mainComponent).Error("Unable to reset checkpoint", "error", err)
+			return exitFailure
+		}
+		fmt.Printf("Checkpoint %s reset\n", config.ResumeName)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown checkpoint action %s\n", action)
+		return exitUsage
+	}
+	return exitOK
+}
+
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintf(os.Stderr, "Usage: %s config validate [flags]\n", Name)
+		return exitUsage
+	}
+	config := newConfig()
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	config.registerFlags(fs)
+	if code, ok := config.parseFlags(fs, args[1:]); !ok {
+		return code
+	}
+	config.LoadPlugin()
+	errs := config.Validate()
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	if len(errs) > 0 {
+		return exitFailure
+	}
+	fmt.Printf("%s is valid\n", config.ConfigFile)
+	return exitOK
+}
+
+func enginesCommand(args []string) int {
+	if len(args) == 0 || args[0] != "list" {
+		fmt.Fprintf(os.Stderr, "Usage: %s engines list [flags]\n", Name)
+		return exitUsage
+	}
+	config := newConfig()
+	fs := flag.NewFlagSet("engines list", flag.ContinueOnError)
+	config.registerFlags(fs)
+	if code, ok := config.parseFlags(fs, args[1:]); !ok {
+		return code
+	}
+	client, err := newAppSearchClient(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create client: %s\n", err)
+		return exitFailure
+	}
+	defer client.Close()
+	code := exitOK
+	fmt.Printf("%-20s %-30s %-20s %-8s %s\n", "NAME", "NAMESPACE", "ENGINE", "TYPE", "DOCUMENTS")
+	for _, m := range config.EngineConfig {
+		engine, err := client.getEngine(m.Name)
+		switch {
+		case err != nil:
+			fmt.Printf("%-20s %-30s error: %s\n", m.Name, m.Namespace, err)
+			code = exitFailure
+		case engine == nil:
+			fmt.Printf("%-20s %-30s %-20s %-8s %s\n", m.Name, m.Namespace, "-", "missing", "-")
+		default:
+			fmt.Printf("%-20s %-30s %-20s %-8s %d\n", m.Name, m.Namespace, strings.Join(append([]string{engine.Name}, engine.SourceEngines...), ","), engine.Type, engine.DocumentCount)
+		}
+	}
+	return code
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestExecuteExitCodes(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"version", []string{"-v"}, exitOK},
+		{"command help", []string{"verify", "-h"}, exitOK},
+		{"help", []string{"help"}, exitUsage},
+		{"unknown command", []string{"frob"}, exitUsage},
+		{"unknown flag", []string{"run", "-frob"}, exitUsage},
+		{"checkpoint without action", []string{"checkpoint"}, exitUsage},
+		{"checkpoint flag without action", []string{"checkpoint", "-ts", "1"}, exitUsage},
+		{"config without action", []string{"config"}, exitUsage},
+		{"engines without action", []string{"engines", "show"}, exitUsage},
+		{"invalid config", []string{"config", "validate"}, exitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := execute(tt.args); got != tt.want {
+				t.Errorf("execute(%v) = %d, want %d", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyExitCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		reports []*verifyReport
+		want    int
+	}{
+		{"no engines", nil, exitOK},
+		{"in sync", []*verifyReport{{}, {}}, exitOK},
+		{"repaired", []*verifyReport{{Missing: []string{"1"}, Repaired: true}}, exitOK},
+		{"differences", []*verifyReport{{}, {Differing: []string{"1"}}}, exitDifferences},
+		{"unlisted extra docs", []*verifyReport{{ExtraPartial: true, Unlisted: 2}}, exitDifferences},
+		{"engine not checked", []*verifyReport{{Differing: []string{"1"}}, {Error: "unreachable"}}, exitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyExitCode(tt.reports); got != tt.want {
+				t.Errorf("verifyExitCode() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,9 +3,9 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
-	"os"
 	"plugin"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	client "github.com/testbook/app-search-client"
@@ -14,40 +14,70 @@ import (
 )
 
 type engineConfig struct {
-	Name           string
-	Namespace      string // mongo namespace
-	ChangeStreamNS string
-	DirectReadNS   string
-	FunctionName   string // function name within plugins
-	Plugin         MapperPlugin
+	Name                  string
+	Namespace             string // mongo namespace
+	ChangeStreamNS        string
+	DirectReadNS          string
+	FunctionName          string                 // function name within plugins
+	FilterFunctionName    string                 // filter function name within plugins
+	Filter                map[string]interface{} // mongo style match expression
+	Plugin                MapperPlugin
+	BatchPlugin           BatchMapperPlugin
+	FilterPlugin          FilterPlugin
+	PluginConfig          map[string]interface{} // passed to the plugin Init and mapping functions
+	IDSeparator           string                 // joins the values of a composite _id
+	IDFields              []string               // order of the composite _id values
+	Normalize             *normalizeSettings     // overrides of the global normalize settings
+	Language              string                 // language of the engine when created by the sync
+	Schema                map[string]string      // field name -> text, number, date or geolocation
+	BlockUnexpectedFields bool                   // drop docs with fields missing from the schema
+	MetaEngine            bool                   // serve the engine as a meta engine over versioned source engines
+	Cluster               string                 // core, learn, engagement or test; defaults to core
+	Disabled              bool                   // start with the engine disabled, spilling its docs to disk
+
+	sourceEngine string // the current source engine of a meta engine
 }
 
 type logFiles struct {
-	Error string `toml:"error"`
-	Info  string `toml:"info"`
+	Error      string `toml:"error"`
+	Info       string `toml:"info"`
+	MaxSize    int    `toml:"max-size"`    // megabytes before a file is rotated, 100 when unset
+	MaxBackups int    `toml:"max-backups"` // rotated files to keep, all when unset
+	MaxAge     int    `toml:"max-age"`     // days to keep rotated files, forever when unset
+	Compress   bool   `toml:"compress"`    // gzip rotated files
+	LocalTime  bool   `toml:"local-time"`  // name rotated files in local time instead of UTC
 }
 
 type configOptions struct {
-	EnableHTTPServer         bool        `toml:"enable-http-server"`
-	HTTPServerAddr           string      `toml:"http-server-addr"` // port for http stats server
-	Logs                     logFiles    `toml:"logs"`
-	CoreMongoURL             string      `toml:"core-mongo-url"`
-	LearnMongoURL            string      `toml:"learn-mongo-url"`
-	EngagementMongoURL       string      `toml:"engagement-mongo-url"`
-	TestMongoURL             string      `toml:"test-mongo-url"`
-	MongoOpLogDatabaseName   string      `toml:"mongo-oplog-database-name"`
-	MongoOpLogCollectionName string      `toml:"mongo-oplog-collection-name"`
-	GtmSettings              gtmSettings `toml:"gtm-settings"`
-	ResumeName               string      `toml:"resume-name"`
+	EnableHTTPServer         bool              `toml:"enable-http-server"`
+	HTTPServerAddr           string            `toml:"http-server-addr"` // port for http stats server
+	Logs                     logFiles          `toml:"logs"`
+	Logging                  loggingSettings   `toml:"logging"`
+	CoreMongoURL             string            `toml:"core-mongo-url"`
+	LearnMongoURL            string            `toml:"learn-mongo-url"`
+	EngagementMongoURL       string            `toml:"engagement-mongo-url"`
+	TestMongoURL             string            `toml:"test-mongo-url"`
+	MongoOpLogDatabaseName   string            `toml:"mongo-oplog-database-name"`
+	MongoOpLogCollectionName string            `toml:"mongo-oplog-collection-name"`
+	GtmSettings              gtmSettings       `toml:"gtm-settings"`
+	Normalize                normalizeSettings `toml:"normalize"`
+	ResumeName               string            `toml:"resume-name"`
 	Version                  bool
-	Verbose                  bool           `toml:"verbose"`
-	Stats                    bool           `toml:"stats"`
-	Pprof                    bool           `toml:"pprof"`
-	Resume                   bool           `toml:"resume"`
-	ResumeStrategy           resumeStrategy `toml:"resume-strategy"`
-	ResumeWriteUnsafe        bool           `toml:"resume-write-unsafe"`
-	ResumeFromTimestamp      int64          `toml:"resume-from-timestamp"`
+	Verbose                  bool                `toml:"verbose"`
+	Stats                    bool                `toml:"stats"`
+	Pprof                    bool                `toml:"pprof"`
+	Resume                   bool                `toml:"resume"`
+	ResumeStrategy           resumeStrategy      `toml:"resume-strategy"`
+	ResumeWriteUnsafe        bool                `toml:"resume-write-unsafe"`
+	ResumeFromTimestamp      int64               `toml:"resume-from-timestamp"`
+	ResumeStore              resumeStoreSettings `toml:"resume-store"`
+	Tracing                  tracingSettings     `toml:"tracing"`
+	Audit                    auditSettings       `toml:"audit"`
+	Spill                    spillSettings       `toml:"spill"`
+	HTTPServer               httpServerSettings  `toml:"http-server"`
 	Replay                   bool
+	Backfill                 bool
+	BackfillEngines          []string // limits direct reads to these engines when set
 	ConfigFile               string
 	AppSearchURL             string `toml:"app-search-url"`
 	AppSearchAPIKey          string `toml:"app-search-api-key"`
@@ -58,49 +88,78 @@ type configOptions struct {
 	PluginPath               string `toml:"plugin-path"`
 	FlushBufferSize          int    `toml:"flush-buffer-size"`
 	FlushInterval            int    `toml:"flush-interval"`
+	MaxLag                   int    `toml:"max-lag"`       // seconds of lag after which /health fails, 0 to disable
+	ControlToken             string `toml:"control-token"` // bearer token of the control api, disabled when unset
+	IDSeparator              string `toml:"id-separator"`
+	StaleWriteProtection     bool   `toml:"stale-write-protection"`
+	ProvisionEngines         bool   `toml:"provision-engines"`
+	FailOnSchemaConflict     bool   `toml:"fail-on-schema-conflict"`
+	DetectSchemaDrift        bool   `toml:"detect-schema-drift"`
+	Reindex                  bool   `toml:"reindex"`
+	ReindexDeleteOld         bool   `toml:"reindex-delete-old"`
+	VersionStorePath         string `toml:"version-store-path"`
+	VersionStoreMaxDocs      int    `toml:"version-store-max-docs"`
 	EngineConfig             []*engineConfig
+	PluginInit               InitPlugin
+	PluginShutdown           ShutdownPlugin
 
-	InfoLogger  *log.Logger
-	ErrorLogger *log.Logger
+	pluginClients *MongoClients
+	resume        resumeStore
+	logs          *logOutput
+	tracer        *tracer
+	audit         *auditLog
 }
 
-func (config *configOptions) ParseCommandLineFlags() *configOptions {
-	flag.BoolVar(&config.EnableHTTPServer, "enable-http-server", false, "True to enable an internal http server")
-	flag.StringVar(&config.HTTPServerAddr, "http-server-addr", "", "The address the internal http server listens on")
-	flag.StringVar(&config.AppSearchURL, "app-search-url", "", "App search connection URL")
-	flag.StringVar(&config.AppSearchAPIKey, "app-search-api-key", "", "App search api key")
-	flag.IntVar(&config.AppSearchClients, "app-search-clients", 1, "The number of concurrent app search clients")
-	flag.StringVar(&config.CoreMongoURL, "core-mongo-url", "", "Core MongoDB connection URL")
-	flag.StringVar(&config.LearnMongoURL, "learn-mongo-url", "", "Learn MongoDB connection URL")
-	flag.StringVar(&config.EngagementMongoURL, "engagement-mongo-url", "", "Engagement MongoDB connection URL")
-	flag.StringVar(&config.TestMongoURL, "test-mongo-url", "", "Test MongoDB connection URL")
-	flag.StringVar(&config.MongoOpLogDatabaseName, "mongo-oplog-database-name", "", "Override the database name which contains the mongodb oplog")
-	flag.StringVar(&config.MongoOpLogCollectionName, "mongo-oplog-collection-name", "", "Override the collection name which contains the mongodb oplog")
-	flag.StringVar(&config.ConfigFile, "f", "", "Location of configuration file")
-	flag.BoolVar(&config.Version, "v", false, "True to print the version number")
-	flag.BoolVar(&config.Verbose, "verbose", false, "True to output verbose messages")
-	flag.BoolVar(&config.Resume, "resume", false, "True to capture the last timestamp of this run and resume on a subsequent run")
-	flag.Var(&config.ResumeStrategy, "resume-strategy", "Strategy to use for resuming. 0=timestamp,1=token")
-	flag.Int64Var(&config.ResumeFromTimestamp, "resume-from-timestamp", 0, "Timestamp to resume syncing from")
-	flag.BoolVar(&config.ResumeWriteUnsafe, "resume-write-unsafe", false, "True to speedup writes of the last timestamp synched for resuming at the cost of error checking")
-	flag.BoolVar(&config.Replay, "replay", false, "True to replay all events from the oplog and index them in elasticsearch")
-	flag.BoolVar(&config.Stats, "stats", false, "Enable stats for updates")
-	flag.BoolVar(&config.Pprof, "pprof", false, "Enable pprof profiling")
-	flag.StringVar(&config.ResumeName, "resume-name", "", "Name under which to load/store the resume state. Defaults to 'default'")
-	flag.StringVar(&config.PluginPath, "plugin-path", "", "The file path to a .so file plugin")
-	flag.BoolVar(&config.DirectReads, "direct-reads", false, "Set to true to read directly from MongoDB collections")
-	flag.BoolVar(&config.ChangeStreams, "change-streams", false, "Set to true to enable change streams for MongoDB 3.6+")
-	flag.BoolVar(&config.ExitAfterDirectReads, "exit-after-direct-reads", false, "Set to true to exit after direct reads are complete")
-	flag.IntVar(&config.FlushBufferSize, "flush-buffer-size", 10, "After this number of docs the batch is flushed to appsearch")
-	flag.IntVar(&config.FlushInterval, "flush-interval", 10, "Defined interval (in seconds) for which the batch is flushed to appsearch")
-	flag.Parse()
-	return config
+// registerFlags adds the connection flags shared by every command.
+func (config *configOptions) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&config.AppSearchURL, "app-search-url", "", "App search connection URL")
+	fs.StringVar(&config.AppSearchAPIKey, "app-search-api-key", "", "App search api key")
+	fs.StringVar(&config.CoreMongoURL, "core-mongo-url", "", "Core MongoDB connection URL")
+	fs.StringVar(&config.LearnMongoURL, "learn-mongo-url", "", "Learn MongoDB connection URL")
+	fs.StringVar(&config.EngagementMongoURL, "engagement-mongo-url", "", "Engagement MongoDB connection URL")
+	fs.StringVar(&config.TestMongoURL, "test-mongo-url", "", "Test MongoDB connection URL")
+	fs.StringVar(&config.MongoOpLogDatabaseName, "mongo-oplog-database-name", "", "Override the database name which contains the mongodb oplog")
+	fs.StringVar(&config.MongoOpLogCollectionName, "mongo-oplog-collection-name", "", "Override the collection name which contains the mongodb oplog")
+	fs.StringVar(&config.ConfigFile, "f", "", "Location of configuration file")
+	fs.BoolVar(&config.Version, "v", false, "True to print the version number")
+	fs.BoolVar(&config.Verbose, "verbose", false, "True to log at debug level when [logging] sets no level")
+	fs.Var(&config.ResumeStrategy, "resume-strategy", "Strategy to use for resuming. 0=timestamp,1=token")
+	fs.StringVar(&config.ResumeName, "resume-name", "", "Name under which to load/store the resume state. Defaults to 'default'")
+	fs.StringVar(&config.PluginPath, "plugin-path", "", "The file path to a .so file plugin")
+}
+
+// registerSyncFlags adds the flags of the commands that run the sync.
+func (config *configOptions) registerSyncFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&config.EnableHTTPServer, "enable-http-server", false, "True to enable an internal http server")
+	fs.StringVar(&config.HTTPServerAddr, "http-server-addr", "", "The address the internal http server listens on")
+	fs.IntVar(&config.AppSearchClients, "app-search-clients", 1, "The number of concurrent app search clients")
+	fs.BoolVar(&config.Resume, "resume", false, "True to capture the last timestamp of this run and resume on a subsequent run")
+	fs.Int64Var(&config.ResumeFromTimestamp, "resume-from-timestamp", 0, "Timestamp to resume syncing from")
+	fs.BoolVar(&config.ResumeWriteUnsafe, "resume-write-unsafe", false, "True to speedup writes of the last timestamp synched for resuming at the cost of error checking")
+	fs.BoolVar(&config.Replay, "replay", false, "True to replay all events from the oplog and index them in elasticsearch")
+	fs.BoolVar(&config.Stats, "stats", false, "Enable stats for updates")
+	fs.BoolVar(&config.Pprof, "pprof", false, "Enable pprof profiling")
+	fs.BoolVar(&config.DirectReads, "direct-reads", false, "Set to true to read directly from MongoDB collections")
+	fs.BoolVar(&config.ChangeStreams, "change-streams", false, "Set to true to enable change streams for MongoDB 3.6+")
+	fs.BoolVar(&config.ExitAfterDirectReads, "exit-after-direct-reads", false, "Set to true to exit after direct reads are complete")
+	fs.IntVar(&config.FlushBufferSize, "flush-buffer-size", 10, "After this number of docs the batch is flushed to appsearch")
+	fs.BoolVar(&config.StaleWriteProtection, "stale-write-protection", false, "True to refuse indexing a document version older than the last one indexed")
+	fs.StringVar(&config.VersionStorePath, "version-store-path", "", "The file in which the last indexed document versions are kept")
+	fs.IntVar(&config.VersionStoreMaxDocs, "version-store-max-docs", 0, "The number of most recently indexed document versions kept")
+	fs.BoolVar(&config.ProvisionEngines, "provision-engines", false, "True to create missing engines and schema fields on startup")
+	fs.BoolVar(&config.FailOnSchemaConflict, "fail-on-schema-conflict", false, "True to refuse to start when a schema field type differs from the config")
+	fs.BoolVar(&config.DetectSchemaDrift, "detect-schema-drift", false, "True to compare the fields of indexed docs with the live engine schema")
+	fs.BoolVar(&config.Reindex, "reindex", false, "True to rebuild meta engines into new source engines and swap them once direct reads complete")
+	fs.BoolVar(&config.ReindexDeleteOld, "reindex-delete-old", false, "True to delete the previous source engines after a reindex")
+	fs.IntVar(&config.FlushInterval, "flush-interval", 10, "Defined interval (in seconds) for which the batch is flushed to appsearch")
+	fs.IntVar(&config.MaxLag, "max-lag", 0, "Replication lag (in seconds) above which /health reports unhealthy, 0 to disable")
 }
 
 func (config *configOptions) LoadConfigFile() *configOptions {
 	if config.ConfigFile != "" {
 		var tomlConfig configOptions = configOptions{
 			GtmSettings: GtmDefaultSettings(),
+			Normalize:   defaultNormalizeSettings(),
 		}
 		if _, err := toml.DecodeFile(config.ConfigFile, &tomlConfig); err != nil {
 			panic(err)
@@ -111,6 +170,12 @@ func (config *configOptions) LoadConfigFile() *configOptions {
 		if config.HTTPServerAddr == "" {
 			config.HTTPServerAddr = tomlConfig.HTTPServerAddr
 		}
+		if config.MaxLag == 0 {
+			config.MaxLag = tomlConfig.MaxLag
+		}
+		if config.ControlToken == "" {
+			config.ControlToken = tomlConfig.ControlToken
+		}
 		if config.AppSearchURL == "" {
 			config.AppSearchURL = tomlConfig.AppSearchURL
 		}
@@ -162,7 +227,7 @@ func (config *configOptions) LoadConfigFile() *configOptions {
 		if config.ResumeFromTimestamp == 0 {
 			config.ResumeFromTimestamp = tomlConfig.ResumeFromTimestamp
 		}
-		if config.Resume && config.ResumeName == "" {
+		if config.ResumeName == "" {
 			config.ResumeName = tomlConfig.ResumeName
 		}
 		if config.PluginPath == "" {
@@ -171,24 +236,51 @@ func (config *configOptions) LoadConfigFile() *configOptions {
 		if config.FlushBufferSize == 0 {
 			config.FlushBufferSize = tomlConfig.FlushBufferSize
 		}
+		if config.IDSeparator == "" {
+			config.IDSeparator = tomlConfig.IDSeparator
+		}
+		if !config.StaleWriteProtection && tomlConfig.StaleWriteProtection {
+			config.StaleWriteProtection = true
+		}
+		if config.VersionStorePath == "" {
+			config.VersionStorePath = tomlConfig.VersionStorePath
+		}
+		if config.VersionStoreMaxDocs == 0 {
+			config.VersionStoreMaxDocs = tomlConfig.VersionStoreMaxDocs
+		}
+		if !config.ProvisionEngines && tomlConfig.ProvisionEngines {
+			config.ProvisionEngines = true
+		}
+		if !config.FailOnSchemaConflict && tomlConfig.FailOnSchemaConflict {
+			config.FailOnSchemaConflict = true
+		}
+		if !config.DetectSchemaDrift && tomlConfig.DetectSchemaDrift {
+			config.DetectSchemaDrift = true
+		}
+		if !config.Reindex && tomlConfig.Reindex {
+			config.Reindex = true
+		}
+		if !config.ReindexDeleteOld && tomlConfig.ReindexDeleteOld {
+			config.ReindexDeleteOld = true
+		}
 		if config.Stats || tomlConfig.Stats {
 			config.Stats = true
 		}
 		if config.Pprof || tomlConfig.Pprof {
 			config.Pprof = true
 		}
-		if config.HTTPServerAddr == "" {
-			config.HTTPServerAddr = tomlConfig.HTTPServerAddr
-		}
 
-		if config.Logs.Error == "" && tomlConfig.Logs.Error != "" {
-			config.ErrorLogger.SetOutput(config.newLogger(tomlConfig.Logs.Error))
-		}
-		if config.Logs.Error == "" && tomlConfig.Logs.Info != "" {
-			config.InfoLogger.SetOutput(config.newLogger(tomlConfig.Logs.Info))
-		}
+		config.Logs = tomlConfig.Logs
+		config.openLogFiles()
+		config.Logging = tomlConfig.Logging
 
 		config.GtmSettings = tomlConfig.GtmSettings
+		config.ResumeStore = tomlConfig.ResumeStore
+		config.Tracing = tomlConfig.Tracing
+		config.Audit = tomlConfig.Audit
+		config.Spill = tomlConfig.Spill
+		config.HTTPServer = tomlConfig.HTTPServer
+		config.Normalize = tomlConfig.Normalize
 		config.EngineConfig = tomlConfig.EngineConfig
 	}
 	return config
@@ -213,55 +305,218 @@ func (config *configOptions) SetDefaults() *configOptions {
 	if config.FlushBufferSize == 0 {
 		config.FlushBufferSize = indexClientBufferDefault
 	}
+	if config.IDSeparator == "" {
+		config.IDSeparator = idSeparatorDefault
+	}
+	if config.VersionStorePath == "" {
+		config.VersionStorePath = versionStorePathDefault
+	}
+	if config.VersionStoreMaxDocs <= 0 {
+		config.VersionStoreMaxDocs = versionMaxDocsDefault
+	}
+	if config.ResumeStore.Type == "" {
+		config.ResumeStore.Type = mongoResumeStoreType
+	}
+	if config.ResumeStore.Database == "" {
+		config.ResumeStore.Database = Name
+	}
+	if config.ResumeStore.Path == "" {
+		switch config.ResumeStore.Type {
+		case fileResumeStoreType:
+			config.ResumeStore.Path = resumeStoreFileDefault
+		case kvResumeStoreType:
+			config.ResumeStore.Path = resumeStoreDirDefault
+		}
+	}
+	if config.Tracing.Endpoint == "" {
+		config.Tracing.Endpoint = tracingEndpointDefault
+	}
+	if config.Tracing.ServiceName == "" {
+		config.Tracing.ServiceName = Name
+	}
+	if config.Audit.Database == "" {
+		config.Audit.Database = Name
+	}
+	if config.Audit.Collection == "" {
+		config.Audit.Collection = auditCollectionDefault
+	}
+	if config.Audit.MaxSize <= 0 {
+		config.Audit.MaxSize = auditMaxSizeDefault
+	}
+	if config.HTTPServerAddr == "" {
+		config.HTTPServerAddr = defaultHttpAddr
+	}
+	if config.Spill.Dir == "" {
+		config.Spill.Dir = spillDirDefault
+	}
+	if config.Spill.MaxSize <= 0 {
+		config.Spill.MaxSize = spillMaxSizeDefault
+	}
 	if config.AppSearchClients <= 0 {
 		config.AppSearchClients = 1
 	}
-	if config.InfoLogger == nil {
-		config.InfoLogger = log.New(os.Stdout, "INFO ", log.Flags())
-	}
-	if config.ErrorLogger == nil {
-		config.ErrorLogger = log.New(os.Stdout, "ERROR ", log.Flags())
+	if err := config.log(mainComponent).out.configure(config.Logging, config.Verbose); err != nil {
+		config.log(mainComponent).Fatal("Invalid logging settings", "error", err)
 	}
 	if config.ConfigFile == "" {
 		config.ConfigFile = defaultConfigFile
 	}
+	if config.Reindex {
+		config.DirectReads = true
+	}
 	return config
 }
 
 func (config *configOptions) LoadPlugin() *configOptions {
+	log := config.log(pluginComponent).With("plugin", config.PluginPath)
 	if config.PluginPath == "" {
-		if config.Verbose {
-			config.InfoLogger.Println("no plugins detected")
-		}
+		log.Debug("No plugins detected")
 		return config
 	}
 	p, err := plugin.Open(config.PluginPath)
 	if err != nil {
-		config.ErrorLogger.Fatalf("Unable to load plugin <%s>: %s", config.PluginPath, err)
+		log.Fatal("Unable to load plugin", "error", err)
 	}
 
 	for _, m := range config.EngineConfig {
+		if m.FilterFunctionName != "" {
+			f, err := p.Lookup(m.FilterFunctionName)
+			if err != nil {
+				log.Fatal("Unable to lookup plugin symbol", "symbol", m.FilterFunctionName, "error", err)
+			}
+			switch f := f.(type) {
+			case func(*MapperPluginInput) (bool, error):
+				m.FilterPlugin = f
+			default:
+				log.Fatal(fmt.Sprintf("Plugin symbol must be typed %T", m.FilterPlugin), "symbol", m.FilterFunctionName)
+			}
+		}
 		if m.FunctionName == "" {
 			continue
 		}
 		f, err := p.Lookup(m.FunctionName)
 		if err != nil {
-			config.ErrorLogger.Fatalf("Unable to lookup symbol <%s> for plugin <%s>: %s", m.FunctionName, config.PluginPath, err)
+			log.Fatal("Unable to lookup plugin symbol", "symbol", m.FunctionName, "error", err)
 		}
 
 		switch f := f.(type) {
 		case func(*MapperPluginInput) (*MapperPluginOutput, error):
 			m.Plugin = f
+		case func([]*MapperPluginInput) ([]*MapperPluginOutput, error):
+			m.BatchPlugin = f
 		default:
-			config.ErrorLogger.Fatalf("Plugin symbol <%s> must be typed %T", m.FunctionName, m.Plugin)
+			log.Fatal(fmt.Sprintf("Plugin symbol must be typed %T or %T", m.Plugin, m.BatchPlugin), "symbol", m.FunctionName)
 		}
 	}
-	if config.Verbose {
-		config.InfoLogger.Printf("plugin <%s> loaded succesfully\n", config.PluginPath)
+	if f, err := p.Lookup("Init"); err == nil {
+		switch f := f.(type) {
+		case func(map[string]interface{}, *MongoClients) error:
+			config.PluginInit = f
+		default:
+			log.Fatal(fmt.Sprintf("Plugin symbol must be typed %T", config.PluginInit), "symbol", "Init")
+		}
+	}
+	if f, err := p.Lookup("Shutdown"); err == nil {
+		switch f := f.(type) {
+		case func():
+			config.PluginShutdown = f
+		default:
+			log.Fatal(fmt.Sprintf("Plugin symbol must be typed %T", config.PluginShutdown), "symbol", "Shutdown")
+		}
 	}
+	log.Debug("Plugin loaded successfully")
 	return config
 }
 
+func (config *configOptions) InitPlugin(clients *MongoClients) error {
+	config.pluginClients = clients
+	if config.PluginInit == nil {
+		return nil
+	}
+	pluginConfig := make(map[string]interface{})
+	for _, m := range config.EngineConfig {
+		if m.PluginConfig != nil {
+			pluginConfig[m.Name] = m.PluginConfig
+		}
+	}
+	return config.PluginInit(pluginConfig, clients)
+}
+
+func (config *configOptions) ShutdownPlugin() {
+	if config.PluginShutdown != nil {
+		config.PluginShutdown()
+	}
+}
+
+// Validate checks the loaded configuration and returns every problem found.
+func (config *configOptions) Validate() (errs []error) {
+	if len(config.EngineConfig) == 0 {
+		errs = append(errs, fmt.Errorf("no engine configuration found"))
+	}
+	if _, err := time.ParseDuration(config.GtmSettings.BufferDuration); err != nil {
+		errs = append(errs, fmt.Errorf("gtm-settings: invalid buffer-duration %s: %s", config.GtmSettings.BufferDuration, err))
+	}
+	if config.ResumeStrategy != timestampResumeStrategy && config.ResumeStrategy != tokenResumeStrategy {
+		errs = append(errs, fmt.Errorf("invalid resume-strategy %d", config.ResumeStrategy))
+	}
+	if err := newLogOutput().configure(config.Logging, false); err != nil {
+		errs = append(errs, fmt.Errorf("logging: %s", err))
+	}
+	for component := range config.Logging.Components {
+		if !containsString(logComponents, component) {
+			errs = append(errs, fmt.Errorf("logging: unknown component %s, expected one of %s", component, strings.Join(logComponents, ", ")))
+		}
+	}
+	if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("tracing: sample-ratio %v must be between 0 and 1", config.Tracing.SampleRatio))
+	}
+	if (config.HTTPServer.TLSCert == "") != (config.HTTPServer.TLSKey == "") {
+		errs = append(errs, fmt.Errorf("http-server: tls-cert and tls-key must be set together"))
+	}
+	if config.HTTPServer.Username != "" && config.HTTPServer.Password == "" {
+		errs = append(errs, fmt.Errorf("http-server: password is required with username"))
+	}
+	if addr := config.HTTPServer.PprofAddr; addr != "" && !isLoopbackAddr(addr) {
+		errs = append(errs, fmt.Errorf("http-server: pprof-addr %s must be a loopback address such as 127.0.0.1:6060", addr))
+	}
+	if config.Audit.SampleRatio < 0 || config.Audit.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("audit: sample-ratio %v must be between 0 and 1", config.Audit.SampleRatio))
+	}
+	switch config.Audit.Cluster {
+	case "", "core", "learn", "engagement", "test":
+	default:
+		errs = append(errs, fmt.Errorf("audit: unknown cluster %s", config.Audit.Cluster))
+	}
+	namespaces := make(map[string]bool)
+	for i, m := range config.EngineConfig {
+		if m.Name == "" {
+			errs = append(errs, fmt.Errorf("engineConfig %d: name is required", i))
+		}
+		if _, err := parseNamespace(m.Namespace); err != nil {
+			errs = append(errs, fmt.Errorf("engine %s: %s", m.Name, err))
+		} else if namespaces[m.Namespace] {
+			errs = append(errs, fmt.Errorf("engine %s: namespace %s is used by another engine", m.Name, m.Namespace))
+		}
+		namespaces[m.Namespace] = true
+		switch m.Cluster {
+		case "", "core", "learn", "engagement", "test":
+		default:
+			errs = append(errs, fmt.Errorf("engine %s: unknown cluster %s", m.Name, m.Cluster))
+		}
+		for field, fieldType := range m.Schema {
+			if !schemaFieldTypes[fieldType] {
+				errs = append(errs, fmt.Errorf("engine %s: field %s has unsupported type %s", m.Name, field, fieldType))
+			}
+		}
+		if m.Filter != nil {
+			if err := validateFilter(m.Filter); err != nil {
+				errs = append(errs, fmt.Errorf("engine %s: invalid filter: %s", m.Name, err))
+			}
+		}
+	}
+	return errs
+}
+
 func (config *configOptions) GetHTTPConfig() client.HTTPConfig {
 	httpConfig := client.HTTPConfig{
 		Addr:      config.AppSearchURL,
@@ -273,6 +528,29 @@ func (config *configOptions) GetHTTPConfig() client.HTTPConfig {
 
 func (config *configOptions) newLogger(path string) *lumberjack.Logger {
 	return &lumberjack.Logger{
-		Filename: path,
+		Filename:   path,
+		MaxSize:    config.Logs.MaxSize,
+		MaxBackups: config.Logs.MaxBackups,
+		MaxAge:     config.Logs.MaxAge,
+		Compress:   config.Logs.Compress,
+		LocalTime:  config.Logs.LocalTime,
+	}
+}
+
+// openLogFiles sends the logs to the files of the logs table. Info and error
+// logs configured with the same file share one logger so that it is rotated
+// once.
+func (config *configOptions) openLogFiles() {
+	var infoLog, errorLog *lumberjack.Logger
+	if config.Logs.Info != "" {
+		infoLog = config.newLogger(config.Logs.Info)
+	}
+	if config.Logs.Error != "" {
+		if config.Logs.Error == config.Logs.Info {
+			errorLog = infoLog
+		} else {
+			errorLog = config.newLogger(config.Logs.Error)
+		}
 	}
+	config.log(mainComponent).out.setFiles(infoLog, errorLog)
 }
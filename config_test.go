@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/rwynn/gtm"
+	"github.com/testbook/app-search-sync/plugin"
+)
+
+// tempDir returns a directory removed once the test ends.
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "app-search-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestInitPlugin(t *testing.T) {
+	clients := &plugin.MongoClients{}
+	config := newConfig()
+	config.EngineConfig = []*engineConfig{
+		{Name: "courses", Namespace: "db.courses", PluginConfig: map[string]interface{}{"lookup": "db.tags"}},
+		{Name: "tests", Namespace: "db.tests"},
+	}
+	if err := config.InitPlugin(clients); err != nil {
+		t.Fatalf("InitPlugin() without an Init symbol error = %v", err)
+	}
+
+	var gotConfig map[string]interface{}
+	var gotClients *plugin.MongoClients
+	config.PluginInit = func(c map[string]interface{}, m *plugin.MongoClients) error {
+		gotConfig, gotClients = c, m
+		return nil
+	}
+	if err := config.InitPlugin(clients); err != nil {
+		t.Fatalf("InitPlugin() error = %v", err)
+	}
+	want := map[string]interface{}{"courses": map[string]interface{}{"lookup": "db.tags"}}
+	if !reflect.DeepEqual(gotConfig, want) {
+		t.Errorf("Init config = %v, want %v", gotConfig, want)
+	}
+	if gotClients != clients || config.pluginClients != clients {
+		t.Error("Init was not passed the mongo clients")
+	}
+
+	config.PluginInit = func(map[string]interface{}, *plugin.MongoClients) error { return errors.New("boom") }
+	if err := config.InitPlugin(clients); err == nil {
+		t.Error("InitPlugin() error = nil, want the Init error")
+	}
+}
+
+func TestShutdownPlugin(t *testing.T) {
+	config := newConfig()
+	config.ShutdownPlugin() // no Shutdown symbol
+	calls := 0
+	config.PluginShutdown = func() { calls++ }
+	config.ShutdownPlugin()
+	if calls != 1 {
+		t.Errorf("Shutdown called %d times, want 1", calls)
+	}
+}
+
+func TestEnginePluginConfig(t *testing.T) {
+	pluginConfig := map[string]interface{}{"lookup": "db.tags"}
+	ic, _ := newTestIndexClient(t, "")
+	ic.config.Spill.Dir = tempDir(t)
+	ic.config.EngineConfig = []*engineConfig{{Name: "courses", Namespace: "db.courses", PluginConfig: pluginConfig}}
+	if err := ic.setupEngines(); err != nil {
+		t.Fatal(err)
+	}
+	e := ic.engines["db.courses"]
+	if got := ic.mapperInput(e, &gtm.Op{Namespace: "db.courses"}).Config; !reflect.DeepEqual(got, pluginConfig) {
+		t.Errorf("mapper input config = %v, want %v", got, pluginConfig)
+	}
+}
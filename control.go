@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rwynn/gtm"
+)
+
+// pauseGate stops the index loops from reading ops while the change streams
+// and direct reads stay open, gtm holding back once its channel is full. The
+// gate is held by owners, the operator or a full spill file, and opens again
+// once all of them have released it.
+type pauseGate struct {
+	mutex   sync.Mutex
+	owners  map[string]bool
+	since   time.Time
+	resumed chan struct{} // closed when the gate opens again
+}
+
+// Owners of the pause gate.
+const (
+	operatorPause = "operator"
+	spillPause    = "spill:" // followed by the engine name
+)
+
+func newPauseGate() *pauseGate {
+	return &pauseGate{owners: make(map[string]bool)}
+}
+
+// pause holds the gate for owner, closing it when open. It returns false when
+// owner already holds the gate.
+func (g *pauseGate) pause(owner string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.owners[owner] {
+		return false
+	}
+	if len(g.owners) == 0 {
+		g.since, g.resumed = time.Now(), make(chan struct{})
+	}
+	g.owners[owner] = true
+	return true
+}
+
+// resume releases the gate held by owner, opening it when no other owner holds
+// it. It returns false when owner does not hold the gate.
+func (g *pauseGate) resume(owner string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if !g.owners[owner] {
+		return false
+	}
+	delete(g.owners, owner)
+	if len(g.owners) == 0 {
+		close(g.resumed)
+	}
+	return true
+}
+
+// heldBy returns the sorted owners holding the gate, none when open.
+func (g *pauseGate) heldBy() []string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	owners := make([]string, 0, len(g.owners))
+	for owner := range g.owners {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// logReleased logs whether the consumption of ops resumed once an owner
+// released the gate.
+func (g *pauseGate) logReleased(log *logger) {
+	if owners := g.heldBy(); len(owners) > 0 {
+		log.Warn("Consumption of ops still paused", "paused_by", strings.Join(owners, ","))
+	} else {
+		log.Info("Consumption of ops resumed")
+	}
+}
+
+// opChannel returns the channel the index loops read ops from, nil while
+// paused along with a channel closed on resume.
+func (g *pauseGate) opChannel(opC chan *gtm.Op) (chan *gtm.Op, chan struct{}) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if len(g.owners) > 0 {
+		return nil, g.resumed
+	}
+	return opC, nil
+}
+
+type controlStatus struct {
+	Paused         bool     `json:"paused"`
+	PausedSince    string   `json:"pausedSince,omitempty"`
+	PausedBy       []string `json:"pausedBy,omitempty"` // operator or spill:{engine}
+	Buffered       int      `json:"buffered"`           // docs, deletes and ops waiting for a flush
+	Queued         int      `json:"queued"`             // ops read by gtm waiting for the index loops
+	CheckpointHeld bool     `json:"checkpointHeld"`     // checkpoints are not saved since the checkpoint was changed
+}
+
+func (ic *indexClient) controlStatus() *controlStatus {
+	status := &controlStatus{}
+	ic.pause.mutex.Lock()
+	if status.Paused = len(ic.pause.owners) > 0; status.Paused {
+		status.PausedSince = ic.pause.since.UTC().Format(time.RFC3339)
+	}
+	ic.pause.mutex.Unlock()
+	status.PausedBy = ic.pause.heldBy()
+	ic.indexMutex.Lock()
+	for _, e := range ic.engines {
+		status.Buffered += e.buffered()
+	}
+	status.CheckpointHeld = ic.checkpointHeld
+	ic.indexMutex.Unlock()
+	if ic.gtmCtx != nil {
+		status.Queued = len(ic.gtmCtx.OpC)
+	}
+	return status
+}
+
+// authorized checks the bearer token of a request against the control token.
+func authorized(req *http.Request, token string) bool {
+	auth := req.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// controlAuthorized checks the control token of a request, answering it when
+// the control api is disabled or the token is missing or wrong.
+func (ctx *httpServerCtx) controlAuthorized(w http.ResponseWriter, req *http.Request) bool {
+	token := ctx.indexConfig.config.ControlToken
+	if token == "" {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "The control api is disabled, set control-token to enable it")
+		return false
+	}
+	if !authorized(req, token) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="control"`)
+		w.WriteHeader(401)
+		return false
+	}
+	return true
+}
+
+// control serves the runtime control api: GET /control reports the status and
+// POST /control/{pause,resume,flush,checkpoint,resync} acts on the running
+// sync, GET /control/checkpoint showing the saved checkpoint. It is disabled
+// unless a control-token is configured, which requests must carry.
+func (ctx *httpServerCtx) control(w http.ResponseWriter, req *http.Request) {
+	ic := ctx.indexConfig
+	if !ctx.controlAuthorized(w, req) {
+		return
+	}
+	action := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/control"), "/")
+	if action == "engines" || strings.HasPrefix(action, "engines/") {
+		ctx.controlEngine(w, req, strings.TrimPrefix(strings.TrimPrefix(action, "engines"), "/"))
+		return
+	}
+	if action == "checkpoint" {
+		ctx.checkpoint(w, req)
+		return
+	}
+	if action == "" {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(405)
+			return
+		}
+		writeJSON(w, ic.controlStatus())
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.WriteHeader(405)
+		return
+	}
+	log := ic.config.log(httpComponent).With("action", action, "remote_addr", req.RemoteAddr)
+	switch action {
+	case "pause":
+		if ic.pause.pause(operatorPause) {
+			log.Warn("Consumption of ops paused")
+		}
+	case "resume":
+		if ic.pause.resume(operatorPause) {
+			ic.pause.logReleased(log)
+		}
+	case "flush":
+		ic.stats.AddFlushed(1)
+		if err := ic.batchIndex(); err != nil {
+			log.Error("Forced flush failed", "error", err)
+			w.WriteHeader(502)
+			fmt.Fprintf(w, "Unable to flush: %s", err)
+			return
+		}
+		log.Info("Buffers flushed")
+	case "resync":
+		ctx.resync(w, req)
+		return
+	default:
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Unknown control action %q", action)
+		return
+	}
+	writeJSON(w, ic.controlStatus())
+}
+
+// controlEngine lists the engines on GET /control/engines and enables or
+// disables one on POST /control/engines/{name}/{enable,disable}.
+func (ctx *httpServerCtx) controlEngine(w http.ResponseWriter, req *http.Request, path string) {
+	ic := ctx.indexConfig
+	if path == "" {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(405)
+			return
+		}
+		writeJSON(w, ic.engineStatuses())
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.WriteHeader(405)
+		return
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Expected /control/engines/{name}/enable or /control/engines/{name}/disable")
+		return
+	}
+	e := ic.engineByName(parts[0])
+	if e == nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Unknown engine %q", parts[0])
+		return
+	}
+	switch parts[1] {
+	case "enable":
+		ic.enableEngine(e)
+	case "disable":
+		ic.disableEngine(e)
+	default:
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Unknown engine action %q", parts[1])
+		return
+	}
+	writeJSON(w, ic.engineStatuses())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, _ := json.MarshalIndent(v, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/rwynn/gtm"
+)
+
+func TestAuthorized(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   bool
+	}{
+		{"matching token", "secret", "Bearer secret", true},
+		{"wrong token", "secret", "Bearer other", false},
+		{"token prefix", "secret", "Bearer secre", false},
+		{"missing header", "secret", "", false},
+		{"basic scheme", "secret", "Basic secret", false},
+		{"no token configured", "", "Bearer ", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/control", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if got := authorized(req, tt.token); got != tt.want {
+				t.Errorf("authorized() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestControlAuthorized(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		header     string
+		want       bool
+		wantStatus int
+	}{
+		{"disabled", "", "Bearer x", false, 404},
+		{"unauthorized", "secret", "Bearer x", false, 401},
+		{"authorized", "secret", "Bearer secret", true, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &httpServerCtx{indexConfig: &indexClient{config: &configOptions{ControlToken: tt.token}}}
+			req := httptest.NewRequest(http.MethodPost, "/control/pause", nil)
+			req.Header.Set("Authorization", tt.header)
+			w := httptest.NewRecorder()
+			if got := ctx.controlAuthorized(w, req); got != tt.want {
+				t.Errorf("controlAuthorized() = %v, want %v", got, tt.want)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestPauseGate(t *testing.T) {
+	opC := make(chan *gtm.Op)
+	g := newPauseGate()
+	if c, resumed := g.opChannel(opC); c != opC || resumed != nil {
+		t.Fatal("opChannel() of an open gate should return the op channel")
+	}
+	if !g.pause(operatorPause) {
+		t.Error("pause() = false, want true")
+	}
+	if g.pause(operatorPause) {
+		t.Error("pause() of a gate held by the same owner = true, want false")
+	}
+	if !g.pause(spillPause + "courses") {
+		t.Error("pause() by another owner = false, want true")
+	}
+	if got, want := g.heldBy(), []string{operatorPause, "spill:courses"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("heldBy() = %v, want %v", got, want)
+	}
+	c, resumed := g.opChannel(opC)
+	if c != nil || resumed == nil {
+		t.Fatal("opChannel() of a paused gate should return a nil op channel and the resume channel")
+	}
+	if !g.resume(operatorPause) {
+		t.Error("resume() = false, want true")
+	}
+	select {
+	case <-resumed:
+		t.Fatal("resume channel closed while another owner holds the gate")
+	default:
+	}
+	if c, _ := g.opChannel(opC); c != nil {
+		t.Error("opChannel() should return a nil op channel while another owner holds the gate")
+	}
+	if g.resume(operatorPause) {
+		t.Error("resume() by an owner not holding the gate = true, want false")
+	}
+	if !g.resume(spillPause + "courses") {
+		t.Error("resume() = false, want true")
+	}
+	select {
+	case <-resumed:
+	default:
+		t.Error("resume channel not closed once every owner released the gate")
+	}
+	if c, _ := g.opChannel(opC); c != opC {
+		t.Error("opChannel() after resume should return the op channel")
+	}
+	if got := g.heldBy(); len(got) != 0 {
+		t.Errorf("heldBy() of an open gate = %v", got)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rwynn/gtm"
+	"github.com/testbook/app-search-sync/plugin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// documentID stringifies a mongo _id into an App Search document id. Composite
+// keys are joined with the separator of the engine, either in the order of
+// idFields or by sorted key.
+func (e *indexEngineCtx) documentID(id interface{}) string {
+	switch id := id.(type) {
+	case nil:
+		return ""
+	case string:
+		return id
+	case primitive.ObjectID:
+		return id.Hex()
+	case int32:
+		return strconv.FormatInt(int64(id), 10)
+	case int64:
+		return strconv.FormatInt(id, 10)
+	case float64:
+		return strconv.FormatFloat(id, 'f', -1, 64)
+	case primitive.D:
+		if len(e.idFields) == 0 {
+			parts := make([]string, len(id))
+			for i, elem := range id {
+				parts[i] = e.documentID(elem.Value)
+			}
+			return strings.Join(parts, e.idSeparator)
+		}
+		return e.compositeID(id.Map())
+	}
+	if m, ok := toMap(id); ok {
+		return e.compositeID(m)
+	}
+	return fmt.Sprint(id)
+}
+
+func (e *indexEngineCtx) compositeID(m map[string]interface{}) string {
+	keys := e.idFields
+	if len(keys) == 0 {
+		keys = make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+	}
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = e.documentID(m[k])
+	}
+	return strings.Join(parts, e.idSeparator)
+}
+
+// toDocumentMap converts a mapped document into a map so that the sync can
+// set the App Search fields on it.
+func toDocumentMap(doc interface{}) (map[string]interface{}, error) {
+	if doc == nil {
+		return nil, fmt.Errorf("document is empty")
+	}
+	if m, ok := toMap(doc); ok {
+		return m, nil
+	}
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{})
+	if err = bson.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// prepareDocument builds the document sent to App Search for a mongo doc. The
+// id is taken from the mapper output when set, otherwise from the mongo _id.
+func (e *indexEngineCtx) prepareDocument(mongoID interface{}, doc interface{}, id string) (map[string]interface{}, error) {
+	m, err := toDocumentMap(doc)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		// an id field of the document is overwritten so that deletes, which
+		// only know the _id, resolve to the same document
+		id = e.documentID(mongoID)
+	}
+	if id == "" {
+		return nil, fmt.Errorf("unable to determine document id")
+	}
+	m = e.normalize.normalizeDocument(m)
+	m["id"] = id
+	return m, nil
+}
+
+// mapOutput resolves the App Search id and document of op from the mapper
+// output, which is nil when the engine has no plugin. A nil doc means the id
+// must be deleted from the engine and an empty id that the op is skipped. The
+// version is the one supplied by the plugin or else the oplog timestamp.
+func (e *indexEngineCtx) mapOutput(op *gtm.Op, upd *plugin.MapperPluginOutput) (id string, doc map[string]interface{}, version int64, err error) {
+	version = opVersion(op.Timestamp)
+	src := op.Doc
+	if upd != nil {
+		if upd.Skip {
+			return "", nil, version, nil
+		}
+		if upd.Version > 0 {
+			version = upd.Version
+		}
+		id = upd.ID
+		if !upd.Passthrough {
+			src = upd.Document
+		}
+	}
+	if op.IsDelete() || (upd != nil && upd.Drop) {
+		// deleted under the id the doc would be indexed with
+		if id == "" {
+			id = e.documentID(op.Id)
+		}
+		return id, nil, version, nil
+	}
+	if doc, err = e.prepareDocument(op.Id, src, id); err != nil {
+		return "", nil, version, err
+	}
+	return doc["id"].(string), doc, version, nil
+}
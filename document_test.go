@@ -0,0 +1,168 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rwynn/gtm"
+	"github.com/testbook/app-search-sync/plugin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDocumentID(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5f1b2c3d4e5f6a7b8c9d0e1f")
+	tests := []struct {
+		name     string
+		idFields []string
+		id       interface{}
+		want     string
+	}{
+		{"nil", nil, nil, ""},
+		{"string", nil, "abc", "abc"},
+		{"object id", nil, oid, "5f1b2c3d4e5f6a7b8c9d0e1f"},
+		{"int32", nil, int32(42), "42"},
+		{"int64", nil, int64(-7), "-7"},
+		{"float", nil, 1.5, "1.5"},
+		{"ordered composite", nil, primitive.D{{Key: "b", Value: "x"}, {Key: "a", Value: int32(1)}}, "x|1"},
+		{"ordered composite by id fields", []string{"a", "b"}, primitive.D{{Key: "b", Value: "x"}, {Key: "a", Value: int32(1)}}, "1|x"},
+		{"map composite by sorted key", nil, map[string]interface{}{"b": "x", "a": int64(1)}, "1|x"},
+		{"map composite by id fields", []string{"b", "a"}, primitive.M{"b": "x", "a": int64(1)}, "x|1"},
+		{"nested composite", nil, map[string]interface{}{"a": oid, "b": primitive.D{{Key: "c", Value: "y"}}}, "5f1b2c3d4e5f6a7b8c9d0e1f|y"},
+		{"other types", nil, true, "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &indexEngineCtx{idSeparator: "|", idFields: tt.idFields}
+			if got := e.documentID(tt.id); got != tt.want {
+				t.Errorf("documentID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMapOutput(t *testing.T) {
+	e := &indexEngineCtx{idSeparator: "|", normalize: defaultNormalizeSettings()}
+	ts := primitive.Timestamp{T: 10, I: 2}
+	data := map[string]interface{}{"_id": "m1", "isActive": true}
+	tests := []struct {
+		name        string
+		op          *gtm.Op
+		out         *plugin.MapperPluginOutput
+		wantID      string
+		wantDoc     map[string]interface{}
+		wantVersion int64
+		wantErr     bool
+	}{
+		{
+			name:        "doc without plugin",
+			op:          &gtm.Op{Id: "m1", Operation: "i", Doc: data, Timestamp: ts},
+			wantID:      "m1",
+			wantDoc:     map[string]interface{}{"id": "m1", "is_active": "true"},
+			wantVersion: opVersion(ts),
+		},
+		{
+			name:        "mapped doc with plugin id and version",
+			op:          &gtm.Op{Id: "m1", Operation: "u", Doc: data, Timestamp: ts},
+			out:         &plugin.MapperPluginOutput{Document: map[string]interface{}{"title": "T"}, ID: "custom", Version: 99},
+			wantID:      "custom",
+			wantDoc:     map[string]interface{}{"id": "custom", "title": "T"},
+			wantVersion: 99,
+		},
+		{
+			name:        "id field of the mapped doc is replaced by the _id",
+			op:          &gtm.Op{Id: "m1", Operation: "i", Doc: data, Timestamp: ts},
+			out:         &plugin.MapperPluginOutput{Document: map[string]interface{}{"id": "doc-id"}},
+			wantID:      "m1",
+			wantDoc:     map[string]interface{}{"id": "m1"},
+			wantVersion: opVersion(ts),
+		},
+		{
+			name:        "passthrough indexes the original doc",
+			op:          &gtm.Op{Id: "m1", Operation: "i", Doc: data, Timestamp: ts},
+			out:         &plugin.MapperPluginOutput{Passthrough: true, Document: map[string]interface{}{"ignored": 1}},
+			wantID:      "m1",
+			wantDoc:     map[string]interface{}{"id": "m1", "is_active": "true"},
+			wantVersion: opVersion(ts),
+		},
+		{
+			name:        "skip",
+			op:          &gtm.Op{Id: "m1", Operation: "i", Doc: data, Timestamp: ts},
+			out:         &plugin.MapperPluginOutput{Skip: true, ID: "custom"},
+			wantVersion: opVersion(ts),
+		},
+		{
+			name:        "delete",
+			op:          &gtm.Op{Id: "m1", Operation: "d", Timestamp: ts},
+			wantID:      "m1",
+			wantVersion: opVersion(ts),
+		},
+		{
+			name:        "delete under the plugin id",
+			op:          &gtm.Op{Id: "m1", Operation: "d", Timestamp: ts},
+			out:         &plugin.MapperPluginOutput{ID: "custom"},
+			wantID:      "custom",
+			wantVersion: opVersion(ts),
+		},
+		{
+			name:        "drop",
+			op:          &gtm.Op{Id: "m1", Operation: "u", Doc: data, Timestamp: ts},
+			out:         &plugin.MapperPluginOutput{Drop: true},
+			wantID:      "m1",
+			wantVersion: opVersion(ts),
+		},
+		{
+			name:        "empty doc",
+			op:          &gtm.Op{Id: "m1", Operation: "i", Timestamp: ts},
+			wantVersion: opVersion(ts),
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, doc, version, err := e.mapOutput(tt.op, tt.out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mapOutput() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if id != tt.wantID {
+				t.Errorf("mapOutput() id = %q, want %q", id, tt.wantID)
+			}
+			if !reflect.DeepEqual(doc, tt.wantDoc) {
+				t.Errorf("mapOutput() doc = %v, want %v", doc, tt.wantDoc)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("mapOutput() version = %d, want %d", version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestMapOutputOwnIDField(t *testing.T) {
+	e := &indexEngineCtx{idSeparator: "|", normalize: defaultNormalizeSettings()}
+	oid, _ := primitive.ObjectIDFromHex("5f1b2c3d4e5f6a7b8c9d0e1f")
+	doc := map[string]interface{}{"_id": oid, "id": "legacy-id", "title": "T"}
+	tests := []struct {
+		name string
+		op   *gtm.Op
+		out  *plugin.MapperPluginOutput
+	}{
+		{"index without plugin", &gtm.Op{Id: oid, Operation: "i", Doc: doc}, nil},
+		{"index passthrough", &gtm.Op{Id: oid, Operation: "u", Doc: doc}, &plugin.MapperPluginOutput{Passthrough: true}},
+		{"index mapped", &gtm.Op{Id: oid, Operation: "u", Doc: doc}, &plugin.MapperPluginOutput{Document: doc}},
+		{"delete", &gtm.Op{Id: oid, Operation: "d"}, nil},
+		{"drop", &gtm.Op{Id: oid, Operation: "u", Doc: doc}, &plugin.MapperPluginOutput{Drop: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, m, _, err := e.mapOutput(tt.op, tt.out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != oid.Hex() {
+				t.Errorf("mapOutput() id = %q, want the _id %q", id, oid.Hex())
+			}
+			if m != nil && m["id"] != oid.Hex() {
+				t.Errorf("mapOutput() doc id = %v, want the _id %q", m["id"], oid.Hex())
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/rwynn/gtm"
+	. "github.com/testbook/app-search-sync/plugin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// matchFilter reports whether doc satisfies a declarative Mongo style match
+// expression, e.g. {isActive: true, type: {$in: [...]}}. Only the subset of
+// query operators handled below is supported.
+func matchFilter(doc map[string]interface{}, filter map[string]interface{}) (bool, error) {
+	for key, cond := range filter {
+		var ok bool
+		var err error
+		switch key {
+		case "$and", "$or", "$nor":
+			ok, err = matchLogical(doc, key, cond)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("unsupported filter operator %s", key)
+			}
+			ok, err = matchField(lookupPath(doc, key), cond)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchLogical(doc map[string]interface{}, op string, cond interface{}) (bool, error) {
+	clauses, ok := cond.([]interface{})
+	if !ok {
+		return false, fmt.Errorf("%s expects an array of expressions", op)
+	}
+	for _, c := range clauses {
+		clause, ok := c.(map[string]interface{})
+		if !ok {
+			return false, fmt.Errorf("%s expects an array of expressions", op)
+		}
+		matched, err := matchFilter(doc, clause)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case op == "$and" && !matched:
+			return false, nil
+		case op == "$or" && matched:
+			return true, nil
+		case op == "$nor" && matched:
+			return false, nil
+		}
+	}
+	return op != "$or", nil
+}
+
+func matchField(value interface{}, cond interface{}) (bool, error) {
+	ops, ok := cond.(map[string]interface{})
+	if !ok || !hasOperators(ops) {
+		return matchEqual(value, cond), nil
+	}
+	for op, arg := range ops {
+		var matched bool
+		switch op {
+		case "$eq":
+			matched = matchEqual(value, arg)
+		case "$ne":
+			matched = !matchEqual(value, arg)
+		case "$in", "$nin":
+			list, ok := arg.([]interface{})
+			if !ok {
+				return false, fmt.Errorf("%s expects an array", op)
+			}
+			for _, v := range list {
+				if matchEqual(value, v) {
+					matched = true
+					break
+				}
+			}
+			if op == "$nin" {
+				matched = !matched
+			}
+		case "$exists":
+			want, ok := arg.(bool)
+			if !ok {
+				return false, fmt.Errorf("$exists expects a boolean")
+			}
+			matched = (value != nil) == want
+		case "$gt", "$gte", "$lt", "$lte":
+			matched = matchCompare(value, op, arg)
+		default:
+			return false, fmt.Errorf("unsupported filter operator %s", op)
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func hasOperators(m map[string]interface{}) bool {
+	for k := range m {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchEqual follows mongo semantics where an array value matches if any of
+// its elements is equal to the expected value.
+func matchEqual(value, expected interface{}) bool {
+	if arr, ok := toSlice(value); ok {
+		if _, expArr := toSlice(expected); !expArr {
+			for _, v := range arr {
+				if matchEqual(v, expected) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	a, b := comparableValue(value), comparableValue(expected)
+	if fa, ok := a.(float64); ok {
+		fb, ok := b.(float64)
+		return ok && fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func matchCompare(value interface{}, op string, arg interface{}) bool {
+	if arr, ok := toSlice(value); ok {
+		for _, v := range arr {
+			if matchCompare(v, op, arg) {
+				return true
+			}
+		}
+		return false
+	}
+	var c int
+	switch a := comparableValue(value).(type) {
+	case float64:
+		b, ok := comparableValue(arg).(float64)
+		if !ok {
+			return false
+		}
+		c = compareFloat(a, b)
+	case string:
+		b, ok := comparableValue(arg).(string)
+		if !ok {
+			return false
+		}
+		c = strings.Compare(a, b)
+	case time.Time:
+		b, ok := comparableValue(arg).(time.Time)
+		if !ok {
+			return false
+		}
+		c = compareFloat(float64(a.UnixNano()), float64(b.UnixNano()))
+	default:
+		return false
+	}
+	switch op {
+	case "$gt":
+		return c > 0
+	case "$gte":
+		return c >= 0
+	case "$lt":
+		return c < 0
+	default:
+		return c <= 0
+	}
+}
+
+func compareFloat(a, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// comparableValue converts numeric types to float64 and object ids to their hex
+// form so that values decoded from bson can be compared with toml values.
+func comparableValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case primitive.ObjectID:
+		return v.Hex()
+	case primitive.DateTime:
+		return v.Time()
+	}
+	return v
+}
+
+func toSlice(v interface{}) ([]interface{}, bool) {
+	switch v := v.(type) {
+	case []interface{}:
+		return v, true
+	case primitive.A:
+		return []interface{}(v), true
+	}
+	return nil, false
+}
+
+func toMap(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, true
+	case primitive.M:
+		return map[string]interface{}(v), true
+	case primitive.D:
+		return map[string]interface{}(v.Map()), true
+	}
+	return nil, false
+}
+
+// lookupPath resolves a dotted field path within a document.
+func lookupPath(doc map[string]interface{}, path string) interface{} {
+	var value interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		m, ok := toMap(value)
+		if !ok {
+			return nil
+		}
+		value = m[part]
+	}
+	return value
+}
+
+// prefixFilter rewrites the field names of a match expression so that it can
+// be evaluated against the fullDocument of a change event.
+func prefixFilter(filter map[string]interface{}, prefix string) map[string]interface{} {
+	out := make(map[string]interface{}, len(filter))
+	for key, cond := range filter {
+		switch key {
+		case "$and", "$or", "$nor":
+			if clauses, ok := cond.([]interface{}); ok {
+				prefixed := make([]interface{}, len(clauses))
+				for i, c := range clauses {
+					if clause, ok := c.(map[string]interface{}); ok {
+						prefixed[i] = prefixFilter(clause, prefix)
+					} else {
+						prefixed[i] = c
+					}
+				}
+				out[key] = prefixed
+				continue
+			}
+			out[key] = cond
+		default:
+			out[prefix+key] = cond
+		}
+	}
+	return out
+}
+
+// unmatchedUpdate turns a change stream update of a doc that no longer passes
+// the filters of its engine into a delete, so that the doc indexed while it
+// matched is removed. Other ops failing the filters are dropped.
+func unmatchedUpdate(op *gtm.Op) bool {
+	if !op.IsUpdate() || !op.IsSourceOplog() {
+		return false
+	}
+	op.Operation = "d"
+	return true
+}
+
+// engineFilter applies the filter and filter plugin of the engines, recording
+// in the audit trail the ops received and the filter rejecting them.
+func (config *configOptions) engineFilter() gtm.OpFilter {
+	engines := config.enginesByNamespace()
+	return func(op *gtm.Op) bool {
+		m := engines[op.Namespace]
+		if m == nil {
+			return true
+		}
+		config.audit.record(op, m.Name, auditReceived, "", nil)
+		if op.IsDelete() {
+			return true
+		}
+		if ok, by, err := config.matchEngine(m, op); !ok {
+			config.audit.record(op, m.Name, auditFiltered, by, err)
+			return err == nil && unmatchedUpdate(op)
+		}
+		return true
+	}
+}
+
+// documentFilter applies the filter and filter plugin of the engines to the
+// docs read by verify and resync. These are not ops of the sync and are not
+// recorded in the audit trail.
+func (config *configOptions) documentFilter() gtm.OpFilter {
+	engines := config.enginesByNamespace()
+	return func(op *gtm.Op) bool {
+		m := engines[op.Namespace]
+		if m == nil {
+			return true
+		}
+		ok, _, _ := config.matchEngine(m, op)
+		return ok
+	}
+}
+
+func (config *configOptions) enginesByNamespace() map[string]*engineConfig {
+	engines := make(map[string]*engineConfig)
+	for _, m := range config.EngineConfig {
+		engines[m.Namespace] = m
+	}
+	return engines
+}
+
+// matchEngine reports whether the doc of the op passes the filter and filter
+// plugin of the engine, and otherwise which of them rejected it.
+func (config *configOptions) matchEngine(m *engineConfig, op *gtm.Op) (ok bool, by string, err error) {
+	if m.Filter != nil {
+		ok, err = matchFilter(op.Data, m.Filter)
+		if err != nil {
+			config.log(indexComponent).Error("Error while evaluating filter", "engine", m.Name, "namespace", op.Namespace, "doc_id", op.Id, "op", op.Operation, "error", err)
+		}
+		if !ok {
+			return false, "filter", err
+		}
+	}
+	if m.FilterPlugin != nil {
+		ok, err = m.FilterPlugin(config.filterInput(m, op))
+		if err != nil {
+			config.log(pluginComponent).Error("Error while calling FilterFunc", "engine", m.Name, "namespace", op.Namespace, "doc_id", op.Id, "op", op.Operation, "error", err)
+		}
+		if !ok || err != nil {
+			return false, m.FilterFunctionName, err
+		}
+	}
+	return true, "", nil
+}
+
+// buildPipeline pushes the declarative engine filters down to mongo as a
+// $match stage for direct reads and the inserts of change streams. Updates
+// must reach engineFilter so that docs no longer matching are deleted.
+func (config *configOptions) buildPipeline() gtm.PipelineBuilder {
+	filters := make(map[string]map[string]interface{})
+	for _, m := range config.EngineConfig {
+		if m.Filter != nil {
+			filters[m.Namespace] = m.Filter
+		}
+	}
+	if len(filters) == 0 {
+		return nil
+	}
+	return func(namespace string, changeStream bool) ([]interface{}, error) {
+		filter := filters[namespace]
+		if filter == nil {
+			return nil, nil
+		}
+		if !changeStream {
+			return []interface{}{map[string]interface{}{"$match": filter}}, nil
+		}
+		match := map[string]interface{}{
+			"$or": []interface{}{
+				map[string]interface{}{"operationType": map[string]interface{}{"$ne": "insert"}},
+				prefixFilter(filter, "fullDocument."),
+			},
+		}
+		return []interface{}{map[string]interface{}{"$match": match}}, nil
+	}
+}
+
+func (config *configOptions) filterInput(m *engineConfig, op *gtm.Op) *MapperPluginInput {
+	inp := &MapperPluginInput{
+		Id:         op.Id,
+		Document:   op.Doc,
+		Data:       op.Data,
+		Database:   op.GetDatabase(),
+		Collection: op.GetCollection(),
+		Operation:  op.Operation,
+		Namespace:  op.Namespace,
+		Config:     m.PluginConfig,
+	}
+	if clients := config.pluginClients; clients != nil {
+		inp.CoreMongo = clients.CoreMongo
+		inp.LearnMongo = clients.LearnMongo
+		inp.EngagementMongo = clients.EngagementMongo
+		inp.TestMongo = clients.TestMongo
+	}
+	return inp
+}
+
+// validateFilter reports the operators of a match expression that matchFilter
+// does not support.
+func validateFilter(filter map[string]interface{}) error {
+	for key, cond := range filter {
+		switch key {
+		case "$and", "$or", "$nor":
+			clauses, ok := cond.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s expects an array of expressions", key)
+			}
+			for _, c := range clauses {
+				clause, ok := c.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("%s expects an array of expressions", key)
+				}
+				if err := validateFilter(clause); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "$") {
+			return fmt.Errorf("unsupported filter operator %s", key)
+		}
+		ops, ok := cond.(map[string]interface{})
+		if !ok || !hasOperators(ops) {
+			continue
+		}
+		for op := range ops {
+			switch op {
+			case "$eq", "$ne", "$in", "$nin", "$exists", "$gt", "$gte", "$lt", "$lte":
+			default:
+				return fmt.Errorf("unsupported filter operator %s", op)
+			}
+		}
+		if _, err := matchField(nil, cond); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMatchFilter(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5f1b2c3d4e5f6a7b8c9d0e1f")
+	doc := map[string]interface{}{
+		"isActive": true,
+		"type":     "course",
+		"count":    int32(5),
+		"owner":    oid,
+		"tags":     primitive.A{"a", "b"},
+		"meta":     map[string]interface{}{"lang": "en", "rank": 2.5},
+	}
+	tests := []struct {
+		name    string
+		filter  map[string]interface{}
+		want    bool
+		wantErr bool
+	}{
+		{"empty", map[string]interface{}{}, true, false},
+		{"equal", map[string]interface{}{"isActive": true}, true, false},
+		{"not equal", map[string]interface{}{"isActive": false}, false, false},
+		{"number across types", map[string]interface{}{"count": int64(5)}, true, false},
+		{"object id as hex", map[string]interface{}{"owner": "5f1b2c3d4e5f6a7b8c9d0e1f"}, true, false},
+		{"array element", map[string]interface{}{"tags": "b"}, true, false},
+		{"dotted path", map[string]interface{}{"meta.lang": "en"}, true, false},
+		{"missing path", map[string]interface{}{"meta.missing.deep": "x"}, false, false},
+		{"$eq", map[string]interface{}{"type": map[string]interface{}{"$eq": "course"}}, true, false},
+		{"$ne", map[string]interface{}{"type": map[string]interface{}{"$ne": "course"}}, false, false},
+		{"$in", map[string]interface{}{"type": map[string]interface{}{"$in": []interface{}{"test", "course"}}}, true, false},
+		{"$nin", map[string]interface{}{"type": map[string]interface{}{"$nin": []interface{}{"test", "course"}}}, false, false},
+		{"$in array value", map[string]interface{}{"tags": map[string]interface{}{"$in": []interface{}{"c", "a"}}}, true, false},
+		{"$exists", map[string]interface{}{"meta.lang": map[string]interface{}{"$exists": true}}, true, false},
+		{"$exists false", map[string]interface{}{"nope": map[string]interface{}{"$exists": false}}, true, false},
+		{"$gt", map[string]interface{}{"count": map[string]interface{}{"$gt": 4}}, true, false},
+		{"$gte and $lt", map[string]interface{}{"count": map[string]interface{}{"$gte": 5, "$lt": 5}}, false, false},
+		{"$lte float", map[string]interface{}{"meta.rank": map[string]interface{}{"$lte": 2.5}}, true, false},
+		{"compare mismatched types", map[string]interface{}{"type": map[string]interface{}{"$gt": 1}}, false, false},
+		{"$and", map[string]interface{}{"$and": []interface{}{
+			map[string]interface{}{"isActive": true},
+			map[string]interface{}{"type": "test"},
+		}}, false, false},
+		{"$or", map[string]interface{}{"$or": []interface{}{
+			map[string]interface{}{"type": "test"},
+			map[string]interface{}{"count": 5},
+		}}, true, false},
+		{"$nor", map[string]interface{}{"$nor": []interface{}{
+			map[string]interface{}{"type": "test"},
+		}}, true, false},
+		{"unsupported top level operator", map[string]interface{}{"$where": "1"}, false, true},
+		{"unsupported field operator", map[string]interface{}{"type": map[string]interface{}{"$regex": "c"}}, false, true},
+		{"$in without array", map[string]interface{}{"type": map[string]interface{}{"$in": "course"}}, false, true},
+		{"$or without array", map[string]interface{}{"$or": map[string]interface{}{}}, false, true},
+		{"$exists without bool", map[string]interface{}{"type": map[string]interface{}{"$exists": 1}}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := matchFilter(doc, tt.filter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("matchFilter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("matchFilter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter map[string]interface{}
+		want   map[string]interface{}
+	}{
+		{
+			"fields",
+			map[string]interface{}{"isActive": true, "meta.lang": "en"},
+			map[string]interface{}{"fullDocument.isActive": true, "fullDocument.meta.lang": "en"},
+		},
+		{
+			"logical clauses",
+			map[string]interface{}{"$or": []interface{}{
+				map[string]interface{}{"type": "test"},
+				map[string]interface{}{"count": map[string]interface{}{"$gt": 1}},
+			}},
+			map[string]interface{}{"$or": []interface{}{
+				map[string]interface{}{"fullDocument.type": "test"},
+				map[string]interface{}{"fullDocument.count": map[string]interface{}{"$gt": 1}},
+			}},
+		},
+		{
+			"invalid logical clause kept as is",
+			map[string]interface{}{"$and": "x"},
+			map[string]interface{}{"$and": "x"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := prefixFilter(tt.filter, "fullDocument."); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("prefixFilter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  map[string]interface{}
+		wantErr bool
+	}{
+		{"equality", map[string]interface{}{"isActive": true}, false},
+		{"operators", map[string]interface{}{"count": map[string]interface{}{"$gte": 1, "$in": []interface{}{1}}}, false},
+		{"nested logical", map[string]interface{}{"$or": []interface{}{
+			map[string]interface{}{"$and": []interface{}{map[string]interface{}{"a": 1}}},
+		}}, false},
+		{"unsupported operator", map[string]interface{}{"a": map[string]interface{}{"$regex": "x"}}, true},
+		{"unsupported nested operator", map[string]interface{}{"$nor": []interface{}{
+			map[string]interface{}{"a": map[string]interface{}{"$size": 1}},
+		}}, true},
+		{"logical without array", map[string]interface{}{"$and": map[string]interface{}{}}, true},
+		{"logical clause not an expression", map[string]interface{}{"$or": []interface{}{1}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateFilter(tt.filter); (err != nil) != tt.wantErr {
+				t.Errorf("validateFilter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildPipeline(t *testing.T) {
+	filter := map[string]interface{}{"isActive": true}
+	config := &configOptions{EngineConfig: []*engineConfig{
+		{Name: "targets", Namespace: "db.targets", Filter: filter},
+		{Name: "courses", Namespace: "db.courses"},
+	}}
+	pipe := config.buildPipeline()
+	if pipe == nil {
+		t.Fatal("buildPipeline() = nil, want a pipeline for the filtered engine")
+	}
+	tests := []struct {
+		name         string
+		namespace    string
+		changeStream bool
+		want         []interface{}
+	}{
+		{"direct read", "db.targets", false, []interface{}{
+			map[string]interface{}{"$match": filter},
+		}},
+		{"change stream only filters inserts", "db.targets", true, []interface{}{
+			map[string]interface{}{"$match": map[string]interface{}{
+				"$or": []interface{}{
+					map[string]interface{}{"operationType": map[string]interface{}{"$ne": "insert"}},
+					map[string]interface{}{"fullDocument.isActive": true},
+				},
+			}},
+		}},
+		{"unfiltered namespace", "db.courses", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pipe(tt.namespace, tt.changeStream)
+			if err != nil {
+				t.Fatalf("pipeline error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pipeline = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if (&configOptions{EngineConfig: []*engineConfig{{Namespace: "db.courses"}}}).buildPipeline() != nil {
+		t.Error("buildPipeline() without filters should be nil")
+	}
+}
+
+func TestUnmatchedUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		op     *gtm.Op
+		want   bool
+		wantOp string
+	}{
+		{"change stream update", &gtm.Op{Operation: "u", Source: gtm.OplogQuerySource}, true, "d"},
+		{"change stream insert", &gtm.Op{Operation: "i", Source: gtm.OplogQuerySource}, false, "i"},
+		{"direct read", &gtm.Op{Operation: "u", Source: gtm.DirectQuerySource}, false, "u"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unmatchedUpdate(tt.op); got != tt.want {
+				t.Errorf("unmatchedUpdate() = %v, want %v", got, tt.want)
+			}
+			if tt.op.Operation != tt.wantOp {
+				t.Errorf("operation = %q, want %q", tt.op.Operation, tt.wantOp)
+			}
+		})
+	}
+}
+
+func TestEngineFilter(t *testing.T) {
+	config := newConfig()
+	config.EngineConfig = []*engineConfig{
+		{Name: "targets", Namespace: "db.targets", Filter: map[string]interface{}{"isActive": true}},
+	}
+	active := map[string]interface{}{"isActive": true}
+	inactive := map[string]interface{}{"isActive": false}
+	tests := []struct {
+		name   string
+		op     *gtm.Op
+		want   bool
+		wantOp string
+	}{
+		{"matching insert", &gtm.Op{Namespace: "db.targets", Operation: "i", Data: active}, true, "i"},
+		{"unmatched insert", &gtm.Op{Namespace: "db.targets", Operation: "i", Data: inactive}, false, "i"},
+		{"unmatched update is deleted", &gtm.Op{Namespace: "db.targets", Operation: "u", Data: inactive}, true, "d"},
+		{"delete", &gtm.Op{Namespace: "db.targets", Operation: "d"}, true, "d"},
+		{"unfiltered namespace", &gtm.Op{Namespace: "db.courses", Operation: "i", Data: inactive}, true, "i"},
+	}
+	filter := config.engineFilter()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filter(tt.op); got != tt.want {
+				t.Errorf("engineFilter() = %v, want %v", got, tt.want)
+			}
+			if tt.op.Operation != tt.wantOp {
+				t.Errorf("operation = %q, want %q", tt.op.Operation, tt.wantOp)
+			}
+		})
+	}
+
+	direct := config.documentFilter()
+	if direct(&gtm.Op{Namespace: "db.targets", Operation: "i", Source: gtm.DirectQuerySource, Data: inactive}) {
+		t.Error("documentFilter() passed a doc failing the filter")
+	}
+	if !direct(&gtm.Op{Namespace: "db.targets", Operation: "i", Source: gtm.DirectQuerySource, Data: active}) {
+		t.Error("documentFilter() rejected a doc passing the filter")
+	}
+}
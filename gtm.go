@@ -1,11 +1,10 @@
 package main
 
 import (
-	"context"
+	"fmt"
 	"time"
 
 	"github.com/rwynn/gtm"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -30,8 +29,8 @@ func notAppSearchSync() gtm.OpFilter {
 	}
 }
 
-func isInsertOrUpdate(op *gtm.Op) bool {
-	return op.IsInsert() || op.IsUpdate()
+func isInsertUpdateOrDelete(op *gtm.Op) bool {
+	return op.IsInsert() || op.IsUpdate() || op.IsDelete()
 }
 
 func (config *configOptions) onlyMeasured() gtm.OpFilter {
@@ -60,6 +59,12 @@ func (config *configOptions) getDirectReadNSList() []string {
 	directReadNSList := make([]string, 0)
 
 	for _, m := range config.EngineConfig {
+		if config.Reindex && !m.MetaEngine {
+			continue
+		}
+		if len(config.BackfillEngines) > 0 && !containsString(config.BackfillEngines, m.Name) {
+			continue
+		}
 		if m.DirectReadNS != "" {
 			directReadNSList = append(directReadNSList, m.Namespace)
 		}
@@ -68,6 +73,9 @@ func (config *configOptions) getDirectReadNSList() []string {
 }
 
 func (config *configOptions) getChangeStreamNSList() []string {
+	if config.Backfill {
+		return nil
+	}
 	changeStreamNSList := make([]string, 0)
 
 	for _, m := range config.EngineConfig {
@@ -96,24 +104,16 @@ func (config *configOptions) getTimestampGen() (after gtm.TimestampGenerator) {
 		}
 	} else if config.Resume {
 		after = func(client *mongo.Client, options *gtm.Options) (primitive.Timestamp, error) {
-			var ts primitive.Timestamp
-			col := client.Database(Name).Collection("resume")
-			result := col.FindOne(context.Background(), bson.M{
-				"_id": config.ResumeName,
-			})
-			if err := result.Err(); err == nil {
-				doc := make(map[string]interface{})
-				if err = result.Decode(&doc); err == nil {
-					if doc["ts"] != nil {
-						ts = doc["ts"].(primitive.Timestamp)
-						ts.I += 1
-					}
-				}
+			ts, err := config.resume.LoadTimestamp()
+			if err != nil {
+				config.log(resumeComponent).Error("Unable to load resume timestamp", "error", err)
+			} else if ts.T > 0 {
+				ts = nextTimestamp(ts)
 			}
 			if ts.T == 0 {
 				ts, _ = gtm.LastOpTimestamp(client, options)
 			}
-			config.ErrorLogger.Printf("Resuming from timestamp %+v", ts)
+			config.log(resumeComponent).Info("Resuming from timestamp", "ts", fmt.Sprintf("%+v", ts), "resume_name", config.ResumeName)
 			return ts, nil
 		}
 	}
@@ -127,22 +127,10 @@ func (config *configOptions) buildTokenGen() gtm.ResumeTokenGenenerator {
 	}
 
 	token = func(client *mongo.Client, streamID string, options *gtm.Options) (interface{}, error) {
-		var t interface{} = nil
-		var err error
-		col := client.Database(Name).Collection("tokens")
-		result := col.FindOne(context.Background(), bson.M{
-			"resumeName": config.ResumeName,
-			"streamID":   streamID,
-		})
-		if err = result.Err(); err == nil {
-			doc := make(map[string]interface{})
-			if err = result.Decode(&doc); err == nil {
-				t = doc["token"]
-				if t != nil {
-					config.InfoLogger.Printf("Resuming stream '%s' from collection %s.tokens using resume name '%s'",
-						streamID, Name, config.ResumeName)
-				}
-			}
+		t, err := config.resume.LoadToken(streamID)
+		if err == nil && t != nil {
+			config.log(resumeComponent).Info("Resuming stream from token", "stream_id", streamID,
+				"store", config.ResumeStore.Type, "resume_name", config.ResumeName)
 		}
 		return t, err
 	}
@@ -152,11 +140,12 @@ func (config *configOptions) buildTokenGen() gtm.ResumeTokenGenenerator {
 func (config *configOptions) buildGtmOptions() *gtm.Options {
 	var nsFilter, filter, directReadFilter gtm.OpFilter
 
-	filterChain := []gtm.OpFilter{notAppSearchSync(), config.onlyMeasured(), isInsertOrUpdate}
+	filterChain := []gtm.OpFilter{notAppSearchSync(), config.onlyMeasured(), isInsertUpdateOrDelete, config.engineFilter()}
 	filter = gtm.ChainOpFilters(filterChain...)
+	directReadFilter = config.engineFilter()
 	bufferDuration, err := time.ParseDuration(config.GtmSettings.BufferDuration)
 	if err != nil {
-		config.ErrorLogger.Fatalf("Unable to parse gtm buffer duration %s: %s", config.GtmSettings.BufferDuration, err)
+		config.log(gtmComponent).Fatal("Unable to parse gtm buffer duration", "buffer_duration", config.GtmSettings.BufferDuration, "error", err)
 	}
 
 	after := config.getTimestampGen()
@@ -177,7 +166,8 @@ func (config *configOptions) buildGtmOptions() *gtm.Options {
 		BufferSize:          config.GtmSettings.BufferSize,
 		DirectReadNs:        config.getDirectReadNSList(),
 		DirectReadFilter:    directReadFilter,
-		Log:                 config.InfoLogger,
+		Pipe:                config.buildPipeline(),
+		Log:                 config.log(gtmComponent).stdLogger(infoLevel),
 		ChangeStreamNs:      config.getChangeStreamNSList(),
 	}
 	return gtmOpts
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	loopBeatInterval  = 5 * time.Second
+	loopBeatTimeout   = 60 * time.Second // a loop silent for longer is considered wedged
+	readyCheckTimeout = 5 * time.Second
+	streamErrorWindow = 30 * time.Second // change streams count as closed after an error this recent
+)
+
+type healthCheck struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+type healthReport struct {
+	Status string         `json:"status"`
+	Checks []*healthCheck `json:"checks"`
+}
+
+func newHealthReport(checks []*healthCheck) *healthReport {
+	report := &healthReport{Status: "ok", Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			report.Status = "fail"
+		}
+	}
+	return report
+}
+
+func (r *healthReport) ok() bool {
+	return r.Status == "ok"
+}
+
+type loopBeat struct {
+	last    time.Time
+	timeout time.Duration
+}
+
+// liveness records when each long running loop last made progress.
+type liveness struct {
+	mutex      sync.Mutex
+	beats      map[string]*loopBeat
+	streamErr  error
+	streamErrT time.Time
+	reindexErr error // the last failure to swap the reindexed meta engines
+}
+
+func newLiveness() *liveness {
+	return &liveness{beats: make(map[string]*loopBeat)}
+}
+
+// beat records progress of a loop which is considered wedged when it does not
+// beat again within timeout.
+func (l *liveness) beat(loop string, timeout time.Duration) {
+	l.mutex.Lock()
+	l.beats[loop] = &loopBeat{last: time.Now(), timeout: timeout}
+	l.mutex.Unlock()
+}
+
+// done stops expecting beats from a loop that returned on purpose.
+func (l *liveness) done(loop string) {
+	l.mutex.Lock()
+	delete(l.beats, loop)
+	l.mutex.Unlock()
+}
+
+func (l *liveness) streamError(err error) {
+	l.mutex.Lock()
+	l.streamErr, l.streamErrT = err, time.Now()
+	l.mutex.Unlock()
+}
+
+func (l *liveness) reindexError(err error) {
+	l.mutex.Lock()
+	l.reindexErr = err
+	l.mutex.Unlock()
+}
+
+func (l *liveness) checks() []*healthCheck {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	loops := make([]string, 0, len(l.beats))
+	for loop := range l.beats {
+		loops = append(loops, loop)
+	}
+	sort.Strings(loops)
+	checks := make([]*healthCheck, 0, len(loops))
+	for _, loop := range loops {
+		b := l.beats[loop]
+		since := time.Since(b.last)
+		c := &healthCheck{Name: loop, OK: since < b.timeout, Duration: since.Round(time.Millisecond).String()}
+		if !c.OK {
+			c.Error = fmt.Sprintf("no progress for %s", since.Round(time.Second))
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// healthz reports whether the index loops and the flusher are still making
+// progress.
+func (ic *indexClient) healthz() *healthReport {
+	return newHealthReport(ic.live.checks())
+}
+
+func timedCheck(name string, f func() error) *healthCheck {
+	start := time.Now()
+	err := f()
+	c := &healthCheck{Name: name, OK: err == nil, Duration: time.Since(start).Round(time.Millisecond).String()}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	return c
+}
+
+// readyz reports whether the sync can do its job: mongo and App Search are
+// reachable, the change streams are open and the direct reads are finished.
+func (ic *indexClient) readyz() *healthReport {
+	clients := []struct {
+		name   string
+		client *mongo.Client
+	}{
+		{"mongo.core", ic.coreMongo},
+		{"mongo.learn", ic.learnMongo},
+		{"mongo.engagement", ic.engagementMongo},
+		{"mongo.test", ic.testMongo},
+	}
+	checks := make([]*healthCheck, len(clients)+1)
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, name string, client *mongo.Client) {
+			defer wg.Done()
+			checks[i] = timedCheck(name, func() error {
+				ctx, cancel := context.WithTimeout(context.Background(), readyCheckTimeout)
+				defer cancel()
+				return client.Ping(ctx, nil)
+			})
+		}(i, c.name, c.client)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		checks[len(clients)] = ic.appSearchCheck()
+	}()
+	wg.Wait()
+	return newHealthReport(append(checks, ic.syncChecks()...))
+}
+
+// appSearchCheck fetches an engine, which also verifies the api key.
+func (ic *indexClient) appSearchCheck() *healthCheck {
+	return timedCheck("app-search", func() error {
+		if len(ic.config.EngineConfig) == 0 {
+			return nil
+		}
+		_, err := ic.client.getEngine(ic.config.EngineConfig[0].indexName())
+		return err
+	})
+}
+
+// syncChecks reports whether the change streams are open and the direct reads
+// and reindex are finished.
+func (ic *indexClient) syncChecks() []*healthCheck {
+	var checks []*healthCheck
+	if len(ic.config.getChangeStreamNSList()) > 0 {
+		c := &healthCheck{Name: "change-streams", OK: true}
+		ic.live.mutex.Lock()
+		if ic.live.streamErr != nil && time.Since(ic.live.streamErrT) < streamErrorWindow {
+			c.OK = false
+			c.Error = ic.live.streamErr.Error()
+		}
+		ic.live.mutex.Unlock()
+		checks = append(checks, c)
+	}
+	if ic.config.DirectReads {
+		c := &healthCheck{Name: "direct-reads", OK: true}
+		select {
+		case <-ic.directReadsIndexed:
+		default:
+			c.OK = false
+			c.Error = "direct reads in progress"
+		}
+		checks = append(checks, c)
+	}
+	if ic.config.Reindex {
+		c := &healthCheck{Name: "reindex", OK: true}
+		ic.live.mutex.Lock()
+		if ic.live.reindexErr != nil {
+			c.OK = false
+			c.Error = ic.live.reindexErr.Error()
+		}
+		ic.live.mutex.Unlock()
+		checks = append(checks, c)
+	}
+	return checks
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLivenessChecks(t *testing.T) {
+	l := newLiveness()
+	l.beat("index", time.Hour)
+	l.beat("flusher", time.Nanosecond)
+	l.beat("direct-reads", time.Nanosecond)
+	l.done("direct-reads")
+	time.Sleep(time.Millisecond)
+	report := newHealthReport(l.checks())
+	if report.ok() || len(report.Checks) != 2 {
+		t.Fatalf("healthz = %+v, want the wedged flusher failing and the finished direct reads dropped", report)
+	}
+	if c := report.Checks[0]; c.Name != "flusher" || c.OK || c.Error == "" {
+		t.Errorf("flusher check = %+v, want failed", c)
+	}
+	if c := report.Checks[1]; c.Name != "index" || !c.OK {
+		t.Errorf("index check = %+v, want ok", c)
+	}
+}
+
+func TestAppSearchCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int // answered to the engine request, none when zero
+		exists bool
+		want   bool
+	}{
+		{"engine", 0, true, true},
+		{"missing engine", 0, false, true},
+		{"invalid api key", http.StatusUnauthorized, true, false},
+		{"unavailable", http.StatusServiceUnavailable, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeEngines()
+			server := httptest.NewServer(srv)
+			defer server.Close()
+			if tt.exists {
+				srv.add(appSearchEngine{Name: "courses"})
+			}
+			srv.setFail("GET /api/as/v1/engines/courses", tt.status)
+			ic, _ := newTestIndexClient(t, server.URL)
+			if c := ic.appSearchCheck(); c.OK != tt.want || c.Name != "app-search" {
+				t.Errorf("appSearchCheck() = %+v, want ok %v", c, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncChecks(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+	tests := []struct {
+		name        string
+		stream      bool
+		streamErr   error
+		streamErrAt time.Duration // how long ago the stream failed
+		directReads chan struct{}
+		reindexErr  error
+		reindex     bool
+		want        map[string]bool
+	}{
+		{"nothing to check", false, nil, 0, nil, nil, false, map[string]bool{}},
+		{"open change streams", true, nil, 0, nil, nil, false, map[string]bool{"change-streams": true}},
+		{"recent stream error", true, errors.New("closed"), time.Second, nil, nil, false, map[string]bool{"change-streams": false}},
+		{"old stream error", true, errors.New("closed"), streamErrorWindow + time.Second, nil, nil, false, map[string]bool{"change-streams": true}},
+		{"direct reads running", false, nil, 0, make(chan struct{}), nil, false, map[string]bool{"direct-reads": false}},
+		{"direct reads indexed", false, nil, 0, done, nil, false, map[string]bool{"direct-reads": true}},
+		{"reindex swapped", false, nil, 0, nil, nil, true, map[string]bool{"reindex": true}},
+		{"reindex swap failed", false, nil, 0, nil, errors.New("meta engine"), true, map[string]bool{"reindex": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ic, _ := newTestIndexClient(t, "")
+			if tt.stream {
+				ic.config.EngineConfig[0].ChangeStreamNS = "db.courses"
+			}
+			if tt.streamErr != nil {
+				ic.live.streamErr, ic.live.streamErrT = tt.streamErr, time.Now().Add(-tt.streamErrAt)
+			}
+			ic.config.DirectReads = tt.directReads != nil
+			ic.directReadsIndexed = tt.directReads
+			ic.config.Reindex = tt.reindex
+			ic.live.reindexError(tt.reindexErr)
+			got := make(map[string]bool)
+			for _, c := range ic.syncChecks() {
+				got[c.Name] = c.OK
+				if !c.OK && c.Error == "" {
+					t.Errorf("check %s failed without an error", c.Name)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("syncChecks() = %v, want %v", got, tt.want)
+			}
+			for name, ok := range tt.want {
+				if got[name] != ok {
+					t.Errorf("check %s ok = %v, want %v", name, got[name], ok)
+				}
+			}
+		})
+	}
+}
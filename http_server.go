@@ -1,20 +1,96 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"strconv"
+	"strings"
 	"time"
 )
 
+type httpServerSettings struct {
+	TLSCert     string `toml:"tls-cert"`     // serve https with this certificate file
+	TLSKey      string `toml:"tls-key"`      // and this key file
+	BearerToken string `toml:"bearer-token"` // required by all but the health endpoints when set
+	Username    string `toml:"username"`     // basic auth, accepted as well as the bearer token
+	Password    string `toml:"password"`
+	PprofAddr   string `toml:"pprof-addr"` // loopback address of a separate pprof listener
+}
+
+// unauthenticated paths stay open for probes, /control checks its own token
+var unauthenticated = map[string]bool{
+	"/started": true,
+	"/health":  true,
+	"/healthz": true,
+	"/readyz":  true,
+}
+
 type httpServerCtx struct {
 	httpServer  *http.Server
+	pprofServer *http.Server
 	indexConfig *indexClient
 	shutdown    bool
 	started     time.Time
 }
 
+// authenticate requires the bearer token or the basic auth credentials of the
+// http-server settings on every path but the health and control ones.
+func (ctx *httpServerCtx) authenticate(next http.Handler) http.Handler {
+	settings := ctx.indexConfig.config.HTTPServer
+	if settings.BearerToken == "" && settings.Username == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		if unauthenticated[path] || path == "/control" || strings.HasPrefix(path, "/control/") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if settings.BearerToken != "" && authorized(req, settings.BearerToken) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if settings.Username != "" {
+			if user, password, ok := req.BasicAuth(); ok &&
+				subtle.ConstantTimeCompare([]byte(user), []byte(settings.Username)) == 1 &&
+				subtle.ConstantTimeCompare([]byte(password), []byte(settings.Password)) == 1 {
+				next.ServeHTTP(w, req)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, Name))
+		} else {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, Name))
+		}
+		w.WriteHeader(401)
+	})
+}
+
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// isLoopbackAddr reports whether a listen address only accepts local
+// connections.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func (ctx *httpServerCtx) buildServer() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/started", func(w http.ResponseWriter, _ *http.Request) {
@@ -24,13 +100,21 @@ func (ctx *httpServerCtx) buildServer() {
 	})
 
 	mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
+		if l := ctx.indexConfig.lagging(); l != nil {
+			w.WriteHeader(503)
+			fmt.Fprintf(w, "stream %s is %ds behind, over max-lag of %ds", l.StreamID, l.LagSeconds, ctx.indexConfig.config.MaxLag)
+			return
+		}
 		w.WriteHeader(200)
 		w.Write([]byte("ok"))
 	})
 
 	if ctx.indexConfig.config.Stats {
 		mux.HandleFunc("/stats", func(w http.ResponseWriter, _ *http.Request) {
-			stats, err := json.MarshalIndent(ctx.indexConfig.stats, "", "    ")
+			stats, err := json.MarshalIndent(struct {
+				*bulkProcessorStats
+				Lag []*streamLag
+			}{ctx.indexConfig.stats, ctx.indexConfig.lag.lags()}, "", "    ")
 			if err == nil {
 				w.Header().Set("Content-Type", "application/json")
 				w.WriteHeader(200)
@@ -43,36 +127,281 @@ func (ctx *httpServerCtx) buildServer() {
 		})
 	}
 
-	if ctx.indexConfig.config.Pprof {
-		mux.HandleFunc("/debug/pprof/", pprof.Index)
-		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		writeHealthReport(w, ctx.indexConfig.healthz())
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		writeHealthReport(w, ctx.indexConfig.readyz())
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(200)
+		ctx.indexConfig.writeMetrics(w)
+	})
+
+	if ctx.indexConfig.config.DetectSchemaDrift {
+		mux.HandleFunc("/schema", func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Query().Get("refresh") == "true" {
+				ctx.indexConfig.refreshSchemas(true)
+			}
+			report, err := json.MarshalIndent(ctx.indexConfig.schemaReport(), "", "    ")
+			if err == nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(200)
+				w.Write(report)
+				fmt.Fprintln(w)
+			} else {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Unable to print schema report: %s", err)
+			}
+		})
+	}
+
+	mux.HandleFunc("/control", ctx.control)
+	mux.HandleFunc("/control/", ctx.control)
+
+	if ctx.indexConfig.config.audit != nil {
+		mux.HandleFunc("/audit", ctx.audit)
+	}
+
+	config := ctx.indexConfig.config
+	errorLog := config.log(httpComponent).stdLogger(errorLevel)
+	if config.Pprof {
+		if config.HTTPServer.PprofAddr == "" {
+			registerPprof(mux)
+		} else if !isLoopbackAddr(config.HTTPServer.PprofAddr) {
+			config.log(httpComponent).Error("Not serving pprof, pprof-addr must be a loopback address", "addr", config.HTTPServer.PprofAddr)
+		} else {
+			pprofMux := http.NewServeMux()
+			registerPprof(pprofMux)
+			ctx.pprofServer = &http.Server{
+				Addr:     config.HTTPServer.PprofAddr,
+				Handler:  pprofMux,
+				ErrorLog: errorLog,
+			}
+		}
 	}
 
 	s := &http.Server{
-		Addr:     ctx.indexConfig.config.HTTPServerAddr,
-		Handler:  mux,
-		ErrorLog: ctx.indexConfig.config.ErrorLogger,
+		Addr:     config.HTTPServerAddr,
+		Handler:  ctx.authenticate(mux),
+		ErrorLog: errorLog,
 	}
 	ctx.httpServer = s
 }
 
+func writeHealthReport(w http.ResponseWriter, report *healthReport) {
+	data, _ := json.MarshalIndent(report, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	if report.ok() {
+		w.WriteHeader(200)
+	} else {
+		w.WriteHeader(503)
+	}
+	w.Write(data)
+	fmt.Fprintln(w)
+}
+
+// checkpoint serves /control/checkpoint. GET shows the saved checkpoint and
+// POST flushes and saves it. On POST the action parameter instead sets (ts),
+// rewinds (by) or resets it. Since this process would overwrite the change,
+// the request must be forced and checkpoint saving stops until restart or the
+// release action.
+func (ctx *httpServerCtx) checkpoint(w http.ResponseWriter, req *http.Request) {
+	ic := ctx.indexConfig
+	q := req.URL.Query()
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		switch q.Get("action") {
+		case "":
+			if !ctx.saveCheckpoint(w, req) {
+				return
+			}
+		case "release":
+			ic.releaseCheckpoint()
+		default:
+			if !ctx.changeCheckpoint(w, req) {
+				return
+			}
+		}
+	default:
+		w.WriteHeader(405)
+		return
+	}
+	cp, err := ic.loadCheckpoint()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Unable to load checkpoint: %s", err)
+		return
+	}
+	data, _ := json.MarshalIndent(cp, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+	fmt.Fprintln(w)
+}
+
+// saveCheckpoint flushes the buffers and saves the checkpoint, answering the
+// request when it cannot.
+func (ctx *httpServerCtx) saveCheckpoint(w http.ResponseWriter, req *http.Request) bool {
+	ic := ctx.indexConfig
+	log := ic.config.log(httpComponent).With("action", "checkpoint", "remote_addr", req.RemoteAddr)
+	if !ic.config.Resume {
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "Checkpoints are only saved with resume enabled")
+		return false
+	}
+	ic.indexMutex.Lock()
+	held := ic.checkpointHeld
+	ic.indexMutex.Unlock()
+	if held {
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "Saving of checkpoints is suspended until restart or release since the checkpoint was changed")
+		return false
+	}
+	if err := ic.saveTs(); err != nil {
+		log.Error("Forced checkpoint failed", "error", err)
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Unable to save checkpoint: %s", err)
+		return false
+	}
+	log.Info("Checkpoint saved")
+	return true
+}
+
+// changeCheckpoint applies the set, rewind or reset action of the request and
+// holds the checkpoint, answering the request when it cannot.
+func (ctx *httpServerCtx) changeCheckpoint(w http.ResponseWriter, req *http.Request) bool {
+	ic := ctx.indexConfig
+	q := req.URL.Query()
+	if q.Get("force") != "true" {
+		w.WriteHeader(409)
+		fmt.Fprintf(w, "Changing the checkpoint of a running sync requires force=true, checkpoints are not saved again until restart or release")
+		return false
+	}
+	var err error
+	switch q.Get("action") {
+	case "set":
+		var ts int64
+		if ts, err = strconv.ParseInt(q.Get("ts"), 10, 64); err == nil && ts > 0 {
+			err = ic.config.setCheckpoint(uint32(ts))
+		} else {
+			err = fmt.Errorf("invalid ts %q", q.Get("ts"))
+		}
+	case "rewind":
+		var by time.Duration
+		if by, err = time.ParseDuration(q.Get("by")); err == nil {
+			_, err = ic.config.rewindCheckpoint(by)
+		}
+	case "reset":
+		err = ic.config.deleteCheckpoint()
+	default:
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Unknown checkpoint action %q", q.Get("action"))
+		return false
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Unable to change checkpoint: %s", err)
+		return false
+	}
+	ic.holdCheckpoint()
+	return true
+}
+
+// resync indexes the docs of a namespace read from mongo on POST
+// /control/resync, by ids or by filter.
+func (ctx *httpServerCtx) resync(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		resyncRequest
+		Filter json.RawMessage `json:"filter"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, req.Body, resyncMaxBody)).Decode(&body)
+	if err == nil && len(body.Filter) > 0 {
+		err = body.setFilter(string(body.Filter))
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid resync request: %s", err)
+		return
+	}
+	results, err := ctx.indexConfig.resync(&body.resyncRequest)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Unable to resync: %s", err)
+		return
+	}
+	writeJSON(w, results)
+}
+
+// audit returns the audit trail of the doc with the id parameter, optionally
+// limited to a namespace and to the latest limit entries.
+func (ctx *httpServerCtx) audit(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	id := q.Get("id")
+	if id == "" {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "The id parameter is required")
+		return
+	}
+	var limit int64
+	if s := q.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.ParseInt(s, 10, 64); err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid limit %q", s)
+			return
+		}
+	}
+	entries, err := ctx.indexConfig.config.audit.find(id, q.Get("namespace"), limit)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Unable to load audit trail: %s", err)
+		return
+	}
+	data, _ := json.MarshalIndent(entries, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+	fmt.Fprintln(w)
+}
+
 func (ctx *httpServerCtx) serveHTTP() {
 	s := ctx.httpServer
-	if ctx.indexConfig.config.Verbose {
-		ctx.indexConfig.config.InfoLogger.Printf("Starting http server at %s", s.Addr)
-	}
+	settings := ctx.indexConfig.config.HTTPServer
+	log := ctx.indexConfig.config.log(httpComponent)
 	ctx.started = time.Now()
+	var err error
+	if settings.TLSCert != "" {
+		log.Debug("Starting https server", "addr", s.Addr)
+		err = s.ListenAndServeTLS(settings.TLSCert, settings.TLSKey)
+	} else {
+		log.Debug("Starting http server", "addr", s.Addr)
+		err = s.ListenAndServe()
+	}
+	if !ctx.shutdown {
+		log.Fatal("Unable to serve http", "addr", s.Addr, "error", err)
+	}
+}
+
+func (ctx *httpServerCtx) servePprof() {
+	s := ctx.pprofServer
+	log := ctx.indexConfig.config.log(httpComponent)
+	log.Debug("Starting pprof server", "addr", s.Addr)
 	err := s.ListenAndServe()
 	if !ctx.shutdown {
-		ctx.indexConfig.config.ErrorLogger.Fatalf("Unable to serve http at address %s: %s", s.Addr, err)
+		log.Error("Unable to serve pprof", "addr", s.Addr, "error", err)
 	}
 }
 
 func startHTTPServer(ctx *httpServerCtx) {
 	ctx.buildServer()
 	ctx.started = time.Now()
+	if ctx.pprofServer != nil {
+		go ctx.servePprof()
+	}
 	ctx.serveHTTP()
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	bearer := httpServerSettings{BearerToken: "secret"}
+	basic := httpServerSettings{Username: "admin", Password: "pw"}
+	both := httpServerSettings{BearerToken: "secret", Username: "admin", Password: "pw"}
+	tests := []struct {
+		name       string
+		settings   httpServerSettings
+		path       string
+		bearer     string
+		user, pass string
+		wantStatus int
+		wantAuth   string
+	}{
+		{"no credentials configured", httpServerSettings{}, "/stats", "", "", "", 200, ""},
+		{"missing bearer token", bearer, "/stats", "", "", "", 401, `Bearer realm="` + Name + `"`},
+		{"wrong bearer token", bearer, "/stats", "other", "", "", 401, `Bearer realm="` + Name + `"`},
+		{"bearer token", bearer, "/stats", "secret", "", "", 200, ""},
+		{"health is open", bearer, "/health", "", "", "", 200, ""},
+		{"readyz is open", bearer, "/readyz", "", "", "", 200, ""},
+		{"control checks its own token", bearer, "/control/pause", "", "", "", 200, ""},
+		{"control prefix only", bearer, "/controls", "", "", "", 401, `Bearer realm="` + Name + `"`},
+		{"missing basic auth", basic, "/metrics", "", "", "", 401, `Basic realm="` + Name + `"`},
+		{"wrong password", basic, "/metrics", "", "admin", "nope", 401, `Basic realm="` + Name + `"`},
+		{"basic auth", basic, "/metrics", "", "admin", "pw", 200, ""},
+		{"basic auth when both are set", both, "/metrics", "", "admin", "pw", 200, ""},
+		{"bearer token when both are set", both, "/metrics", "secret", "", "", 200, ""},
+		{"both set and none given", both, "/metrics", "", "", "", 401, `Basic realm="` + Name + `"`},
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(200) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &httpServerCtx{indexConfig: &indexClient{config: &configOptions{HTTPServer: tt.settings}}}
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			w := httptest.NewRecorder()
+			ctx.authenticate(ok).ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != tt.wantAuth {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, tt.wantAuth)
+			}
+		})
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"localhost:6060", true},
+		{"127.0.0.1:6060", true},
+		{"127.1.2.3:6060", true},
+		{"[::1]:6060", true},
+		{":6060", false},
+		{"0.0.0.0:6060", false},
+		{"10.0.0.1:6060", false},
+		{"[::]:6060", false},
+		{"example.com:6060", false},
+		{"127.0.0.1", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isLoopbackAddr(tt.addr); got != tt.want {
+			t.Errorf("isLoopbackAddr(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
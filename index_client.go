@@ -1,14 +1,13 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/rwynn/gtm"
-	client "github.com/testbook/app-search-client"
 	"github.com/testbook/app-search-sync/plugin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -16,28 +15,92 @@ import (
 )
 
 type indexEngineCtx struct {
-	name      string
-	namespace string
-	docs      []interface{}
-	plugin    plugin.MapperPlugin
+	name         string
+	namespace    string
+	docs         []interface{}
+	reindexDocs  []interface{}                  // direct read docs only sent to the reindex engine
+	reindexName  string                         // the new source engine while reindexing a meta engine
+	deletes      []string                       // ids of docs to remove from the engine
+	ops          []*gtm.Op                      // ops waiting to be mapped by the batch plugin on flush
+	pending      map[string]primitive.Timestamp // latest oplog op buffered per stream
+	traces       []*span                        // spans of the buffered ops being traced
+	requests     []*tracedRequest               // App Search requests of the flush, for traces
+	audits       []*auditedOp                   // audited ops waiting for the flush outcome
+	versions     map[string]docVersion          // versions of the buffered docs, stored once flushed
+	spill        *engineSpill
+	idSeparator  string
+	idFields     []string
+	normalize    normalizeSettings
+	schema       *schemaTracker // nil unless schema drift detection is enabled
+	plugin       plugin.MapperPlugin
+	batchPlugin  plugin.BatchMapperPlugin
+	pluginConfig map[string]interface{}
+}
+
+func (e *indexEngineCtx) buffered() int {
+	return len(e.docs) + len(e.reindexDocs) + len(e.deletes) + len(e.ops)
+}
+
+// docVersion is the version of a doc buffered for an engine, or of its delete.
+// Versions set by plugins and oplog timestamps are on different scales and
+// are only compared with versions on the same scale.
+type docVersion struct {
+	version int64
+	plugin  bool // set by the plugin rather than the oplog timestamp
+	deleted bool
+}
+
+// unbuffer removes the doc or delete buffered for id, so that the op buffered
+// next is the one sent whatever the order of deletes and docs in a flush. The
+// caller must hold indexMutex.
+func (e *indexEngineCtx) unbuffer(id string) {
+	e.docs = unbufferDoc(e.docs, id)
+	e.reindexDocs = unbufferDoc(e.reindexDocs, id)
+	deletes := e.deletes[:0]
+	for _, d := range e.deletes {
+		if d != id {
+			deletes = append(deletes, d)
+		}
+	}
+	e.deletes = deletes
+}
+
+func unbufferDoc(docs []interface{}, id string) []interface{} {
+	kept := docs[:0]
+	for _, doc := range docs {
+		if m, ok := doc.(map[string]interface{}); !ok || m["id"] != id {
+			kept = append(kept, doc)
+		}
+	}
+	return kept
 }
 
 type indexClient struct {
-	gtmCtx          *gtm.OpCtxMulti
-	config          *configOptions
-	coreMongo       *mongo.Client
-	learnMongo      *mongo.Client
-	engagementMongo *mongo.Client
-	testMongo       *mongo.Client
-	client          client.Client
-	indexWg         *sync.WaitGroup
-	indexMutex      *sync.Mutex
-	indexC          chan *gtm.Op
-	lastTs          primitive.Timestamp
-	tokens          bson.M
-	lastUpdateTs    time.Time
-	engines         map[string]*indexEngineCtx
-	stats           *bulkProcessorStats
+	gtmCtx             *gtm.OpCtxMulti
+	config             *configOptions
+	coreMongo          *mongo.Client
+	learnMongo         *mongo.Client
+	engagementMongo    *mongo.Client
+	testMongo          *mongo.Client
+	client             *appSearchClient
+	indexWg            *sync.WaitGroup
+	indexMutex         *sync.Mutex
+	indexC             chan *gtm.Op
+	lastTs             primitive.Timestamp
+	tokens             bson.M
+	checkpointHeld     bool // set once the checkpoint is changed while running
+	lastUpdateTs       time.Time
+	engines            map[string]*indexEngineCtx
+	stats              *bulkProcessorStats
+	metrics            *syncMetrics
+	lag                *lagTracker
+	live               *liveness
+	pause              *pauseGate
+	versions           *versionStore
+	schemaRefresh      chan struct{} // wakes the schema refresher after a flush
+	drains             sync.Map      // markers of the drains in progress, see drainOps
+	directReadsDone    chan struct{} // closed once direct reads are indexed with exit-after-direct-reads
+	directReadsIndexed chan struct{} // closed once the ops of the direct reads are indexed
 }
 
 type dbcol struct {
@@ -64,11 +127,27 @@ func (ic *indexClient) setupEngines() error {
 
 	ic.engines = make(map[string]*indexEngineCtx)
 	for _, engine := range ic.config.EngineConfig {
+		idSeparator := engine.IDSeparator
+		if idSeparator == "" {
+			idSeparator = ic.config.IDSeparator
+		}
 		ic.engines[engine.Namespace] = &indexEngineCtx{
-			name:      engine.Name,
-			namespace: engine.Namespace,
-			plugin:    engine.Plugin,
+			name:         engine.indexName(),
+			namespace:    engine.Namespace,
+			plugin:       engine.Plugin,
+			batchPlugin:  engine.BatchPlugin,
+			pluginConfig: engine.PluginConfig,
+			idSeparator:  idSeparator,
+			idFields:     engine.IDFields,
+			normalize:    ic.config.Normalize.merge(engine.Normalize),
+		}
+		if ic.config.DetectSchemaDrift {
+			ic.engines[engine.Namespace].schema = newSchemaTracker(engine.Schema, engine.BlockUnexpectedFields)
 		}
+		ic.setupSpill(ic.engines[engine.Namespace], engine)
+	}
+	if ic.config.DetectSchemaDrift {
+		ic.refreshSchemas(true)
 	}
 	return nil
 }
@@ -76,103 +155,411 @@ func (ic *indexClient) setupEngines() error {
 func (ic *indexClient) batchIndex() (err error) {
 	ic.indexMutex.Lock()
 	defer ic.indexMutex.Unlock()
+	return ic.flush()
+}
 
+// flush maps any ops pending for batch plugins and indexes the buffered docs
+// of every engine. The caller must hold indexMutex.
+func (ic *indexClient) flush() (err error) {
 	docs := 0
+	flushStart := time.Now()
 	for idx, e := range ic.engines {
-		if len(e.docs) == 0 {
+		var engineErr, indexErr, delErr error
+		if len(e.ops) > 0 {
+			if mapErr := ic.batchMap(e); mapErr != nil {
+				// keep the ops and their checkpoint for the next flush to retry;
+				// they are not failed docs since they are not given up
+				ic.config.log(pluginComponent).Error("Unable to map ops, retrying on next flush", "engine", e.name, "namespace", e.namespace, "ops", len(e.ops), "error", mapErr)
+				ic.metrics.mapRetries.add(float64(len(e.ops)), e.name, e.namespace)
+				for _, op := range e.ops {
+					ic.config.audit.record(op, e.name, auditFailed, "plugin", mapErr)
+				}
+				err = mapErr
+				continue
+			}
+			e.ops = nil
+		}
+		if e.spilling() {
+			if spillErr := ic.spillEngine(e); spillErr != nil {
+				// keep the buffers and their checkpoint for the next flush
+				err = spillErr
+				continue
+			}
+			ic.finishTraces(e, flushStart)
 			continue
 		}
-
-		docs += len(e.docs)
-		if err = ic.client.Index(e.name, e.docs); err != nil {
-			ic.stats.AddFailed(len(e.docs))
+		if len(e.deletes) > 0 {
+			start := time.Now()
+			delErr = ic.deleteDocuments(e)
+			ic.traceRequest(e, "delete", e.name, len(e.deletes), start, delErr)
+			if delErr != nil {
+				ic.config.log(indexComponent).Error("Unable to delete docs", "engine", e.name, "docs", len(e.deletes), "error", delErr)
+				err, engineErr = delErr, delErr
+				ic.stats.AddFailed(len(e.deletes))
+				ic.metrics.docsFailed.add(float64(len(e.deletes)), e.name)
+			} else {
+				ic.stats.AddDeleted(len(e.deletes))
+				ic.metrics.docsDeleted.add(float64(len(e.deletes)), e.name)
+			}
+			e.deletes = nil
+		}
+		if e.reindexName != "" {
+			reindexDocs := append(e.reindexDocs, e.docs...)
+			if len(reindexDocs) > 0 {
+				docs += len(e.reindexDocs)
+				start := time.Now()
+				if indexErr = ic.indexDocuments(e.reindexName, reindexDocs); indexErr != nil {
+					err, engineErr = indexErr, indexErr
+				}
+				ic.traceRequest(e, "index", e.reindexName, len(reindexDocs), start, indexErr)
+			}
+			e.reindexDocs = nil
+		}
+		if len(e.docs) > 0 {
+			docs += len(e.docs)
+			start := time.Now()
+			docsErr := ic.indexDocuments(e.name, e.docs)
+			ic.traceRequest(e, "index", e.name, len(e.docs), start, docsErr)
+			if docsErr != nil {
+				err, engineErr, indexErr = docsErr, docsErr, docsErr
+			}
+			ic.engines[idx].docs = []interface{}{}
 		}
-		ic.engines[idx].docs = []interface{}{}
+		if engineErr == nil {
+			ic.trackIndexed(e)
+		}
+		ic.storeVersions(e, indexErr == nil, delErr == nil)
+		ic.finishTraces(e, flushStart)
+		ic.finishAudits(e, indexErr, delErr)
 	}
 
+	if ic.config.DetectSchemaDrift && docs > 0 {
+		ic.requestSchemaRefresh()
+	}
 	ic.stats.AddProcessed(docs)
-	s, _ := json.Marshal(ic.stats)
-	fmt.Printf("%+v\n", string(s))
-	if ic.config.Verbose {
-		if docs > 0 {
-			ic.config.InfoLogger.Printf("%d docs flushed\n", docs)
-		}
+	if docs > 0 {
+		ic.config.log(indexComponent).Debug("Docs flushed", "docs", docs)
 	}
 	ic.lastUpdateTs = time.Now()
 	return
 }
 
+// indexDocuments sends one batch of docs to the engine, recording the outcome
+// in the stats and metrics.
+func (ic *indexClient) indexDocuments(engine string, docs []interface{}) error {
+	start := time.Now()
+	err := ic.client.Index(engine, docs)
+	ic.metrics.requestDuration.since(start, engine, "index")
+	ic.metrics.flushBatchSize.observe(float64(len(docs)), engine)
+	if err != nil {
+		ic.config.log(indexComponent).Error("Unable to index docs", "engine", engine, "docs", len(docs), "error", err)
+		ic.stats.AddFailed(len(docs))
+		ic.metrics.docsFailed.add(float64(len(docs)), engine)
+		return err
+	}
+	ic.stats.AddCommitted(1)
+	ic.stats.AddIndexed(len(docs))
+	ic.metrics.docsIndexed.add(float64(len(docs)), engine)
+	return nil
+}
+
 func (ic *indexClient) saveTs() (err error) {
 	if !(ic.config.Resume && ic.lastTs.T > 0) {
 		return err
 	}
 
-	if err = ic.batchIndex(); err != nil {
+	ic.indexMutex.Lock()
+	defer ic.indexMutex.Unlock()
+	if err = ic.flush(); err != nil {
+		return err
+	}
+	if ic.checkpointHeld {
 		return err
 	}
 	if ic.config.ResumeStrategy == tokenResumeStrategy {
-		err = saveTokens(ic.coreMongo, ic.tokens, ic.config)
+		err = ic.config.resume.SaveTokens(ic.tokens)
 		if err == nil {
 			ic.tokens = bson.M{}
 		}
 	} else {
-		err = saveTimestamp(ic.coreMongo, ic.lastTs, ic.config)
+		err = ic.config.resume.SaveTimestamp(ic.lastTs)
 	}
 
 	ic.lastTs = primitive.Timestamp{}
 	return err
 }
 
+func (ic *indexClient) saveVersions() {
+	if ic.versions == nil {
+		return
+	}
+	if err := ic.versions.save(); err != nil {
+		ic.config.log(indexComponent).Error("Unable to save document versions", "path", ic.versions.path, "error", err)
+	}
+}
+
+// lookupInView rebuilds a change event for the namespace of the engine. The op
+// keeps its change stream source and resume token: it is indexed from the
+// event document, so it must advance the checkpoint and the lag of its stream
+// like any other change event, and be written to both engines while
+// reindexing rather than only to the new one like a direct read.
 func (ic *indexClient) lookupInView(orig *gtm.Op, namespace string) (op *gtm.Op, err error) {
-	op = &gtm.Op{
-		Id:        orig.Id,
-		Operation: orig.Operation,
-		Namespace: namespace,
-		Source:    gtm.DirectQuerySource,
-		Timestamp: orig.Timestamp,
+	rebuilt := *orig
+	rebuilt.Namespace = namespace
+	return &rebuilt, nil
+}
+
+func (ic *indexClient) mapperInput(engine *indexEngineCtx, op *gtm.Op) *plugin.MapperPluginInput {
+	return &plugin.MapperPluginInput{
+		Id:              op.Id,
+		Document:        op.Doc,
+		Data:            op.Data,
+		Database:        op.GetDatabase(),
+		Collection:      op.GetCollection(),
+		Operation:       op.Operation,
+		Namespace:       op.Namespace,
+		CoreMongo:       ic.coreMongo,
+		LearnMongo:      ic.learnMongo,
+		EngagementMongo: ic.engagementMongo,
+		TestMongo:       ic.testMongo,
+		Config:          engine.pluginConfig,
+		Context:         context.Background(),
 	}
-	return
+}
+
+// mapOps runs ops through the plugin of the engine, calling the batch plugin
+// once for all of them. Outputs are nil when the engine has no plugin.
+func (ic *indexClient) mapOps(engine *indexEngineCtx, ops []*gtm.Op) ([]*plugin.MapperPluginOutput, error) {
+	outs := make([]*plugin.MapperPluginOutput, len(ops))
+	if engine.plugin != nil {
+		for i, op := range ops {
+			start := time.Now()
+			trace := ic.config.tracer.opSpan(op).child("plugin.map", start)
+			inp := ic.mapperInput(engine, op)
+			inp.Context = contextWithSpan(inp.Context, trace)
+			upd, err := engine.plugin(inp)
+			ic.metrics.pluginDuration.since(start, engine.name, engine.namespace)
+			trace.finish(err)
+			if err != nil {
+				return nil, fmt.Errorf("Error while calling MappingFunc for ns: %s, doc ID: %s, err: %s", op.Namespace, op.Id, err.Error())
+			}
+			outs[i] = upd
+		}
+	} else if engine.batchPlugin != nil && len(ops) > 0 {
+		inps := make([]*plugin.MapperPluginInput, len(ops))
+		traces := make([]*span, len(ops))
+		start := time.Now()
+		for i, op := range ops {
+			traces[i] = ic.config.tracer.opSpan(op).child("plugin.batch_map", start)
+			traces[i].set("batch_size", len(ops))
+			inps[i] = ic.mapperInput(engine, op)
+			inps[i].Context = contextWithSpan(inps[i].Context, traces[i])
+		}
+		var err error
+		outs, err = engine.batchPlugin(inps)
+		ic.metrics.pluginDuration.since(start, engine.name, engine.namespace)
+		for _, trace := range traces {
+			trace.finish(err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error while calling BatchMappingFunc for ns: %s, %d docs, err: %s", engine.namespace, len(inps), err.Error())
+		}
+		if len(outs) != len(inps) {
+			return nil, fmt.Errorf("BatchMappingFunc for ns: %s returned %d docs for %d inputs", engine.namespace, len(outs), len(inps))
+		}
+	}
+	return outs, nil
+}
+
+// batchMap runs the pending ops of an engine through its batch plugin and
+// buffers the resulting docs. The caller must hold indexMutex.
+func (ic *indexClient) batchMap(engine *indexEngineCtx) error {
+	outs, err := ic.mapOps(engine, engine.ops)
+	if err != nil {
+		return err
+	}
+	for i, upd := range outs {
+		if upd == nil && !engine.ops[i].IsDelete() {
+			// counted, traced and audited like a skip so that a plugin bug
+			// cannot drop docs unnoticed
+			upd = &plugin.MapperPluginOutput{Skip: true}
+		}
+		if err = ic.bufferOutput(engine, engine.ops[i], upd); err != nil {
+			ic.opLog(engine, engine.ops[i]).Error("Unable to buffer doc", "error", err)
+		}
+	}
+	return nil
+}
+
+// deleteDocuments removes the buffered deletes from the engine, and from the
+// new source engine while reindexing.
+func (ic *indexClient) deleteDocuments(e *indexEngineCtx) error {
+	start := time.Now()
+	err := ic.client.deleteDocuments(e.name, e.deletes)
+	ic.metrics.requestDuration.since(start, e.name, "delete")
+	if err != nil {
+		return err
+	}
+	if e.reindexName != "" {
+		start = time.Now()
+		err = ic.client.deleteDocuments(e.reindexName, e.deletes)
+		ic.metrics.requestDuration.since(start, e.reindexName, "delete")
+	}
+	return err
+}
+
+// bufferOutput adds the result of mapping op to the engine buffers. A nil
+// output means op was not mapped by a plugin. The caller must hold indexMutex.
+func (ic *indexClient) bufferOutput(engine *indexEngineCtx, op *gtm.Op, upd *plugin.MapperPluginOutput) error {
+	_, err := ic.bufferOutcome(engine, op, upd)
+	return err
+}
+
+// bufferOutcome buffers the mapped doc or delete of the op like bufferOutput
+// and returns what became of it: indexed, deleted, skipped, invalid, schema or
+// stale. The doc is only indexed or deleted once flushed.
+func (ic *indexClient) bufferOutcome(engine *indexEngineCtx, op *gtm.Op, upd *plugin.MapperPluginOutput) (string, error) {
+	trace := ic.config.tracer.opSpan(op)
+	id, m, version, err := engine.mapOutput(op, upd)
+	if err != nil {
+		ic.metrics.docsDropped.add(1, engine.name, engine.namespace, "invalid")
+		trace.set("outcome", "invalid")
+		ic.config.audit.record(op, engine.name, auditDropped, "invalid", err)
+		return "invalid", fmt.Errorf("Unable to prepare document for ns: %s, doc ID: %v, err: %s", op.Namespace, op.Id, err)
+	}
+	if id == "" {
+		ic.metrics.docsSkipped.add(1, engine.name, engine.namespace)
+		trace.set("outcome", "skipped")
+		ic.config.audit.record(op, engine.name, auditSkipped, "", nil)
+		return "skipped", nil
+	}
+	v := docVersion{version: version, plugin: upd != nil && upd.Version > 0, deleted: m == nil}
+	if m != nil && !ic.checkSchema(engine, m) {
+		ic.metrics.docsDropped.add(1, engine.name, engine.namespace, "schema")
+		trace.set("outcome", "schema")
+		ic.config.audit.record(op, engine.name, auditDropped, "schema", nil)
+		return "schema", nil
+	}
+	if ic.isStale(engine, id, v) {
+		trace.set("outcome", "stale")
+		ic.config.audit.record(op, engine.name, auditDropped, "stale", nil)
+		return "stale", nil
+	}
+	if m == nil {
+		// the version of the delete is kept so that older writes delivered
+		// late cannot bring the doc back
+		engine.unbuffer(id)
+		engine.deletes = append(engine.deletes, id)
+		ic.bufferVersion(engine, id, v)
+		trace.set("outcome", "deleted")
+		ic.auditBuffered(engine, op, auditDeleted)
+		return "deleted", nil
+	}
+	ic.metrics.docsMapped.add(1, engine.name, engine.namespace)
+	trace.set("outcome", "indexed")
+	ic.config.audit.record(op, engine.name, auditMapped, "", nil)
+	ic.auditBuffered(engine, op, auditIndexed)
+	engine.unbuffer(id)
+	ic.bufferVersion(engine, id, v)
+	if engine.reindexName != "" && op.IsSourceDirect() {
+		engine.reindexDocs = append(engine.reindexDocs, m)
+		return "indexed", nil
+	}
+	engine.docs = append(engine.docs, m)
+	return "indexed", nil
+}
+
+// isStale reports whether a newer version of the document has already been
+// indexed, deleted or buffered, in which case the write or delete must be
+// dropped. The caller must hold indexMutex.
+func (ic *indexClient) isStale(engine *indexEngineCtx, id string, v docVersion) bool {
+	if ic.versions == nil || v.version == 0 {
+		return false
+	}
+	if buffered, ok := engine.versions[id]; ok {
+		if buffered.plugin != v.plugin || v.version >= buffered.version {
+			return false
+		}
+	} else if !ic.versions.stale(engine.namespace, id, v) {
+		return false
+	}
+	ic.stats.AddStale(1)
+	ic.metrics.docsDropped.add(1, engine.name, engine.namespace, "stale")
+	ic.config.log(indexComponent).Debug("Dropping stale doc version", "engine", engine.name, "namespace", engine.namespace, "doc_id", id, "version", v.version, "deleted", v.deleted)
+	return true
+}
+
+// bufferVersion remembers the version of a doc buffered for the engine until
+// the outcome of the flush is known. The caller must hold indexMutex.
+func (ic *indexClient) bufferVersion(engine *indexEngineCtx, id string, v docVersion) {
+	if ic.versions == nil {
+		return
+	}
+	if engine.versions == nil {
+		engine.versions = make(map[string]docVersion)
+	}
+	engine.versions[id] = v
+}
+
+// storeVersions records the versions of the docs the flush indexed and
+// deleted, so that a failed flush leaves the versions of its docs free to be
+// written again. The caller must hold indexMutex.
+func (ic *indexClient) storeVersions(engine *indexEngineCtx, indexed, deleted bool) {
+	for id, v := range engine.versions {
+		if (v.deleted && deleted) || (!v.deleted && indexed) {
+			ic.versions.set(engine.namespace, id, v)
+		}
+	}
+	engine.versions = nil
 }
 
 func (ic *indexClient) addDocument(op *gtm.Op) error {
+	received := time.Now()
 	engine := ic.engines[op.Namespace]
 	if engine == nil {
 		return nil
 	}
+	ic.metrics.opsReceived.add(1, engine.name, op.Namespace, opSource(op))
 	if engine.namespace != "" && op.IsSourceOplog() {
 		var err error
-		op, err = ic.lookupInView(op, engine.namespace) // fetch from mongo
+		op, err = ic.lookupInView(op, engine.namespace)
 		if err != nil {
 			return err
 		}
 	}
+	if !op.IsDelete() && op.Doc == nil {
+		// e.g. an update of a doc deleted before its change event was read
+		ic.metrics.docsDropped.add(1, engine.name, engine.namespace, "invalid")
+		err := fmt.Errorf("document is empty")
+		ic.config.audit.record(op, engine.name, auditDropped, "invalid", err)
+		return err
+	}
+	trace := ic.config.tracer.startOp(engine, op, received)
 
+	// deletes are mapped too so that the plugin can set the id to delete
+	var upd *plugin.MapperPluginOutput
 	if engine.plugin != nil {
-		inp := &plugin.MapperPluginInput{
-			Id:              op.Id,
-			Document:        op.Doc,
-			Data:            op.Data,
-			Database:        op.GetDatabase(),
-			Collection:      op.GetCollection(),
-			Operation:       op.Operation,
-			Namespace:       op.Namespace,
-			CoreMongo:       ic.coreMongo,
-			LearnMongo:      ic.learnMongo,
-			EngagementMongo: ic.engagementMongo,
-			TestMongo:       ic.testMongo,
-		}
-		upd, err := engine.plugin(inp)
+		outs, err := ic.mapOps(engine, []*gtm.Op{op})
 		if err != nil {
-			err = fmt.Errorf("Error while calling MappingFunc for ns: %s, doc ID: %s, err: %s", op.Namespace, op.Id, err.Error())
+			ic.metrics.docsDropped.add(1, engine.name, engine.namespace, "plugin_error")
+			ic.config.tracer.endOp(trace, err)
+			ic.config.audit.record(op, engine.name, auditFailed, "plugin", err)
 			return err
 		}
-		if upd.Skip {
-			return nil
-		}
-		op.Doc = upd.Document
+		upd = outs[0]
 	}
-	engine.docs = append(engine.docs, op.Doc)
 
+	ic.indexMutex.Lock()
+	defer ic.indexMutex.Unlock()
+	if engine.batchPlugin != nil {
+		engine.ops = append(engine.ops, op)
+	} else if err := ic.bufferOutput(engine, op, upd); err != nil {
+		ic.config.tracer.endOp(trace, err)
+		return err
+	}
+	ic.bufferTrace(engine, trace)
+
+	ic.trackPending(engine, op)
 	if op.IsSourceOplog() {
 		ic.lastTs = op.Timestamp
 		if ic.config.ResumeStrategy == tokenResumeStrategy {
@@ -180,51 +567,144 @@ func (ic *indexClient) addDocument(op *gtm.Op) error {
 		}
 	}
 
-	if len(engine.docs) >= ic.config.FlushBufferSize {
-		if err := ic.batchIndex(); err != nil {
+	if engine.buffered() >= ic.config.FlushBufferSize {
+		if err := ic.flush(); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (ic *indexClient) index() {
+func (ic *indexClient) index(worker int) {
+	loop := fmt.Sprintf("index-%d", worker)
+	ticker := time.NewTicker(loopBeatInterval)
+	defer ticker.Stop()
+	defer ic.live.done(loop)
 	for {
+		ic.live.beat(loop, loopBeatTimeout)
+		opC, resumed := ic.pause.opChannel(ic.gtmCtx.OpC)
 		select {
+		case <-ticker.C:
+
+		case <-resumed:
+
 		case err := <-ic.gtmCtx.ErrC:
 			if err == nil {
 				break
 			}
-			ic.config.ErrorLogger.Println(err)
+			ic.live.streamError(err)
+			ic.config.log(gtmComponent).Error("Change stream error", "error", err)
 
-		case op, open := <-ic.gtmCtx.OpC:
+		case op, open := <-opC:
 			if op == nil {
 				if !open {
 					if err := ic.saveTs(); err != nil {
-						ic.config.ErrorLogger.Println(err)
+						ic.config.log(resumeComponent).Error("Unable to save checkpoint", "error", err)
 					}
 					return
 				}
 				break
 			}
+			if d, ok := ic.drains.Load(op); ok {
+				ic.waitDrain(d.(*opDrain), loop, ticker)
+				break
+			}
 			if err := ic.addDocument(op); err != nil {
-				ic.config.ErrorLogger.Println(err)
+				ic.opLog(ic.engines[op.Namespace], op).Error("Unable to index op", "error", err)
 			}
 		}
 	}
 }
 
+// opDrain is the marker of a drain, sent through the op channel once per
+// index loop. Each loop stops at a marker until every loop has reached one, so
+// that the ops read before the markers are buffered once the drain is done.
+type opDrain struct {
+	mutex   sync.Mutex
+	pending int
+	done    chan struct{}
+}
+
+func (d *opDrain) reach() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.pending--; d.pending == 0 {
+		close(d.done)
+	}
+}
+
+// cancel releases the loops waiting at the markers already read.
+func (d *opDrain) cancel() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.pending > 0 {
+		d.pending = 0
+		close(d.done)
+	}
+}
+
+func (ic *indexClient) waitDrain(d *opDrain, loop string, ticker *time.Ticker) {
+	d.reach()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			ic.live.beat(loop, loopBeatTimeout)
+		}
+	}
+}
+
+// drainOps returns once the ops read by gtm so far are buffered, which waits
+// for consumption to resume when paused. It returns false when the op channel
+// was closed meanwhile.
+func (ic *indexClient) drainOps() (drained bool) {
+	d := &opDrain{pending: ic.config.AppSearchClients, done: make(chan struct{})}
+	markers := make([]*gtm.Op, d.pending)
+	for i := range markers {
+		markers[i] = &gtm.Op{}
+		ic.drains.Store(markers[i], d)
+	}
+	defer func() {
+		if recover() != nil {
+			// the op channel was closed by a shutdown
+			d.cancel()
+			drained = false
+		}
+		for _, m := range markers {
+			ic.drains.Delete(m)
+		}
+	}()
+	for _, m := range markers {
+		ic.gtmCtx.OpC <- m
+	}
+	<-d.done
+	return true
+}
+
 func (ic *indexClient) directReads() {
 	directReadsFunc := func() {
 		ic.gtmCtx.DirectReadWg.Wait()
-		ic.config.InfoLogger.Println("Direct reads completed")
+		ic.config.log(indexComponent).Info("Direct reads completed")
+		// wait for the index loops to buffer the ops read, which blocks while
+		// consumption is paused, then index them
+		if !ic.drainOps() {
+			return
+		}
+		if ic.config.Reindex {
+			ic.finishReindex()
+		} else if err := ic.batchIndex(); err != nil {
+			ic.config.log(indexComponent).Error("Unable to flush direct reads", "error", err)
+		}
+		close(ic.directReadsIndexed)
 
 		// Resume not supported for direct read
 		//if ic.config.Resume && ic.config.ResumeStrategy == timestampResumeStrategy {
-		//saveTimestampFromReplStatus(ic.mongo, ic.config)
+		//saveTimestampFromReplStatus(ic.coreMongo, ic.config.resume)
 		//}
 		if ic.config.ExitAfterDirectReads {
 			ic.gtmCtx.Stop()
+			close(ic.directReadsDone)
 		}
 	}
 	if ic.config.DirectReads {
@@ -234,7 +714,7 @@ func (ic *indexClient) directReads() {
 
 func (ic *indexClient) startIndex() {
 	for i := 0; i < ic.config.AppSearchClients; i += 1 {
-		go ic.index()
+		go ic.index(i)
 	}
 }
 
@@ -243,12 +723,18 @@ func (ic *indexClient) flusher(interval time.Duration) {
 	defer ticker.Stop()
 
 	for {
+		ic.live.beat("flusher", 3*interval+loopBeatTimeout)
 		<-ticker.C // Periodic flush
 
-		ic.config.InfoLogger.Println("batchingIndex from ticker")
+		ic.config.log(indexComponent).Debug("Flushing from ticker")
+		ic.stats.AddFlushed(1)
 		if err := ic.batchIndex(); err != nil {
-			ic.config.ErrorLogger.Println("err in flusher", err)
+			ic.config.log(indexComponent).Error("Periodic flush failed", "error", err)
+		}
+		if err := ic.saveTs(); err != nil {
+			ic.config.log(resumeComponent).Error("Unable to save checkpoint", "error", err)
 		}
+		ic.saveVersions()
 	}
 }
 
@@ -261,8 +747,48 @@ func (ic *indexClient) startFlusher() {
 func (ic *indexClient) start() {
 	ic.startIndex()
 	ic.startFlusher()
+	ic.startHeartbeat()
+	ic.startLagSampler()
+	ic.startSchemaRefresher()
+	ic.startReplays()
 	ic.directReads()
 }
 
-func (ic *indexClient) getMongoClient(namespace string) {
+// opLog returns the index logger with the fields identifying an op.
+func (ic *indexClient) opLog(engine *indexEngineCtx, op *gtm.Op) *logger {
+	log := ic.config.log(indexComponent).With("namespace", op.Namespace, "doc_id", op.Id, "op", op.Operation)
+	if engine != nil {
+		log = log.With("engine", engine.name)
+	}
+	if op.ResumeToken.StreamID != "" {
+		log = log.With("stream_id", op.ResumeToken.StreamID)
+	}
+	return log
+}
+
+// getMongoClient returns the client of the cluster the namespace is read from.
+func (ic *indexClient) getMongoClient(namespace string) *mongo.Client {
+	var cluster string
+	if m := ic.engineConfig(namespace); m != nil {
+		cluster = m.Cluster
+	}
+	switch cluster {
+	case "learn":
+		return ic.learnMongo
+	case "engagement":
+		return ic.engagementMongo
+	case "test":
+		return ic.testMongo
+	default:
+		return ic.coreMongo
+	}
+}
+
+func (ic *indexClient) engineConfig(namespace string) *engineConfig {
+	for _, m := range ic.config.EngineConfig {
+		if m.Namespace == namespace {
+			return m
+		}
+	}
+	return nil
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/rwynn/gtm"
+	"github.com/testbook/app-search-sync/plugin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestIndexClient returns an index client sending App Search requests to
+// url, with a single engine courses on db.courses.
+func newTestIndexClient(t *testing.T, url string) (*indexClient, *indexEngineCtx) {
+	t.Helper()
+	config := newConfig()
+	config.EngineConfig = []*engineConfig{{Name: "courses", Namespace: "db.courses"}}
+	c := &appSearchClient{baseURL: url, httpClient: http.DefaultClient}
+	c.Client = &documentsIndexer{c: c}
+	ic := &indexClient{
+		config:     config,
+		client:     c,
+		indexMutex: &sync.Mutex{},
+		stats:      &bulkProcessorStats{},
+		metrics:    newSyncMetrics(),
+		lag:        newLagTracker(),
+		live:       newLiveness(),
+		pause:      newPauseGate(),
+	}
+	e := &indexEngineCtx{name: "courses", namespace: "db.courses", idSeparator: "|", docs: []interface{}{}, spill: &engineSpill{}}
+	ic.engines = map[string]*indexEngineCtx{e.namespace: e}
+	return ic, e
+}
+
+func TestBatchMap(t *testing.T) {
+	ops := []*gtm.Op{
+		{Id: "1", Namespace: "db.courses", Operation: "i", Doc: map[string]interface{}{"_id": "1"}},
+		{Id: "2", Namespace: "db.courses", Operation: "i", Doc: map[string]interface{}{"_id": "2"}},
+		{Id: "3", Namespace: "db.courses", Operation: "d"},
+	}
+	tests := []struct {
+		name        string
+		outs        []*plugin.MapperPluginOutput
+		err         error
+		wantErr     bool
+		wantDocs    int
+		wantDeletes int
+		wantSkipped float64
+	}{
+		{
+			name:        "mapped",
+			outs:        []*plugin.MapperPluginOutput{{Document: map[string]interface{}{"a": 1}}, {Document: map[string]interface{}{"a": 2}}, nil},
+			wantDocs:    2,
+			wantDeletes: 1,
+		},
+		{
+			name:        "nil output is a counted skip",
+			outs:        []*plugin.MapperPluginOutput{nil, {Document: map[string]interface{}{"a": 2}}, nil},
+			wantDocs:    1,
+			wantDeletes: 1,
+			wantSkipped: 1,
+		},
+		{
+			name:    "fewer outputs than inputs",
+			outs:    []*plugin.MapperPluginOutput{{Document: map[string]interface{}{"a": 1}}},
+			wantErr: true,
+		},
+		{
+			name:    "plugin error",
+			err:     errors.New("boom"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ic, e := newTestIndexClient(t, "")
+			e.batchPlugin = func(inps []*plugin.MapperPluginInput) ([]*plugin.MapperPluginOutput, error) {
+				return tt.outs, tt.err
+			}
+			e.ops = ops
+			if err := ic.batchMap(e); (err != nil) != tt.wantErr {
+				t.Fatalf("batchMap() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(e.docs) != tt.wantDocs || len(e.deletes) != tt.wantDeletes {
+				t.Errorf("buffered %d docs and %d deletes, want %d and %d", len(e.docs), len(e.deletes), tt.wantDocs, tt.wantDeletes)
+			}
+			if got := ic.metrics.docsSkipped.values["courses\xffdb.courses"]; got != tt.wantSkipped {
+				t.Errorf("docs skipped = %v, want %v", got, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestBufferOutcomeStaleWrites(t *testing.T) {
+	doc := map[string]interface{}{"_id": "1", "title": "T"}
+	op := func(operation string, sec uint32) *gtm.Op {
+		o := &gtm.Op{Id: "1", Namespace: "db.courses", Operation: operation, Timestamp: primitive.Timestamp{T: sec}}
+		if operation != "d" {
+			o.Doc = doc
+		}
+		return o
+	}
+	tests := []struct {
+		name    string
+		flushed []*gtm.Op // buffered and stored as flushed
+		ops     []*gtm.Op
+		want    []string
+	}{
+		{"in order", nil, []*gtm.Op{op("i", 10), op("u", 20), op("d", 30)}, []string{"indexed", "indexed", "deleted"}},
+		{"late write after a buffered delete", nil, []*gtm.Op{op("d", 30), op("u", 20)}, []string{"deleted", "stale"}},
+		{"late write after a flushed delete", []*gtm.Op{op("d", 30)}, []*gtm.Op{op("u", 20), op("i", 40)}, []string{"stale", "indexed"}},
+		{"late delete after a flushed write", []*gtm.Op{op("u", 30)}, []*gtm.Op{op("d", 20)}, []string{"stale"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ic, e := newTestIndexClient(t, "")
+			ic.versions = tempVersionStore(t, 0)
+			for _, o := range tt.flushed {
+				if _, err := ic.bufferOutcome(e, o, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ic.storeVersions(e, true, true)
+			for i, o := range tt.ops {
+				got, err := ic.bufferOutcome(e, o, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.want[i] {
+					t.Errorf("op %d bufferOutcome() = %q, want %q", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFlushRetriesBatchMap(t *testing.T) {
+	srv := newFakeEngines()
+	server := httptest.NewServer(srv)
+	defer server.Close()
+	srv.add(appSearchEngine{Name: "courses"})
+	ic, e := newTestIndexClient(t, server.URL)
+	calls := 0
+	e.batchPlugin = func(inps []*plugin.MapperPluginInput) ([]*plugin.MapperPluginOutput, error) {
+		if calls++; calls <= 2 {
+			return nil, errors.New("lookup unavailable")
+		}
+		outs := make([]*plugin.MapperPluginOutput, len(inps))
+		for i, inp := range inps {
+			outs[i] = &plugin.MapperPluginOutput{Document: inp.Document}
+		}
+		return outs, nil
+	}
+	e.ops = []*gtm.Op{
+		{Id: "1", Namespace: "db.courses", Operation: "i", Doc: map[string]interface{}{"_id": "1"}},
+		{Id: "2", Namespace: "db.courses", Operation: "i", Doc: map[string]interface{}{"_id": "2"}},
+	}
+	for i := 0; i < 2; i++ {
+		if err := ic.flush(); err == nil {
+			t.Fatal("flush() error = nil, want the mapping error")
+		}
+		if len(e.ops) != 2 {
+			t.Fatalf("ops = %d after a failed mapping, want them kept", len(e.ops))
+		}
+	}
+	if err := ic.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+	if got := ic.metrics.mapRetries.values["courses\xffdb.courses"]; got != 4 {
+		t.Errorf("map retries = %v, want both ops counted on both failures", got)
+	}
+	if got := ic.metrics.docsFailed.values["courses"]; got != 0 {
+		t.Errorf("docs failed = %v, want 0 since the ops were indexed", got)
+	}
+	if got := srv.engine("courses").docs; len(got) != 2 {
+		t.Errorf("indexed docs = %v, want both ops", got)
+	}
+}
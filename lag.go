@@ -0,0 +1,221 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const lagSampleInterval = 10 * time.Second
+
+type streamLag struct {
+	StreamID     string              `json:"streamID"`
+	LastReceived primitive.Timestamp `json:"lastReceived"`
+	LastIndexed  primitive.Timestamp `json:"lastIndexed"`
+	ClusterTime  primitive.Timestamp `json:"clusterTime"` // zero when the oplog head cannot be read
+	LagSeconds   int64               `json:"lagSeconds"`
+}
+
+type streamProgress struct {
+	received primitive.Timestamp
+	indexed  primitive.Timestamp
+	head     primitive.Timestamp
+	pending  []uint32 // seconds of the ops received after the last indexed op, oldest first
+}
+
+// lagTracker follows, per change stream, the timestamp of the last op received,
+// of the last op whose docs App Search accepted and the seconds of the ops
+// received since.
+type lagTracker struct {
+	mutex   sync.Mutex
+	streams map[string]*streamProgress
+}
+
+func newLagTracker() *lagTracker {
+	return &lagTracker{streams: make(map[string]*streamProgress)}
+}
+
+func (t *lagTracker) stream(streamID string) *streamProgress {
+	s := t.streams[streamID]
+	if s == nil {
+		s = &streamProgress{}
+		t.streams[streamID] = s
+	}
+	return s
+}
+
+func (t *lagTracker) received(streamID string, ts primitive.Timestamp) {
+	t.mutex.Lock()
+	s := t.stream(streamID)
+	if tsAfter(ts, s.received) {
+		s.received = ts
+	}
+	if tsAfter(ts, s.indexed) {
+		i := sort.Search(len(s.pending), func(i int) bool { return s.pending[i] >= ts.T })
+		if i == len(s.pending) || s.pending[i] != ts.T {
+			s.pending = append(s.pending, 0)
+			copy(s.pending[i+1:], s.pending[i:])
+			s.pending[i] = ts.T
+		}
+	}
+	t.mutex.Unlock()
+}
+
+// indexed records that the ops of the stream up to ts were indexed. The second
+// of ts stays pending when the last op received is a later op of that second.
+func (t *lagTracker) indexed(streamID string, ts primitive.Timestamp) {
+	t.mutex.Lock()
+	s := t.stream(streamID)
+	if tsAfter(ts, s.indexed) {
+		s.indexed = ts
+		keep := ts.T + 1
+		if s.received.T == ts.T && s.received.I > ts.I {
+			keep = ts.T
+		}
+		i := sort.Search(len(s.pending), func(i int) bool { return s.pending[i] >= keep })
+		s.pending = s.pending[i:]
+	}
+	t.mutex.Unlock()
+}
+
+func (t *lagTracker) setHead(streamID string, ts primitive.Timestamp) {
+	t.mutex.Lock()
+	t.stream(streamID).head = ts
+	t.mutex.Unlock()
+}
+
+func (t *lagTracker) streamIDs() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ids := make([]string, 0, len(t.streams))
+	for id := range t.streams {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// lags measures how far each stream trails mongo: the time from the oldest op
+// received but not indexed yet to the cluster time, or to the wall clock when
+// the oplog head cannot be read. A stream whose ops are all indexed does not
+// lag, however long ago it received its last op.
+func (t *lagTracker) lags() []*streamLag {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now().Unix()
+	lags := make([]*streamLag, 0, len(t.streams))
+	for id, s := range t.streams {
+		l := &streamLag{
+			StreamID:     id,
+			LastReceived: s.received,
+			LastIndexed:  s.indexed,
+			ClusterTime:  s.head,
+		}
+		if len(s.pending) > 0 {
+			ref := now
+			if s.head.T > 0 {
+				ref = int64(s.head.T)
+			}
+			if l.LagSeconds = ref - int64(s.pending[0]); l.LagSeconds < 0 {
+				l.LagSeconds = 0
+			}
+		}
+		lags = append(lags, l)
+	}
+	sort.Slice(lags, func(i, j int) bool { return lags[i].StreamID < lags[j].StreamID })
+	return lags
+}
+
+// maxLag returns the stream trailing the most, nil when no stream is tracked.
+func (t *lagTracker) maxLag() *streamLag {
+	var max *streamLag
+	for _, l := range t.lags() {
+		if max == nil || l.LagSeconds > max.LagSeconds {
+			max = l
+		}
+	}
+	return max
+}
+
+func tsAfter(a, b primitive.Timestamp) bool {
+	return a.T > b.T || (a.T == b.T && a.I > b.I)
+}
+
+func opStreamID(op *gtm.Op) string {
+	if op.ResumeToken.StreamID != "" {
+		return op.ResumeToken.StreamID
+	}
+	return op.Namespace
+}
+
+// trackPending remembers the latest oplog op buffered for the engine so that
+// its stream can be marked indexed once the engine is flushed. The caller must
+// hold indexMutex.
+func (ic *indexClient) trackPending(engine *indexEngineCtx, op *gtm.Op) {
+	if !op.IsSourceOplog() {
+		return
+	}
+	streamID := opStreamID(op)
+	ic.lag.received(streamID, op.Timestamp)
+	if engine.pending == nil {
+		engine.pending = make(map[string]primitive.Timestamp)
+	}
+	if tsAfter(op.Timestamp, engine.pending[streamID]) {
+		engine.pending[streamID] = op.Timestamp
+	}
+}
+
+// trackIndexed marks the ops pending for the engine as indexed. The caller
+// must hold indexMutex.
+func (ic *indexClient) trackIndexed(engine *indexEngineCtx) {
+	for streamID, ts := range engine.pending {
+		ic.lag.indexed(streamID, ts)
+	}
+	engine.pending = nil
+}
+
+// sampleClusterTimes reads the oplog head of the cluster of every stream so
+// that lag is measured against mongo rather than the local clock.
+func (ic *indexClient) sampleClusterTimes() {
+	heads := make(map[*mongo.Client]primitive.Timestamp)
+	for _, streamID := range ic.lag.streamIDs() {
+		client := ic.getMongoClient(streamID)
+		head, ok := heads[client]
+		if !ok {
+			var err error
+			if head, err = ic.config.oplogHead(client); err != nil {
+				ic.config.log(indexComponent).Debug("Unable to read the oplog head", "stream_id", streamID, "error", err)
+			}
+			heads[client] = head
+		}
+		ic.lag.setHead(streamID, head)
+	}
+}
+
+func (ic *indexClient) lagSampler() {
+	ticker := time.NewTicker(lagSampleInterval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		ic.sampleClusterTimes()
+	}
+}
+
+func (ic *indexClient) startLagSampler() {
+	go ic.lagSampler()
+}
+
+// lagging reports the stream whose lag exceeds max-lag, if any.
+func (ic *indexClient) lagging() *streamLag {
+	if ic.config.MaxLag <= 0 {
+		return nil
+	}
+	if l := ic.lag.maxLag(); l != nil && l.LagSeconds > int64(ic.config.MaxLag) {
+		return l
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLagTrackerLags(t *testing.T) {
+	ts := func(sec, i uint32) primitive.Timestamp { return primitive.Timestamp{T: sec, I: i} }
+	tests := []struct {
+		name     string
+		received []primitive.Timestamp
+		indexed  []primitive.Timestamp
+		head     primitive.Timestamp
+		want     int64
+	}{
+		{"caught up", []primitive.Timestamp{ts(100, 1)}, []primitive.Timestamp{ts(100, 1)}, ts(100, 1), 0},
+		{"idle stream with every op indexed", []primitive.Timestamp{ts(100, 1)}, []primitive.Timestamp{ts(100, 1)}, ts(5000, 1), 0},
+		{"nothing indexed yet", []primitive.Timestamp{ts(100, 1), ts(105, 1)}, nil, ts(110, 1), 10},
+		{"measured from the oldest pending op", []primitive.Timestamp{ts(100, 1), ts(120, 1), ts(125, 1)}, []primitive.Timestamp{ts(100, 1)}, ts(130, 1), 10},
+		{"pending op received long after the last indexed one", []primitive.Timestamp{ts(100, 1), ts(1000, 1)}, []primitive.Timestamp{ts(100, 1)}, ts(1010, 1), 10},
+		{"pending op of the indexed second", []primitive.Timestamp{ts(100, 1), ts(100, 2)}, []primitive.Timestamp{ts(100, 1)}, ts(110, 1), 10},
+		{"ops received out of order", []primitive.Timestamp{ts(120, 1), ts(110, 1)}, nil, ts(130, 1), 20},
+		{"indexed in several flushes", []primitive.Timestamp{ts(100, 1), ts(110, 1), ts(120, 1)}, []primitive.Timestamp{ts(100, 1), ts(110, 1)}, ts(130, 1), 10},
+		{"older indexed op ignored", []primitive.Timestamp{ts(100, 1), ts(120, 1)}, []primitive.Timestamp{ts(120, 1), ts(100, 1)}, ts(130, 1), 0},
+		{"head behind the pending op", []primitive.Timestamp{ts(100, 1)}, nil, ts(90, 1), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lag := newLagTracker()
+			for _, r := range tt.received {
+				lag.received("s", r)
+			}
+			for _, i := range tt.indexed {
+				lag.indexed("s", i)
+			}
+			lag.setHead("s", tt.head)
+			got := lag.lags()
+			if len(got) != 1 {
+				t.Fatalf("lags() = %d streams, want 1", len(got))
+			}
+			if got[0].LagSeconds != tt.want {
+				t.Errorf("lags() = %+v, want %d seconds", got[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestLagTrackerWallClock(t *testing.T) {
+	lag := newLagTracker()
+	now := uint32(time.Now().Unix())
+	lag.received("s", primitive.Timestamp{T: now - 60, I: 1})
+	if got := lag.lags()[0].LagSeconds; got < 60 || got > 62 {
+		t.Errorf("lags() = %d seconds without a cluster time, want about 60", got)
+	}
+	lag.indexed("s", primitive.Timestamp{T: now - 60, I: 1})
+	if got := lag.lags()[0].LagSeconds; got != 0 {
+		t.Errorf("lags() = %d seconds once indexed, want 0", got)
+	}
+}
+
+func TestLagTrackerMaxLag(t *testing.T) {
+	lag := newLagTracker()
+	if l := lag.maxLag(); l != nil {
+		t.Errorf("maxLag() = %+v, want nil", l)
+	}
+	lag.received("a", primitive.Timestamp{T: 100})
+	lag.setHead("a", primitive.Timestamp{T: 105})
+	lag.received("b", primitive.Timestamp{T: 100})
+	lag.setHead("b", primitive.Timestamp{T: 120})
+	lag.received("c", primitive.Timestamp{T: 90})
+	lag.indexed("c", primitive.Timestamp{T: 90})
+	lag.setHead("c", primitive.Timestamp{T: 120})
+	if l := lag.maxLag(); l == nil || l.StreamID != "b" || l.LagSeconds != 20 {
+		t.Errorf("maxLag() = %+v, want stream b at 20 seconds", l)
+	}
+}
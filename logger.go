@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+type logLevel int
+
+const (
+	debugLevel logLevel = iota
+	infoLevel
+	warnLevel
+	errorLevel
+)
+
+// components logging under their own name, each can be given a level
+const (
+	mainComponent   = "main"
+	indexComponent  = "index"
+	gtmComponent    = "gtm"
+	httpComponent   = "http"
+	pluginComponent = "plugin"
+	engineComponent = "engine" // provisioning, schema drift and reindexing
+	resumeComponent = "resume"
+	traceComponent  = "tracing"
+	auditComponent  = "audit"
+)
+
+var (
+	logLevelNames = []string{"debug", "info", "warn", "error"}
+	logComponents = []string{mainComponent, indexComponent, gtmComponent, httpComponent, pluginComponent, engineComponent, resumeComponent, traceComponent, auditComponent}
+)
+
+func (l logLevel) String() string {
+	if int(l) < len(logLevelNames) {
+		return logLevelNames[l]
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return infoLevel, fmt.Errorf("unknown log level %q, expected one of %s", s, strings.Join(logLevelNames, ", "))
+}
+
+type loggingSettings struct {
+	Level      string            `toml:"level"`  // default level of every component
+	Format     string            `toml:"format"` // text or json
+	Components map[string]string `toml:"components"`
+}
+
+// logOutput is shared by the loggers of every component. Error logs go to the
+// error writer, the others to the info writer.
+type logOutput struct {
+	mutex      sync.RWMutex
+	infoOut    io.Writer
+	errorOut   io.Writer
+	infoFile   *lumberjack.Logger // the files of the logs table, nil when logging to stdout
+	errorFile  *lumberjack.Logger
+	json       bool
+	level      logLevel
+	components map[string]logLevel
+}
+
+func newLogOutput() *logOutput {
+	return &logOutput{
+		infoOut:    os.Stdout,
+		errorOut:   os.Stdout,
+		level:      infoLevel,
+		components: make(map[string]logLevel),
+	}
+}
+
+// configure applies the logging settings, verbose lowering the default level
+// to debug when no level is set.
+func (o *logOutput) configure(settings loggingSettings, verbose bool) error {
+	level := infoLevel
+	if settings.Level != "" {
+		var err error
+		if level, err = parseLogLevel(settings.Level); err != nil {
+			return err
+		}
+	} else if verbose {
+		level = debugLevel
+	}
+	components := make(map[string]logLevel)
+	for component, s := range settings.Components {
+		l, err := parseLogLevel(s)
+		if err != nil {
+			return fmt.Errorf("component %s: %s", component, err)
+		}
+		components[component] = l
+	}
+	var json bool
+	switch settings.Format {
+	case "", "text":
+	case "json":
+		json = true
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", settings.Format)
+	}
+	o.mutex.Lock()
+	o.level, o.components, o.json = level, components, json
+	o.mutex.Unlock()
+	return nil
+}
+
+// setFiles sends the logs to the files, nil ones leaving their writer as is.
+func (o *logOutput) setFiles(infoFile, errorFile *lumberjack.Logger) {
+	o.mutex.Lock()
+	if infoFile != nil {
+		o.infoOut, o.infoFile = infoFile, infoFile
+	}
+	if errorFile != nil {
+		o.errorOut, o.errorFile = errorFile, errorFile
+	}
+	o.mutex.Unlock()
+}
+
+// reopen closes the log files so that the next write opens them again, picking
+// up files moved away by an external logrotate. Other writers are left open.
+func (o *logOutput) reopen() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	var err error
+	if o.infoFile != nil {
+		err = o.infoFile.Close()
+	}
+	if o.errorFile != nil && o.errorFile != o.infoFile {
+		if closeErr := o.errorFile.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (o *logOutput) enabled(component string, level logLevel) bool {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	min, ok := o.components[component]
+	if !ok {
+		min = o.level
+	}
+	return level >= min
+}
+
+// logger writes leveled messages with key value fields for one component.
+type logger struct {
+	out       *logOutput
+	component string
+	fields    []interface{}
+}
+
+// With returns a logger adding the key value pairs to every message.
+func (l *logger) With(kv ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &logger{out: l.out, component: l.component, fields: fields}
+}
+
+func (l *logger) Enabled(level logLevel) bool {
+	return l.out.enabled(l.component, level)
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.log(debugLevel, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(infoLevel, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.log(warnLevel, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(errorLevel, msg, kv) }
+
+// Fatal logs at error level and exits.
+func (l *logger) Fatal(msg string, kv ...interface{}) {
+	l.log(errorLevel, msg, kv)
+	os.Exit(1)
+}
+
+func (l *logger) log(level logLevel, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+	l.out.mutex.Lock()
+	defer l.out.mutex.Unlock()
+	var line []byte
+	if l.out.json {
+		line = l.formatJSON(level, msg, fields)
+	} else {
+		line = l.formatText(level, msg, fields)
+	}
+	w := l.out.infoOut
+	if level >= errorLevel {
+		w = l.out.errorOut
+	}
+	w.Write(line)
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func (l *logger) formatJSON(level logLevel, msg string, fields []interface{}) []byte {
+	m := map[string]interface{}{
+		"time":      time.Now().UTC().Format(time.RFC3339Nano),
+		"level":     level.String(),
+		"component": l.component,
+		"msg":       msg,
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		m[fmt.Sprint(fields[i])] = fieldValue(fields[i+1])
+	}
+	line, err := json.Marshal(m)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{
+			"time":      m["time"],
+			"level":     m["level"],
+			"component": l.component,
+			"msg":       msg,
+			"log_error": err.Error(),
+		})
+	}
+	return append(line, '\n')
+}
+
+func (l *logger) formatText(level logLevel, msg string, fields []interface{}) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %-5s [%s] %s", time.Now().Format("2006/01/02 15:04:05.000"), strings.ToUpper(level.String()), l.component, msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		s := fmt.Sprint(fieldValue(fields[i+1]))
+		if strings.ContainsAny(s, " \t\n\"=") {
+			s = fmt.Sprintf("%q", s)
+		}
+		fmt.Fprintf(&b, " %v=%s", fields[i], s)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// logWriter adapts a logger to the io.Writer of a log.Logger.
+type logWriter struct {
+	logger *logger
+	level  logLevel
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.logger.log(w.level, strings.TrimRight(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+// stdLogger returns a log.Logger logging at level, for libraries that take one.
+func (l *logger) stdLogger(level logLevel) *log.Logger {
+	return log.New(&logWriter{logger: l, level: level}, "", 0)
+}
+
+// log returns the logger of a component.
+func (config *configOptions) log(component string) *logger {
+	if config.logs == nil {
+		config.logs = newLogOutput()
+	}
+	return &logger{out: config.logs, component: component}
+}
+
+// reopenLogsOn reopens the log files on every signal received, until hup is
+// closed.
+func (config *configOptions) reopenLogsOn(hup <-chan os.Signal) {
+	for range hup {
+		if err := config.logs.reopen(); err != nil {
+			config.log(mainComponent).Error("Unable to reopen log files", "error", err)
+		} else {
+			config.log(mainComponent).Info("Reopened log files")
+		}
+	}
+}
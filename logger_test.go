@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// newTestLogOutput returns a log output writing info logs to info and errors
+// to errs.
+func newTestLogOutput(t *testing.T, settings loggingSettings) (o *logOutput, info, errs *bytes.Buffer) {
+	t.Helper()
+	o = newLogOutput()
+	if err := o.configure(settings, false); err != nil {
+		t.Fatal(err)
+	}
+	info, errs = &bytes.Buffer{}, &bytes.Buffer{}
+	o.infoOut, o.errorOut = info, errs
+	return
+}
+
+func TestLogOutputConfigure(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings loggingSettings
+		verbose  bool
+		wantErr  bool
+	}{
+		{"defaults", loggingSettings{}, false, false},
+		{"levels", loggingSettings{Level: "WARN", Components: map[string]string{"index": "debug"}}, false, false},
+		{"json", loggingSettings{Format: "json"}, false, false},
+		{"unknown level", loggingSettings{Level: "trace"}, false, true},
+		{"unknown component level", loggingSettings{Components: map[string]string{"index": "loud"}}, false, true},
+		{"unknown format", loggingSettings{Format: "xml"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := newLogOutput().configure(tt.settings, tt.verbose); (err != nil) != tt.wantErr {
+				t.Errorf("configure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLogComponentLevels(t *testing.T) {
+	tests := []struct {
+		name      string
+		settings  loggingSettings
+		verbose   bool
+		component string
+		level     logLevel
+		want      bool
+	}{
+		{"info by default", loggingSettings{}, false, indexComponent, infoLevel, true},
+		{"no debug by default", loggingSettings{}, false, indexComponent, debugLevel, false},
+		{"verbose", loggingSettings{}, true, indexComponent, debugLevel, true},
+		{"level over verbose", loggingSettings{Level: "info"}, true, indexComponent, debugLevel, false},
+		{"default level", loggingSettings{Level: "warn"}, false, mainComponent, infoLevel, false},
+		{"component lowered", loggingSettings{Level: "warn", Components: map[string]string{"gtm": "debug"}}, false, gtmComponent, debugLevel, true},
+		{"component raised", loggingSettings{Components: map[string]string{"gtm": "error"}}, false, gtmComponent, warnLevel, false},
+		{"other components keep the default", loggingSettings{Components: map[string]string{"gtm": "error"}}, false, httpComponent, warnLevel, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newLogOutput()
+			if err := o.configure(tt.settings, tt.verbose); err != nil {
+				t.Fatal(err)
+			}
+			if got := o.enabled(tt.component, tt.level); got != tt.want {
+				t.Errorf("enabled(%s, %s) = %v, want %v", tt.component, tt.level, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	o, info, errs := newTestLogOutput(t, loggingSettings{Format: "json"})
+	l := (&logger{out: o, component: indexComponent}).With("engine", "courses")
+	l.Info("Docs flushed", "docs", 3)
+	l.Error("Unable to index docs", "error", errors.New("boom"))
+	l.Debug("hidden")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(info.Bytes(), &line); err != nil {
+		t.Fatalf("info log %q is not a json line: %v", info.String(), err)
+	}
+	want := map[string]interface{}{"level": "info", "component": "index", "msg": "Docs flushed", "engine": "courses", "docs": 3.0}
+	for k, v := range want {
+		if line[k] != v {
+			t.Errorf("info log %s = %v, want %v", k, line[k], v)
+		}
+	}
+	if _, ok := line["time"]; !ok {
+		t.Error("info log has no time")
+	}
+	if err := json.Unmarshal(errs.Bytes(), &line); err != nil {
+		t.Fatalf("error log %q is not a json line: %v", errs.String(), err)
+	}
+	if line["level"] != "error" || line["error"] != "boom" || line["engine"] != "courses" {
+		t.Errorf("error log = %v, want the error field as a string", line)
+	}
+}
+
+func TestLoggerText(t *testing.T) {
+	o, info, _ := newTestLogOutput(t, loggingSettings{})
+	l := &logger{out: o, component: httpComponent}
+	l.Warn("Consumption of ops paused", "remote_addr", "10.0.0.1:5000", "reason", "a b")
+	got := info.String()
+	for _, want := range []string{"WARN  [http] Consumption of ops paused", " remote_addr=10.0.0.1:5000", ` reason="a b"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("text log %q does not contain %q", got, want)
+		}
+	}
+	l.stdLogger(debugLevel).Print("from a library")
+	if strings.Contains(info.String(), "from a library") {
+		t.Error("std logger wrote below the configured level")
+	}
+}
+
+func TestReopenLogsOn(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "sync.log")
+	config := newConfig()
+	config.logs = newLogOutput()
+	config.logs.setFiles(&lumberjack.Logger{Filename: path}, nil)
+	l := config.log(indexComponent)
+	l.Info("before rotation")
+
+	// logrotate moves the file away then signals the sync
+	rotated := filepath.Join(dir, "sync.log.1")
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	hup := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		config.reopenLogsOn(hup)
+		close(done)
+	}()
+	hup <- syscall.SIGHUP
+	close(hup)
+	<-done
+	l.Info("after rotation")
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{rotated, []string{"before rotation"}},
+		{path, []string{"Reopened log files", "after rotation"}},
+	}
+	for _, tt := range tests {
+		b, err := ioutil.ReadFile(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(lines) != len(tt.want) {
+			t.Fatalf("%s = %q, want %d lines", filepath.Base(tt.path), b, len(tt.want))
+		}
+		for i, want := range tt.want {
+			if !strings.Contains(lines[i], want) {
+				t.Errorf("%s line %d = %q, want %q", filepath.Base(tt.path), i, lines[i], want)
+			}
+		}
+	}
+}
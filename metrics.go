@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rwynn/gtm"
+)
+
+var (
+	sizeBuckets    = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000}
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// metricVec is a counter or gauge partitioned by label values, written in the
+// prometheus text exposition format.
+type metricVec struct {
+	name   string
+	help   string
+	kind   string // counter or gauge
+	labels []string
+	mutex  sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func newMetricVec(kind, name, help string, labels ...string) *metricVec {
+	return &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]float64),
+		keys:   make(map[string][]string),
+	}
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return newMetricVec("counter", name, help, labels...)
+}
+
+func newGaugeVec(name, help string, labels ...string) *metricVec {
+	return newMetricVec("gauge", name, help, labels...)
+}
+
+func (m *metricVec) add(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	m.mutex.Lock()
+	m.values[key] += v
+	m.keys[key] = values
+	m.mutex.Unlock()
+}
+
+func (m *metricVec) set(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	m.mutex.Lock()
+	m.values[key] = v
+	m.keys[key] = values
+	m.mutex.Unlock()
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, key := range sortedMetricKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, m.keys[key]), formatMetricValue(m.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// histogramVec counts observations in buckets partitioned by label values.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*histogram
+	keys    map[string][]string
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+		keys:    make(map[string][]string),
+	}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+		h.keys[key] = values
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) since(start time.Time, values ...string) {
+	h.observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		s, values := h.series[key], h.keys[key]
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += s.counts[i]
+			le := append(append([]string{}, values...), formatMetricValue(b))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, le), cumulative)
+		}
+		le := append(append([]string{}, values...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, le), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), s.count)
+	}
+}
+
+func sortedMetricKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// syncMetrics are the metrics served on /metrics.
+type syncMetrics struct {
+	opsReceived     *metricVec    // engine, namespace, source
+	docsMapped      *metricVec    // engine, namespace
+	docsSkipped     *metricVec    // engine, namespace
+	docsDropped     *metricVec    // engine, namespace, reason
+	docsIndexed     *metricVec    // engine
+	docsDeleted     *metricVec    // engine
+	docsFailed      *metricVec    // engine
+	mapRetries      *metricVec    // engine, namespace
+	docsSpilled     *metricVec    // engine
+	bufferDepth     *metricVec    // engine
+	lag             *metricVec    // stream
+	flushBatchSize  *histogramVec // engine
+	requestDuration *histogramVec // engine, operation
+	pluginDuration  *histogramVec // engine, namespace
+}
+
+func newSyncMetrics() *syncMetrics {
+	return &syncMetrics{
+		opsReceived:     newCounterVec("app_search_sync_ops_received_total", "Ops received from mongo by source (oplog or direct).", "engine", "namespace", "source"),
+		docsMapped:      newCounterVec("app_search_sync_docs_mapped_total", "Docs mapped and buffered for indexing.", "engine", "namespace"),
+		docsSkipped:     newCounterVec("app_search_sync_docs_skipped_total", "Docs skipped by the mapping.", "engine", "namespace"),
+		docsDropped:     newCounterVec("app_search_sync_docs_dropped_total", "Docs dropped before indexing by reason.", "engine", "namespace", "reason"),
+		docsIndexed:     newCounterVec("app_search_sync_docs_indexed_total", "Docs sent to App Search successfully.", "engine"),
+		docsDeleted:     newCounterVec("app_search_sync_docs_deleted_total", "Docs deleted from App Search.", "engine"),
+		docsFailed:      newCounterVec("app_search_sync_docs_failed_total", "Docs App Search failed to index or delete.", "engine"),
+		mapRetries:      newCounterVec("app_search_sync_map_retries_total", "Ops the batch mapping plugin failed to map, counted on every failed attempt.", "engine", "namespace"),
+		docsSpilled:     newCounterVec("app_search_sync_docs_spilled_total", "Docs and deletes spilled to disk while the engine is disabled.", "engine"),
+		bufferDepth:     newGaugeVec("app_search_sync_buffer_depth", "Docs, deletes and ops buffered waiting for a flush.", "engine"),
+		lag:             newGaugeVec("app_search_sync_replication_lag_seconds", "Seconds the oldest op of a change stream not indexed yet trails mongo.", "stream"),
+		flushBatchSize:  newHistogramVec("app_search_sync_flush_batch_size", "Docs per App Search index request.", sizeBuckets, "engine"),
+		requestDuration: newHistogramVec("app_search_sync_request_duration_seconds", "Latency of App Search requests.", latencyBuckets, "engine", "operation"),
+		pluginDuration:  newHistogramVec("app_search_sync_plugin_duration_seconds", "Latency of mapping plugin calls.", latencyBuckets, "engine", "namespace"),
+	}
+}
+
+func (m *syncMetrics) write(w io.Writer) {
+	m.opsReceived.write(w)
+	m.docsMapped.write(w)
+	m.docsSkipped.write(w)
+	m.docsDropped.write(w)
+	m.docsIndexed.write(w)
+	m.docsDeleted.write(w)
+	m.docsFailed.write(w)
+	m.mapRetries.write(w)
+	m.docsSpilled.write(w)
+	m.bufferDepth.write(w)
+	m.lag.write(w)
+	m.flushBatchSize.write(w)
+	m.requestDuration.write(w)
+	m.pluginDuration.write(w)
+}
+
+func opSource(op *gtm.Op) string {
+	if op.IsSourceDirect() {
+		return "direct"
+	}
+	return "oplog"
+}
+
+// writeMetrics samples the buffer depth of each engine and the lag of each
+// stream and writes all metrics.
+func (ic *indexClient) writeMetrics(w io.Writer) {
+	ic.indexMutex.Lock()
+	for _, e := range ic.engines {
+		ic.metrics.bufferDepth.set(float64(e.buffered()), e.name)
+	}
+	ic.indexMutex.Unlock()
+	for _, l := range ic.lag.lags() {
+		ic.metrics.lag.set(float64(l.LagSeconds), l.StreamID)
+	}
+	ic.metrics.write(w)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestMetricVecWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric *metricVec
+		update func(*metricVec)
+		want   string
+	}{
+		{
+			"empty counter",
+			newCounterVec("docs_total", "Docs.", "engine"),
+			func(*metricVec) {},
+			"# HELP docs_total Docs.\n# TYPE docs_total counter\n",
+		},
+		{
+			"counter adds and sorts series",
+			newCounterVec("docs_total", "Docs.", "engine", "reason"),
+			func(m *metricVec) {
+				m.add(2, "b", "x")
+				m.add(1, "a", "y")
+				m.add(1.5, "b", "x")
+			},
+			"# HELP docs_total Docs.\n# TYPE docs_total counter\n" +
+				"docs_total{engine=\"a\",reason=\"y\"} 1\n" +
+				"docs_total{engine=\"b\",reason=\"x\"} 3.5\n",
+		},
+		{
+			"gauge sets",
+			newGaugeVec("depth", "Depth.", "engine"),
+			func(m *metricVec) {
+				m.set(10, "a")
+				m.set(4, "a")
+			},
+			"# HELP depth Depth.\n# TYPE depth gauge\ndepth{engine=\"a\"} 4\n",
+		},
+		{
+			"label values are escaped",
+			newGaugeVec("lag", "Lag.", "stream"),
+			func(m *metricVec) { m.set(1, "a\"b\\c\nd") },
+			"# HELP lag Lag.\n# TYPE lag gauge\nlag{stream=\"a\\\"b\\\\c\\nd\"} 1\n",
+		},
+		{
+			"unlabelled",
+			newGaugeVec("up", "Up."),
+			func(m *metricVec) { m.set(1) },
+			"# HELP up Up.\n# TYPE up gauge\nup 1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.update(tt.metric)
+			var buf bytes.Buffer
+			tt.metric.write(&buf)
+			if got := buf.String(); got != tt.want {
+				t.Errorf("write() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogramVecWrite(t *testing.T) {
+	h := newHistogramVec("size", "Size.", []float64{1, 10}, "engine")
+	h.observe(0.5, "a")
+	h.observe(5, "a")
+	h.observe(10, "a")
+	h.observe(50, "a")
+	want := "# HELP size Size.\n# TYPE size histogram\n" +
+		"size_bucket{engine=\"a\",le=\"1\"} 1\n" +
+		"size_bucket{engine=\"a\",le=\"10\"} 3\n" +
+		"size_bucket{engine=\"a\",le=\"+Inf\"} 4\n" +
+		"size_sum{engine=\"a\"} 65.5\n" +
+		"size_count{engine=\"a\"} 4\n"
+	var buf bytes.Buffer
+	h.write(&buf)
+	if got := buf.String(); got != want {
+		t.Errorf("write() = %q, want %q", got, want)
+	}
+}
+
+func TestFormatMetricValue(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{3, "3"},
+		{0.005, "0.005"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+	}
+	for _, tt := range tests {
+		if got := formatMetricValue(tt.v); got != tt.want {
+			t.Errorf("formatMetricValue(%v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
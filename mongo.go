@@ -10,39 +10,12 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
-func saveTokens(client *mongo.Client, tokens bson.M, config *configOptions) error {
-	var err error
-	if len(tokens) == 0 {
-		return err
-	}
-	col := client.Database(Name).Collection("tokens")
-	bwo := options.BulkWrite().SetOrdered(false)
-	var models []mongo.WriteModel
-	for streamID, token := range tokens {
-		filter := bson.M{
-			"resumeName": config.ResumeName,
-			"streamID":   streamID,
-		}
-		update := bson.M{"$set": bson.M{
-			"resumeName": config.ResumeName,
-			"streamID":   streamID,
-			"token":      token,
-		}}
-		model := mongo.NewUpdateManyModel()
-		model.SetUpsert(true)
-		model.SetFilter(filter)
-		model.SetUpdate(update)
-		models = append(models, model)
-	}
-	_, err = col.BulkWrite(context.Background(), models, bwo)
-	return err
-}
-
 func cleanMongoURL(URL string) string {
 	const (
 		redact    = "REDACTED"
@@ -67,26 +40,27 @@ func cleanMongoURL(URL string) string {
 }
 
 func (config *configOptions) DialMongo() (core, learn, engagement, test *mongo.Client, err error) {
-	coreMongo, err := dialMongo(config.CoreMongoURL, config.Resume, config.ResumeWriteUnsafe)
+	monitor := config.tracer.commandMonitor()
+	coreMongo, err := dialMongo(config.CoreMongoURL, config.Resume, config.ResumeWriteUnsafe, monitor)
 	if err != nil {
 		return
 	}
-	learnMongo, err := dialMongo(config.LearnMongoURL, config.Resume, config.ResumeWriteUnsafe)
+	learnMongo, err := dialMongo(config.LearnMongoURL, config.Resume, config.ResumeWriteUnsafe, monitor)
 	if err != nil {
 		return
 	}
-	engagementMongo, err := dialMongo(config.EngagementMongoURL, config.Resume, config.ResumeWriteUnsafe)
+	engagementMongo, err := dialMongo(config.EngagementMongoURL, config.Resume, config.ResumeWriteUnsafe, monitor)
 	if err != nil {
 		return
 	}
-	testMongo, err := dialMongo(config.TestMongoURL, config.Resume, config.ResumeWriteUnsafe)
+	testMongo, err := dialMongo(config.TestMongoURL, config.Resume, config.ResumeWriteUnsafe, monitor)
 	if err != nil {
 		return
 	}
 	return coreMongo, learnMongo, engagementMongo, testMongo, nil
 }
 
-func dialMongo(url string, resume, resumeWriteUnsafe bool) (*mongo.Client, error) {
+func dialMongo(url string, resume, resumeWriteUnsafe bool, monitor *event.CommandMonitor) (*mongo.Client, error) {
 	rb := bson.NewRegistryBuilder()
 	rb.RegisterTypeMapEntry(bsontype.DateTime, reflect.TypeOf(time.Time{}))
 	reg := rb.Build()
@@ -97,6 +71,9 @@ func dialMongo(url string, resume, resumeWriteUnsafe bool) (*mongo.Client, error
 	if resume && resumeWriteUnsafe {
 		clientOptions.SetWriteConcern(writeconcern.New(writeconcern.W(0), writeconcern.J(false)))
 	}
+	if monitor != nil {
+		clientOptions.SetMonitor(monitor)
+	}
 	client, err := mongo.NewClient(clientOptions)
 	if err != nil {
 		return nil, err
@@ -113,26 +90,11 @@ func dialMongo(url string, resume, resumeWriteUnsafe bool) (*mongo.Client, error
 	return client, nil
 }
 
-func saveTimestamp(client *mongo.Client, ts primitive.Timestamp, config *configOptions) error {
-	col := client.Database(Name).Collection("resume")
-	doc := map[string]interface{}{
-		"ts": ts,
-	}
-	opts := options.Update()
-	opts.SetUpsert(true)
-	_, err := col.UpdateOne(context.Background(), bson.M{
-		"_id": config.ResumeName,
-	}, bson.M{
-		"$set": doc,
-	}, opts)
-	return err
-}
-
-func saveTimestampFromReplStatus(client *mongo.Client, config *configOptions) {
+func saveTimestampFromReplStatus(client *mongo.Client, store resumeStore) {
 	if rs, err := gtm.GetReplStatus(client); err == nil {
 		var ts primitive.Timestamp
 		if ts, err = rs.GetLastCommitted(); err == nil {
-			saveTimestamp(client, ts, config)
+			store.SaveTimestamp(ts)
 		}
 	}
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// normalizeSettings controls how documents are converted to the flat field
+// names and value types accepted by App Search.
+type normalizeSettings struct {
+	Disabled   bool     `toml:"disabled"`
+	Separator  string   `toml:"separator"`   // joins the keys of nested documents
+	DateFormat string   `toml:"date-format"` // time layout for dates, RFC3339 by default
+	DropFields []string `toml:"drop-fields"` // normalized field names never sent to App Search
+}
+
+func defaultNormalizeSettings() normalizeSettings {
+	return normalizeSettings{
+		Separator:  "_",
+		DateFormat: time.RFC3339,
+	}
+}
+
+// merge returns the settings with the non zero values of the engine overrides applied.
+func (s normalizeSettings) merge(o *normalizeSettings) normalizeSettings {
+	if o == nil {
+		return s
+	}
+	if o.Disabled {
+		s.Disabled = true
+	}
+	if o.Separator != "" {
+		s.Separator = o.Separator
+	}
+	if o.DateFormat != "" {
+		s.DateFormat = o.DateFormat
+	}
+	if len(o.DropFields) > 0 {
+		s.DropFields = append(append([]string{}, s.DropFields...), o.DropFields...)
+	}
+	return s
+}
+
+// normalizeDocument flattens nested documents and converts field names and
+// values to ones App Search accepts. Values of unsupported types are dropped.
+// Fields normalized to the same name are resolved by preferredSource.
+func (s normalizeSettings) normalizeDocument(doc map[string]interface{}) map[string]interface{} {
+	if s.Disabled {
+		return doc
+	}
+	out := make(map[string]interface{}, len(doc))
+	s.flatten(out, make(map[string]string), "", "", doc)
+	for _, f := range s.DropFields {
+		delete(out, f)
+	}
+	return out
+}
+
+// flatten adds the fields of doc to out, sources keeping the dotted source
+// path of each field added.
+func (s normalizeSettings) flatten(out map[string]interface{}, sources map[string]string, prefix, srcPrefix string, doc map[string]interface{}) {
+	for key, value := range doc {
+		if prefix == "" && key == "_id" {
+			continue // the App Search id is set separately
+		}
+		name := normalizeFieldName(key)
+		if name == "" {
+			continue
+		}
+		src := key
+		if prefix != "" {
+			name = prefix + s.Separator + name
+			src = srcPrefix + "." + key
+		}
+		if nested, ok := asMap(value); ok {
+			s.flatten(out, sources, name, src, nested)
+			continue
+		}
+		if prev, ok := sources[name]; ok && !preferredSource(name, src, prev) {
+			continue
+		}
+		if v, ok := s.normalizeValue(value); ok {
+			out[name] = v
+			sources[name] = src
+		}
+	}
+}
+
+// preferredSource reports whether the field at source path src is kept over
+// the one at prev when both normalize to name: a field already named name
+// wins, then the lowest source path, so that the outcome does not depend on
+// the order of the document keys.
+func preferredSource(name, src, prev string) bool {
+	if (src == name) != (prev == name) {
+		return src == name
+	}
+	return src < prev
+}
+
+func (s normalizeSettings) normalizeValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case nil, string, float64, float32, int, int32, int64:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case primitive.ObjectID:
+		return v.Hex(), true
+	case primitive.Decimal128:
+		if f, err := strconv.ParseFloat(v.String(), 64); err == nil {
+			return f, true
+		}
+		return nil, false
+	case time.Time:
+		return v.Format(s.DateFormat), true
+	case primitive.DateTime:
+		return v.Time().UTC().Format(s.DateFormat), true
+	case primitive.Timestamp:
+		return time.Unix(int64(v.T), 0).UTC().Format(s.DateFormat), true
+	case primitive.Symbol:
+		return string(v), true
+	case []byte, primitive.Binary, primitive.Regex, primitive.JavaScript, primitive.CodeWithScope,
+		primitive.DBPointer, primitive.MinKey, primitive.MaxKey, primitive.Undefined:
+		return nil, false
+	}
+	if arr, ok := toSlice(value); ok {
+		return s.normalizeArray(arr)
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		arr := make([]interface{}, rv.Len())
+		for i := range arr {
+			arr[i] = rv.Index(i).Interface()
+		}
+		return s.normalizeArray(arr)
+	}
+	return nil, false
+}
+
+// normalizeArray keeps the scalar elements of an array; App Search does not
+// support arrays of objects.
+func (s normalizeSettings) normalizeArray(arr []interface{}) (interface{}, bool) {
+	out := make([]interface{}, 0, len(arr))
+	for _, elem := range arr {
+		if _, ok := asMap(elem); ok {
+			continue
+		}
+		if _, ok := toSlice(elem); ok {
+			continue
+		}
+		if v, ok := s.normalizeValue(elem); ok && v != nil {
+			out = append(out, v)
+		}
+	}
+	if len(out) == 0 && len(arr) > 0 {
+		return nil, false
+	}
+	return out, true
+}
+
+// normalizeFieldName converts a field name to snake_case containing only
+// lowercase ASCII letters, digits and underscores, e.g. "isActive" to
+// "is_active". Other characters, non-ASCII letters included, separate words.
+func normalizeFieldName(name string) string {
+	var b strings.Builder
+	var prev rune
+	for _, r := range name {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			if (prev >= 'a' && prev <= 'z') || (prev >= '0' && prev <= '9') {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r - 'A' + 'a')
+		case (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9'):
+			b.WriteRune(r)
+		default:
+			if prev != '_' && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			r = '_'
+		}
+		prev = r
+	}
+	return strings.Trim(b.String(), "_")
+}
+
+// asMap is like toMap but also accepts maps of any value type keyed by string,
+// as plugins may return them.
+func asMap(value interface{}) (map[string]interface{}, bool) {
+	if m, ok := toMap(value); ok {
+		return m, true
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	m := make(map[string]interface{}, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		m[iter.Key().String()] = iter.Value().Interface()
+	}
+	return m, true
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNormalizeFieldName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"isActive", "is_active"},
+		{"already_snake", "already_snake"},
+		{"HTMLBody", "htmlbody"},
+		{"field2Name", "field2_name"},
+		{"with space-and.dots", "with_space_and_dots"},
+		{"__private", "private"},
+		{"$weird$", "weird"},
+		{"émoji✓", "moji"},
+		{"naïveValue", "na_ve_value"},
+		{"ÅngströmUnit", "ngstr_m_unit"},
+		{"Ωmega", "mega"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeFieldName(tt.name); got != tt.want {
+				t.Errorf("normalizeFieldName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeDocument(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5f1b2c3d4e5f6a7b8c9d0e1f")
+	at := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	defaults := defaultNormalizeSettings()
+	tests := []struct {
+		name     string
+		settings normalizeSettings
+		doc      map[string]interface{}
+		want     map[string]interface{}
+	}{
+		{
+			name:     "scalars",
+			settings: defaults,
+			doc: map[string]interface{}{
+				"_id":      oid,
+				"title":    "T",
+				"count":    int32(3),
+				"isActive": false,
+				"owner":    oid,
+				"empty":    nil,
+			},
+			want: map[string]interface{}{
+				"title":     "T",
+				"count":     int32(3),
+				"is_active": "false",
+				"owner":     "5f1b2c3d4e5f6a7b8c9d0e1f",
+				"empty":     nil,
+			},
+		},
+		{
+			name:     "dates",
+			settings: defaults,
+			doc: map[string]interface{}{
+				"createdAt": at,
+				"updatedOn": primitive.NewDateTimeFromTime(at),
+				"ts":        primitive.Timestamp{T: uint32(at.Unix())},
+			},
+			want: map[string]interface{}{
+				"created_at": "2021-03-04T05:06:07Z",
+				"updated_on": "2021-03-04T05:06:07Z",
+				"ts":         "2021-03-04T05:06:07Z",
+			},
+		},
+		{
+			name:     "nested docs are flattened",
+			settings: defaults,
+			doc: map[string]interface{}{
+				"meta": map[string]interface{}{"langCode": "en", "deep": primitive.D{{Key: "x", Value: 1}}},
+			},
+			want: map[string]interface{}{"meta_lang_code": "en", "meta_deep_x": 1},
+		},
+		{
+			name:     "arrays keep scalars",
+			settings: defaults,
+			doc: map[string]interface{}{
+				"tags":    primitive.A{"a", int64(1), map[string]interface{}{"x": 1}, nil},
+				"ints":    []int{1, 2},
+				"objects": primitive.A{map[string]interface{}{"x": 1}},
+				"none":    primitive.A{},
+			},
+			want: map[string]interface{}{
+				"tags": []interface{}{"a", int64(1)},
+				"ints": []interface{}{1, 2},
+				"none": []interface{}{},
+			},
+		},
+		{
+			name:     "unsupported values are dropped",
+			settings: defaults,
+			doc: map[string]interface{}{
+				"bin":   primitive.Binary{Data: []byte("x")},
+				"regex": primitive.Regex{Pattern: "x"},
+				"raw":   []byte("x"),
+				"kept":  "y",
+			},
+			want: map[string]interface{}{"kept": "y"},
+		},
+		{
+			name:     "custom separator, date format and dropped fields",
+			settings: normalizeSettings{Separator: ".", DateFormat: "2006-01-02", DropFields: []string{"secret"}},
+			doc: map[string]interface{}{
+				"meta":   map[string]interface{}{"at": at},
+				"secret": "s",
+			},
+			want: map[string]interface{}{"meta.at": "2021-03-04"},
+		},
+		{
+			name:     "colliding names keep the field already named so",
+			settings: defaults,
+			doc:      map[string]interface{}{"isActive": true, "is_active": false, "IsActive": true, "is-active": true},
+			want:     map[string]interface{}{"is_active": "false"},
+		},
+		{
+			name:     "colliding names keep the lowest source path",
+			settings: defaults,
+			doc: map[string]interface{}{
+				"metaLang": "a",
+				"meta":     map[string]interface{}{"lang": "b", "Lang": "c"},
+				"Meta":     map[string]interface{}{"lang": "d"},
+			},
+			want: map[string]interface{}{"meta_lang": "d"},
+		},
+		{
+			name:     "disabled",
+			settings: normalizeSettings{Disabled: true},
+			doc:      map[string]interface{}{"isActive": true},
+			want:     map[string]interface{}{"isActive": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.settings.normalizeDocument(tt.doc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalizeDocument() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeSettingsMerge(t *testing.T) {
+	base := normalizeSettings{Separator: "_", DateFormat: time.RFC3339, DropFields: []string{"a"}}
+	tests := []struct {
+		name      string
+		overrides *normalizeSettings
+		want      normalizeSettings
+	}{
+		{"no overrides", nil, base},
+		{"empty overrides", &normalizeSettings{}, base},
+		{
+			"overrides",
+			&normalizeSettings{Disabled: true, Separator: ".", DateFormat: "2006", DropFields: []string{"b"}},
+			normalizeSettings{Disabled: true, Separator: ".", DateFormat: "2006", DropFields: []string{"a", "b"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := base.merge(tt.overrides); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merge() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if len(base.DropFields) != 1 {
+		t.Errorf("merge() changed the base drop fields: %v", base.DropFields)
+	}
+}
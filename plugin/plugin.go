@@ -1,11 +1,37 @@
 package plugin
 
 import (
+	"context"
+
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type MapperPlugin func(*MapperPluginInput) (*MapperPluginOutput, error)
 
+// BatchMapperPlugin maps every op buffered for an engine in a single call when
+// the batch is flushed. The outputs must be returned in the same order as the inputs.
+// An error fails the whole batch, which is passed again on the next flush. A nil
+// output skips an insert or update, and deletes a deleted doc under its mongo _id.
+type BatchMapperPlugin func([]*MapperPluginInput) ([]*MapperPluginOutput, error)
+
+// FilterPlugin returns false for ops that should not be indexed. A rejected update
+// deletes the doc from the engine since it may have been indexed before.
+type FilterPlugin func(*MapperPluginInput) (bool, error)
+
+// InitPlugin is called once after the MongoDB clients are connected, before any
+// op is mapped. The config holds the pluginConfig table of each engine keyed by engine name.
+type InitPlugin func(map[string]interface{}, *MongoClients) error
+
+// ShutdownPlugin is called once after the last batch has been flushed.
+type ShutdownPlugin func()
+
+type MongoClients struct {
+	CoreMongo       *mongo.Client // Core MongoDB driver client
+	LearnMongo      *mongo.Client // Learn MongoDB driver client
+	EngagementMongo *mongo.Client // Engagement MongoDB driver client
+	TestMongo       *mongo.Client // Test MongoDB driver client
+}
+
 type MapperPluginInput struct {
 	Id                interface{}            // original document id
 	Data              map[string]interface{} // parsed map from data
@@ -13,12 +39,14 @@ type MapperPluginInput struct {
 	Database          string                 // the origin database in MongoDB
 	Collection        string                 // the origin collection in MongoDB
 	Namespace         string                 // the entire namespace for the original document
-	Operation         string                 // "i" for a insert or "u" for update
+	Operation         string                 // "i" for a insert, "u" for update or "d" for delete, which has no Document
 	CoreMongo         *mongo.Client          // Core MongoDB driver client
 	LearnMongo        *mongo.Client          // Learn MongoDB driver client
 	EngagementMongo   *mongo.Client          // Engagement MongoDB driver client
 	TestMongo         *mongo.Client          // Test MongoDB driver client
 	UpdateDescription map[string]interface{} // map describing changes to the document
+	Config            map[string]interface{} // the pluginConfig table of the engine
+	Context           context.Context        // pass to mongo calls to trace them with the op
 }
 
 type MapperPluginOutput struct {
@@ -27,12 +55,12 @@ type MapperPluginOutput struct {
 	Type            string      // the document type
 	Routing         string      // the routing value to use
 	Drop            bool        // set to true to indicate that the document should not be indexed but removed
-	Passthrough     bool        // set to true to indicate the original document should be indexed unchanged
+	Passthrough     bool        // set to true to index the original document instead of Document
 	Parent          string      // the parent id to use
 	Version         int64       // the version of the document
 	VersionType     string      // the version type of the document (internal, external, external_gte)
 	Pipeline        string      // the pipeline to index with
 	RetryOnConflict int         // how many times to retry updates before failing
 	Skip            bool        // set to true to indicate the the document should be ignored
-	ID              string      // override the _id of the indexed document; not recommended
+	ID              string      // override the _id of the indexed or deleted document; not recommended
 }
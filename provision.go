@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+var schemaFieldTypes = map[string]bool{
+	"text":        true,
+	"number":      true,
+	"date":        true,
+	"geolocation": true,
+}
+
+// provisionEngines creates the configured engines missing in App Search and
+// adds the schema fields they lack. Fields whose type differs from the config
+// are reported, and fail the startup with fail-on-schema-conflict.
+func (ic *indexClient) provisionEngines() error {
+	conflicts := 0
+	for _, m := range ic.config.EngineConfig {
+		for field, fieldType := range m.Schema {
+			if !schemaFieldTypes[fieldType] {
+				return fmt.Errorf("engine %s: field %s has unsupported type %s", m.Name, field, fieldType)
+			}
+		}
+		name := m.indexName()
+		engine, err := ic.client.getEngine(name)
+		if err != nil {
+			return fmt.Errorf("engine %s: %s", name, err)
+		}
+		if engine == nil {
+			engine = &appSearchEngine{Name: name}
+			if m.Language != "" {
+				engine.Language = &m.Language
+			}
+			if err = ic.client.createEngine(engine); err != nil {
+				return fmt.Errorf("engine %s: unable to create engine: %s", name, err)
+			}
+			ic.config.log(engineComponent).Info("Created engine", "engine", name)
+		} else if m.Language != "" && (engine.Language == nil || *engine.Language != m.Language) {
+			ic.config.log(engineComponent).Warn("Engine exists with a different language than configured", "engine", name, "language", m.Language)
+		}
+		if len(m.Schema) == 0 {
+			continue
+		}
+		schema, err := ic.client.getSchema(name)
+		if err != nil {
+			return fmt.Errorf("engine %s: unable to get schema: %s", name, err)
+		}
+		missing := make(map[string]string)
+		for _, field := range sortedKeys(m.Schema) {
+			want := m.Schema[field]
+			have, ok := schema[field]
+			if !ok {
+				missing[field] = want
+			} else if have != want {
+				conflicts++
+				ic.config.log(engineComponent).Error("Schema field typed differently in App Search than in config", "engine", name, "field", field, "app_search_type", have, "config_type", want)
+			}
+		}
+		if len(missing) > 0 {
+			if err = ic.client.updateSchema(name, missing); err != nil {
+				return fmt.Errorf("engine %s: unable to update schema: %s", name, err)
+			}
+			ic.config.log(engineComponent).Info("Added schema fields", "engine", name, "fields", len(missing))
+		}
+	}
+	if conflicts > 0 && ic.config.FailOnSchemaConflict {
+		return fmt.Errorf("%d schema type conflicts found", conflicts)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestProvisionEngines(t *testing.T) {
+	english := "en"
+	tests := []struct {
+		name       string
+		existing   *appSearchEngine
+		schema     map[string]string // live schema of the existing engine
+		config     map[string]string
+		failOn     bool
+		wantErr    bool
+		wantSchema map[string]string
+	}{
+		{
+			name:       "creates a missing engine",
+			config:     map[string]string{"title": "text", "price": "number"},
+			wantSchema: map[string]string{"title": "text", "price": "number"},
+		},
+		{
+			name:       "adds missing fields",
+			existing:   &appSearchEngine{Name: "courses", Language: &english},
+			schema:     map[string]string{"title": "text", "tags": "text"},
+			config:     map[string]string{"title": "text", "starts": "date"},
+			wantSchema: map[string]string{"title": "text", "tags": "text", "starts": "date"},
+		},
+		{
+			name:       "reports a conflict",
+			existing:   &appSearchEngine{Name: "courses"},
+			schema:     map[string]string{"price": "text"},
+			config:     map[string]string{"price": "number"},
+			wantSchema: map[string]string{"price": "text"},
+		},
+		{
+			name:       "fails on a conflict",
+			existing:   &appSearchEngine{Name: "courses"},
+			schema:     map[string]string{"price": "text"},
+			config:     map[string]string{"price": "number", "title": "text"},
+			failOn:     true,
+			wantErr:    true,
+			wantSchema: map[string]string{"price": "text", "title": "text"},
+		},
+		{
+			name:    "unsupported type",
+			config:  map[string]string{"active": "boolean"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeEngines()
+			server := httptest.NewServer(srv)
+			defer server.Close()
+			if tt.existing != nil {
+				srv.add(*tt.existing).schema = tt.schema
+			}
+			ic, _ := newTestIndexClient(t, server.URL)
+			ic.config.EngineConfig[0].Language = "en"
+			ic.config.EngineConfig[0].Schema = tt.config
+			ic.config.FailOnSchemaConflict = tt.failOn
+			if err := ic.provisionEngines(); (err != nil) != tt.wantErr {
+				t.Fatalf("provisionEngines() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			e := srv.engine("courses")
+			if tt.wantSchema == nil {
+				if e != nil {
+					t.Error("engine created for an invalid config")
+				}
+				return
+			}
+			if e == nil {
+				t.Fatal("engine not created")
+			}
+			if tt.existing == nil && (e.engine.Language == nil || *e.engine.Language != "en") {
+				t.Errorf("created engine language = %v, want en", e.engine.Language)
+			}
+			if !reflect.DeepEqual(e.schema, tt.wantSchema) {
+				t.Errorf("schema = %v, want %v", e.schema, tt.wantSchema)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var reindexRetryInterval = 30 * time.Second // shortened by tests
+
+// Engines configured with metaEngine are served to clients through a meta
+// engine named after the engine, backed by a single versioned source engine
+// (e.g. targets-v2) that the sync indexes into. A reindex creates the next
+// version, direct reads into it while changes go to both versions, and then
+// swaps the meta engine over to the new version.
+
+func sourceEngineName(metaEngine string, version int) string {
+	return fmt.Sprintf("%s-v%d", metaEngine, version)
+}
+
+func sourceEngineVersion(metaEngine, source string) (int, bool) {
+	prefix := metaEngine + "-v"
+	if !strings.HasPrefix(source, prefix) {
+		return 0, false
+	}
+	v, err := strconv.Atoi(strings.TrimPrefix(source, prefix))
+	return v, err == nil
+}
+
+// indexName is the engine docs are indexed into.
+func (m *engineConfig) indexName() string {
+	if m.sourceEngine != "" {
+		return m.sourceEngine
+	}
+	return m.Name
+}
+
+// resolveMetaEngines looks up the current source engine of each meta engine,
+// creating the meta engine with a first version when it does not exist yet.
+func (ic *indexClient) resolveMetaEngines() error {
+	for _, m := range ic.config.EngineConfig {
+		if !m.MetaEngine {
+			continue
+		}
+		meta, err := ic.client.getEngine(m.Name)
+		if err != nil {
+			return fmt.Errorf("engine %s: %s", m.Name, err)
+		}
+		if meta == nil {
+			source := &appSearchEngine{Name: sourceEngineName(m.Name, 1)}
+			if m.Language != "" {
+				source.Language = &m.Language
+			}
+			if err = ic.client.createEngine(source); err != nil {
+				return fmt.Errorf("engine %s: unable to create engine: %s", source.Name, err)
+			}
+			meta = &appSearchEngine{Name: m.Name, Type: "meta", SourceEngines: []string{source.Name}}
+			if err = ic.client.createEngine(meta); err != nil {
+				return fmt.Errorf("engine %s: unable to create meta engine: %s", m.Name, err)
+			}
+			ic.config.log(engineComponent).Info("Created meta engine", "engine", m.Name, "source_engine", source.Name)
+		}
+		if meta.Type != "meta" {
+			return fmt.Errorf("engine %s is not a meta engine", m.Name)
+		}
+		latest := 0
+		for _, source := range meta.SourceEngines {
+			if v, ok := sourceEngineVersion(m.Name, source); ok && v > latest {
+				latest = v
+				m.sourceEngine = source
+			}
+		}
+		if m.sourceEngine == "" {
+			return fmt.Errorf("meta engine %s has no source engine named %s-v<N>", m.Name, m.Name)
+		}
+	}
+	return nil
+}
+
+// startReindex creates the next source engine version of every meta engine.
+func (ic *indexClient) startReindex() error {
+	for _, m := range ic.config.EngineConfig {
+		if !m.MetaEngine {
+			continue
+		}
+		e := ic.engines[m.Namespace]
+		version, _ := sourceEngineVersion(m.Name, m.sourceEngine)
+		for {
+			version++
+			existing, err := ic.client.getEngine(sourceEngineName(m.Name, version))
+			if err != nil {
+				return err
+			}
+			if existing == nil {
+				break
+			}
+		}
+		target := &appSearchEngine{Name: sourceEngineName(m.Name, version)}
+		if m.Language != "" {
+			target.Language = &m.Language
+		}
+		if err := ic.client.createEngine(target); err != nil {
+			return fmt.Errorf("engine %s: unable to create engine: %s", target.Name, err)
+		}
+		if len(m.Schema) > 0 {
+			if err := ic.client.updateSchema(target.Name, m.Schema); err != nil {
+				return fmt.Errorf("engine %s: unable to update schema: %s", target.Name, err)
+			}
+		}
+		e.reindexName = target.Name
+		ic.config.log(engineComponent).Info("Reindexing meta engine", "engine", m.Name, "from", e.name, "into", e.reindexName)
+	}
+	return nil
+}
+
+// finishReindex points the meta engines at the new source engines once the
+// ops of the direct reads are buffered, and deletes the previous versions if
+// configured. A failed swap is retried, the engines it has not swapped yet
+// keep receiving changes in both versions and /readyz reports the failure.
+func (ic *indexClient) finishReindex() {
+	for {
+		err := ic.swapMetaEngines()
+		ic.live.reindexError(err)
+		if err == nil {
+			return
+		}
+		ic.config.log(engineComponent).Error("Unable to finish reindex, retrying", "error", err, "retry_in", reindexRetryInterval)
+		time.Sleep(reindexRetryInterval)
+	}
+}
+
+// swapMetaEngines flushes the buffered docs and swaps the source engine of the
+// meta engines still being reindexed.
+func (ic *indexClient) swapMetaEngines() error {
+	ic.indexMutex.Lock()
+	defer ic.indexMutex.Unlock()
+	if err := ic.flush(); err != nil {
+		return err
+	}
+	for _, m := range ic.config.EngineConfig {
+		e := ic.engines[m.Namespace]
+		if e == nil || e.reindexName == "" {
+			continue
+		}
+		if err := ic.swapMetaEngine(m.Name, e.name, e.reindexName); err != nil {
+			return err
+		}
+		ic.config.log(engineComponent).Info("Meta engine swapped", "engine", m.Name, "from", e.name, "to", e.reindexName)
+		old := e.name
+		e.name, e.reindexName = e.reindexName, ""
+		m.sourceEngine = e.name
+		if ic.config.ReindexDeleteOld {
+			if err := ic.client.deleteEngine(old); err != nil {
+				ic.config.log(engineComponent).Error("Unable to delete engine", "engine", old, "error", err)
+			} else {
+				ic.config.log(engineComponent).Info("Deleted engine", "engine", old)
+			}
+		}
+	}
+	return nil
+}
+
+// swapMetaEngine replaces the source engine from by to in a meta engine. The
+// sources already swapped by a previous attempt are left alone.
+func (ic *indexClient) swapMetaEngine(metaEngine, from, to string) error {
+	meta, err := ic.client.getEngine(metaEngine)
+	if err != nil {
+		return fmt.Errorf("meta engine %s: %s", metaEngine, err)
+	}
+	if meta == nil {
+		return fmt.Errorf("meta engine %s not found", metaEngine)
+	}
+	if !containsString(meta.SourceEngines, to) {
+		if err = ic.client.addSourceEngines(metaEngine, []string{to}); err != nil {
+			return fmt.Errorf("meta engine %s: unable to add source engine %s: %s", metaEngine, to, err)
+		}
+	}
+	if containsString(meta.SourceEngines, from) {
+		if err = ic.client.removeSourceEngines(metaEngine, []string{from}); err != nil {
+			return fmt.Errorf("meta engine %s: unable to remove source engine %s: %s", metaEngine, from, err)
+		}
+	}
+	return nil
+}
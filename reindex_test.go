@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newReindexTestClient returns an index client whose engine courses is a meta
+// engine served by courses-v1.
+func newReindexTestClient(t *testing.T, srv *fakeEngines) (*indexClient, *indexEngineCtx) {
+	t.Helper()
+	server := httptest.NewServer(srv)
+	t.Cleanup(server.Close)
+	srv.add(appSearchEngine{Name: "courses-v1"})
+	srv.add(appSearchEngine{Name: "courses", Type: "meta", SourceEngines: []string{"courses-v1"}})
+	ic, e := newTestIndexClient(t, server.URL)
+	m := ic.config.EngineConfig[0]
+	m.MetaEngine = true
+	m.sourceEngine = "courses-v1"
+	e.name = "courses-v1"
+	return ic, e
+}
+
+func TestSourceEngineVersion(t *testing.T) {
+	tests := []struct {
+		metaEngine string
+		source     string
+		want       int
+		wantOK     bool
+	}{
+		{"courses", "courses-v1", 1, true},
+		{"courses", "courses-v12", 12, true},
+		{"courses", "courses-vx", 0, false},
+		{"courses", "courses", 0, false},
+		{"courses", "tests-v1", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := sourceEngineVersion(tt.metaEngine, tt.source)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("sourceEngineVersion(%q, %q) = %d, %v, want %d, %v", tt.metaEngine, tt.source, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestResolveMetaEngines(t *testing.T) {
+	tests := []struct {
+		name       string
+		existing   []appSearchEngine
+		wantErr    bool
+		wantSource string
+	}{
+		{
+			name:       "creates the meta engine",
+			wantSource: "courses-v1",
+		},
+		{
+			name: "latest source engine",
+			existing: []appSearchEngine{
+				{Name: "courses", Type: "meta", SourceEngines: []string{"other", "courses-v2", "courses-v10"}},
+			},
+			wantSource: "courses-v10",
+		},
+		{
+			name:     "not a meta engine",
+			existing: []appSearchEngine{{Name: "courses"}},
+			wantErr:  true,
+		},
+		{
+			name:     "no versioned source engine",
+			existing: []appSearchEngine{{Name: "courses", Type: "meta", SourceEngines: []string{"other"}}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeEngines()
+			server := httptest.NewServer(srv)
+			defer server.Close()
+			for _, engine := range tt.existing {
+				srv.add(engine)
+			}
+			ic, _ := newTestIndexClient(t, server.URL)
+			m := ic.config.EngineConfig[0]
+			m.MetaEngine = true
+			if err := ic.resolveMetaEngines(); (err != nil) != tt.wantErr {
+				t.Fatalf("resolveMetaEngines() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if m.sourceEngine != tt.wantSource {
+				t.Errorf("source engine = %q, want %q", m.sourceEngine, tt.wantSource)
+			}
+			if tt.existing == nil {
+				meta := srv.engine("courses")
+				if meta == nil || meta.engine.Type != "meta" || srv.engine("courses-v1") == nil {
+					t.Error("meta engine and its first source engine not created")
+				}
+			}
+		})
+	}
+}
+
+func TestStartReindex(t *testing.T) {
+	srv := newFakeEngines()
+	ic, e := newReindexTestClient(t, srv)
+	srv.add(appSearchEngine{Name: "courses-v2"}) // left over by an aborted reindex
+	ic.config.EngineConfig[0].Schema = map[string]string{"price": "number"}
+	if err := ic.startReindex(); err != nil {
+		t.Fatalf("startReindex() error = %v", err)
+	}
+	if e.reindexName != "courses-v3" {
+		t.Errorf("reindex name = %q, want courses-v3", e.reindexName)
+	}
+	target := srv.engine("courses-v3")
+	if target == nil {
+		t.Fatal("courses-v3 not created")
+	}
+	if !reflect.DeepEqual(target.schema, map[string]string{"price": "number"}) {
+		t.Errorf("courses-v3 schema = %v, want the configured schema", target.schema)
+	}
+}
+
+func TestSwapMetaEngines(t *testing.T) {
+	srv := newFakeEngines()
+	ic, e := newReindexTestClient(t, srv)
+	ic.config.ReindexDeleteOld = true
+	srv.add(appSearchEngine{Name: "courses-v2"})
+	e.reindexName = "courses-v2"
+	e.reindexDocs = []interface{}{map[string]interface{}{"id": "read"}}
+	e.docs = []interface{}{map[string]interface{}{"id": "changed"}}
+
+	if err := ic.swapMetaEngines(); err != nil {
+		t.Fatalf("swapMetaEngines() error = %v", err)
+	}
+	want := []string{
+		"POST /api/as/v1/engines/courses-v2/documents",
+		"POST /api/as/v1/engines/courses-v1/documents",
+		"GET /api/as/v1/engines/courses",
+		"POST /api/as/v1/engines/courses/source_engines",
+		"DELETE /api/as/v1/engines/courses/source_engines",
+		"DELETE /api/as/v1/engines/courses-v1",
+	}
+	if !reflect.DeepEqual(srv.requests, want) {
+		t.Errorf("requests = %v, want the buffers drained before the swap: %v", srv.requests, want)
+	}
+	if got := srv.engine("courses-v2").docs; len(got) != 2 {
+		t.Errorf("courses-v2 docs = %v, want the direct read and the change", got)
+	}
+	if got := srv.engine("courses").engine.SourceEngines; !reflect.DeepEqual(got, []string{"courses-v2"}) {
+		t.Errorf("meta engine sources = %v, want [courses-v2]", got)
+	}
+	if e.name != "courses-v2" || e.reindexName != "" || ic.config.EngineConfig[0].sourceEngine != "courses-v2" {
+		t.Errorf("engine %q reindexing %q, want courses-v2 and none", e.name, e.reindexName)
+	}
+	if srv.engine("courses-v1") != nil {
+		t.Error("courses-v1 not deleted")
+	}
+}
+
+func TestFinishReindexRetry(t *testing.T) {
+	interval := reindexRetryInterval
+	reindexRetryInterval = 10 * time.Millisecond
+	defer func() { reindexRetryInterval = interval }()
+
+	srv := newFakeEngines()
+	ic, e := newReindexTestClient(t, srv)
+	srv.add(appSearchEngine{Name: "courses-v2"})
+	e.reindexName = "courses-v2"
+	// the new source is added but the old one cannot be removed
+	remove := "DELETE /api/as/v1/engines/courses/source_engines"
+	srv.setFail(remove, http.StatusInternalServerError)
+
+	done := make(chan struct{})
+	go func() {
+		ic.finishReindex()
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ic.live.mutex.Lock()
+		failed := ic.live.reindexErr != nil
+		ic.live.mutex.Unlock()
+		if failed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failed swap not reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ic.indexMutex.Lock()
+	if e.name != "courses-v1" || e.reindexName != "courses-v2" {
+		t.Errorf("engine %q reindexing %q after a failed swap, want courses-v1 and courses-v2", e.name, e.reindexName)
+	}
+	ic.indexMutex.Unlock()
+
+	srv.setFail(remove, 0)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("finishReindex() did not retry the swap")
+	}
+	ic.live.mutex.Lock()
+	if ic.live.reindexErr != nil {
+		t.Errorf("reindex error = %v after the retry, want nil", ic.live.reindexErr)
+	}
+	ic.live.mutex.Unlock()
+	if got := srv.engine("courses").engine.SourceEngines; !reflect.DeepEqual(got, []string{"courses-v2"}) {
+		t.Errorf("meta engine sources = %v, want [courses-v2]", got)
+	}
+	if e.name != "courses-v2" || e.reindexName != "" {
+		t.Errorf("engine %q reindexing %q, want courses-v2 and none", e.name, e.reindexName)
+	}
+}
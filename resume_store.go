@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/testbook/app-search-sync/plugin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	mongoResumeStoreType = "mongo"
+	fileResumeStoreType  = "file"
+	kvResumeStoreType    = "kv"
+)
+
+type resumeStoreSettings struct {
+	Type     string `toml:"type"`     // mongo, file or kv
+	Cluster  string `toml:"cluster"`  // mongo cluster holding the resume state, core by default
+	Database string `toml:"database"` // mongo database holding the resume state
+	Path     string `toml:"path"`     // the file of the file store or the directory of the kv store
+}
+
+// resumeStore persists the resume state saved under a resume name: the last
+// timestamp synced, the resume token of each change stream and the heartbeat
+// of the process syncing.
+type resumeStore interface {
+	LoadTimestamp() (primitive.Timestamp, error) // zero when nothing is saved
+	SaveTimestamp(ts primitive.Timestamp) error
+	LoadToken(streamID string) (interface{}, error) // nil when nothing is saved
+	LoadTokens() (map[string]interface{}, error)
+	SaveTokens(tokens bson.M) error
+	Delete() error
+	LoadHeartbeat() (*heartbeat, error) // nil when nothing is saved
+	SaveHeartbeat(hb *heartbeat) error
+	DeleteHeartbeat() error
+}
+
+// newResumeStore returns the resume store selected by the resume-store settings.
+func (config *configOptions) newResumeStore(clients *plugin.MongoClients) (resumeStore, error) {
+	settings := config.ResumeStore
+	switch settings.Type {
+	case "", mongoResumeStoreType:
+		client, err := clusterClient(clients, settings.Cluster)
+		if err != nil {
+			return nil, fmt.Errorf("resume store: %s", err)
+		}
+		return &mongoResumeStore{
+			db:   client.Database(settings.Database),
+			name: config.ResumeName,
+		}, nil
+	case fileResumeStoreType:
+		return &fileResumeStore{path: settings.Path, name: config.ResumeName}, nil
+	case kvResumeStoreType:
+		return &kvResumeStore{dir: filepath.Join(settings.Path, url.PathEscape(config.ResumeName))}, nil
+	default:
+		return nil, fmt.Errorf("unknown resume store type %s", settings.Type)
+	}
+}
+
+// clusterClient returns the client of a cluster named in the config, core when
+// unset.
+func clusterClient(clients *plugin.MongoClients, cluster string) (*mongo.Client, error) {
+	switch cluster {
+	case "", "core":
+		return clients.CoreMongo, nil
+	case "learn":
+		return clients.LearnMongo, nil
+	case "engagement":
+		return clients.EngagementMongo, nil
+	case "test":
+		return clients.TestMongo, nil
+	}
+	return nil, fmt.Errorf("unknown cluster %s", cluster)
+}
+
+// tokenDocument converts a raw resume token into a document that survives
+// being encoded as json.
+func tokenDocument(token interface{}) interface{} {
+	if raw, ok := token.(bson.Raw); ok {
+		doc := bson.M{}
+		if err := bson.Unmarshal(raw, &doc); err == nil {
+			return doc
+		}
+	}
+	return token
+}
+
+type mongoResumeStore struct {
+	db   *mongo.Database
+	name string
+}
+
+func (s *mongoResumeStore) LoadTimestamp() (ts primitive.Timestamp, err error) {
+	result := s.db.Collection("resume").FindOne(context.Background(), bson.M{
+		"_id": s.name,
+	})
+	if err = result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = nil
+		}
+		return
+	}
+	doc := make(map[string]interface{})
+	if err = result.Decode(&doc); err != nil {
+		return
+	}
+	if t, ok := doc["ts"].(primitive.Timestamp); ok {
+		ts = t
+	}
+	return
+}
+
+func (s *mongoResumeStore) SaveTimestamp(ts primitive.Timestamp) error {
+	opts := options.Update()
+	opts.SetUpsert(true)
+	_, err := s.db.Collection("resume").UpdateOne(context.Background(), bson.M{
+		"_id": s.name,
+	}, bson.M{
+		"$set": bson.M{"ts": ts},
+	}, opts)
+	return err
+}
+
+func (s *mongoResumeStore) LoadToken(streamID string) (interface{}, error) {
+	result := s.db.Collection("tokens").FindOne(context.Background(), bson.M{
+		"resumeName": s.name,
+		"streamID":   streamID,
+	})
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = nil
+		}
+		return nil, err
+	}
+	doc := make(map[string]interface{})
+	if err := result.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc["token"], nil
+}
+
+func (s *mongoResumeStore) LoadTokens() (map[string]interface{}, error) {
+	cursor, err := s.db.Collection("tokens").Find(context.Background(), bson.M{
+		"resumeName": s.name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+	tokens := make(map[string]interface{})
+	for cursor.Next(context.Background()) {
+		doc := make(map[string]interface{})
+		if err = cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		streamID, _ := doc["streamID"].(string)
+		tokens[streamID] = doc["token"]
+	}
+	return tokens, cursor.Err()
+}
+
+func (s *mongoResumeStore) SaveTokens(tokens bson.M) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	bwo := options.BulkWrite().SetOrdered(false)
+	var models []mongo.WriteModel
+	for streamID, token := range tokens {
+		filter := bson.M{
+			"resumeName": s.name,
+			"streamID":   streamID,
+		}
+		update := bson.M{"$set": bson.M{
+			"resumeName": s.name,
+			"streamID":   streamID,
+			"token":      token,
+		}}
+		model := mongo.NewUpdateManyModel()
+		model.SetUpsert(true)
+		model.SetFilter(filter)
+		model.SetUpdate(update)
+		models = append(models, model)
+	}
+	_, err := s.db.Collection("tokens").BulkWrite(context.Background(), models, bwo)
+	return err
+}
+
+func (s *mongoResumeStore) Delete() error {
+	if _, err := s.db.Collection("resume").DeleteOne(context.Background(), bson.M{"_id": s.name}); err != nil {
+		return err
+	}
+	_, err := s.db.Collection("tokens").DeleteMany(context.Background(), bson.M{"resumeName": s.name})
+	return err
+}
+
+func (s *mongoResumeStore) LoadHeartbeat() (*heartbeat, error) {
+	hb := &heartbeat{}
+	err := s.db.Collection("instances").FindOne(context.Background(), bson.M{
+		"_id": s.name,
+	}).Decode(hb)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return hb, err
+}
+
+func (s *mongoResumeStore) SaveHeartbeat(hb *heartbeat) error {
+	opts := options.Update().SetUpsert(true)
+	_, err := s.db.Collection("instances").UpdateOne(context.Background(), bson.M{
+		"_id": s.name,
+	}, bson.M{
+		"$set": bson.M{
+			"host":      hb.Host,
+			"pid":       hb.Pid,
+			"heartbeat": hb.Heartbeat,
+		},
+	}, opts)
+	return err
+}
+
+func (s *mongoResumeStore) DeleteHeartbeat() error {
+	_, err := s.db.Collection("instances").DeleteOne(context.Background(), bson.M{
+		"_id": s.name,
+	})
+	return err
+}
+
+// fileResumeState is the resume state of one resume name in a file store.
+type fileResumeState struct {
+	Timestamp *primitive.Timestamp   `json:"ts,omitempty"`
+	Tokens    map[string]interface{} `json:"tokens,omitempty"`
+	Heartbeat *heartbeat             `json:"heartbeat,omitempty"`
+}
+
+// fileResumeStore keeps the resume state of every resume name in a single json
+// file. It is meant for development where no mongo database should be written.
+type fileResumeStore struct {
+	path  string
+	name  string
+	mutex sync.Mutex
+}
+
+func (s *fileResumeStore) read() (map[string]*fileResumeState, error) {
+	states := make(map[string]*fileResumeState)
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return states, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", s.path, err)
+	}
+	return states, nil
+}
+
+// view calls f with the state saved under the resume name, never nil.
+func (s *fileResumeStore) view(f func(*fileResumeState)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	states, err := s.read()
+	if err != nil {
+		return err
+	}
+	state := states[s.name]
+	if state == nil {
+		state = &fileResumeState{}
+	}
+	f(state)
+	return nil
+}
+
+// update calls f with the state saved under the resume name and writes the
+// file back. A nil state removes the resume name from the file.
+func (s *fileResumeStore) update(f func(*fileResumeState) *fileResumeState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	states, err := s.read()
+	if err != nil {
+		return err
+	}
+	state := states[s.name]
+	if state == nil {
+		state = &fileResumeState{}
+	}
+	if state = f(state); state == nil {
+		delete(states, s.name)
+	} else {
+		states[s.name] = state
+	}
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+func (s *fileResumeStore) LoadTimestamp() (ts primitive.Timestamp, err error) {
+	err = s.view(func(state *fileResumeState) {
+		if state.Timestamp != nil {
+			ts = *state.Timestamp
+		}
+	})
+	return
+}
+
+func (s *fileResumeStore) SaveTimestamp(ts primitive.Timestamp) error {
+	return s.update(func(state *fileResumeState) *fileResumeState {
+		state.Timestamp = &ts
+		return state
+	})
+}
+
+func (s *fileResumeStore) LoadToken(streamID string) (token interface{}, err error) {
+	err = s.view(func(state *fileResumeState) {
+		token = state.Tokens[streamID]
+	})
+	return
+}
+
+func (s *fileResumeStore) LoadTokens() (tokens map[string]interface{}, err error) {
+	err = s.view(func(state *fileResumeState) {
+		tokens = state.Tokens
+	})
+	return
+}
+
+func (s *fileResumeStore) SaveTokens(tokens bson.M) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	return s.update(func(state *fileResumeState) *fileResumeState {
+		if state.Tokens == nil {
+			state.Tokens = make(map[string]interface{})
+		}
+		for streamID, token := range tokens {
+			state.Tokens[streamID] = tokenDocument(token)
+		}
+		return state
+	})
+}
+
+func (s *fileResumeStore) Delete() error {
+	return s.update(func(state *fileResumeState) *fileResumeState {
+		if state.Heartbeat == nil {
+			return nil
+		}
+		return &fileResumeState{Heartbeat: state.Heartbeat}
+	})
+}
+
+func (s *fileResumeStore) LoadHeartbeat() (hb *heartbeat, err error) {
+	err = s.view(func(state *fileResumeState) {
+		hb = state.Heartbeat
+	})
+	return
+}
+
+func (s *fileResumeStore) SaveHeartbeat(hb *heartbeat) error {
+	return s.update(func(state *fileResumeState) *fileResumeState {
+		state.Heartbeat = hb
+		return state
+	})
+}
+
+func (s *fileResumeStore) DeleteHeartbeat() error {
+	return s.update(func(state *fileResumeState) *fileResumeState {
+		state.Heartbeat = nil
+		return state
+	})
+}
+
+// kvResumeStore keeps each value of a resume name in its own json file under
+// a directory: ts, heartbeat and one file per stream in tokens/.
+type kvResumeStore struct {
+	dir string
+}
+
+func (s *kvResumeStore) get(key string, v interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("unable to parse %s: %s", filepath.Join(s.dir, key), err)
+	}
+	return true, nil
+}
+
+func (s *kvResumeStore) put(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, key)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func (s *kvResumeStore) remove(key string) error {
+	err := os.RemoveAll(filepath.Join(s.dir, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func tokenKey(streamID string) string {
+	return filepath.Join("tokens", url.PathEscape(streamID))
+}
+
+func (s *kvResumeStore) LoadTimestamp() (ts primitive.Timestamp, err error) {
+	_, err = s.get("ts", &ts)
+	return
+}
+
+func (s *kvResumeStore) SaveTimestamp(ts primitive.Timestamp) error {
+	return s.put("ts", ts)
+}
+
+func (s *kvResumeStore) LoadToken(streamID string) (token interface{}, err error) {
+	_, err = s.get(tokenKey(streamID), &token)
+	return
+}
+
+func (s *kvResumeStore) LoadTokens() (map[string]interface{}, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.dir, "tokens"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	tokens := make(map[string]interface{})
+	for _, f := range files {
+		streamID, err := url.PathUnescape(f.Name())
+		if err != nil {
+			continue
+		}
+		var token interface{}
+		if _, err = s.get(tokenKey(streamID), &token); err != nil {
+			return nil, err
+		}
+		tokens[streamID] = token
+	}
+	return tokens, nil
+}
+
+func (s *kvResumeStore) SaveTokens(tokens bson.M) error {
+	for streamID, token := range tokens {
+		if err := s.put(tokenKey(streamID), tokenDocument(token)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *kvResumeStore) Delete() error {
+	if err := s.remove("ts"); err != nil {
+		return err
+	}
+	return s.remove("tokens")
+}
+
+func (s *kvResumeStore) LoadHeartbeat() (*heartbeat, error) {
+	hb := &heartbeat{}
+	if ok, err := s.get("heartbeat", hb); !ok {
+		return nil, err
+	}
+	return hb, nil
+}
+
+func (s *kvResumeStore) SaveHeartbeat(hb *heartbeat) error {
+	return s.put("heartbeat", hb)
+}
+
+func (s *kvResumeStore) DeleteHeartbeat() error {
+	return s.remove("heartbeat")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// localResumeStores returns a file and a kv store for each resume name, both
+// kept under dir.
+func localResumeStores(dir string, names ...string) map[string][]resumeStore {
+	stores := map[string][]resumeStore{}
+	for _, name := range names {
+		config := &configOptions{ResumeName: name}
+		for _, settings := range []resumeStoreSettings{
+			{Type: fileResumeStoreType, Path: filepath.Join(dir, "resume.json")},
+			{Type: kvResumeStoreType, Path: filepath.Join(dir, "kv")},
+		} {
+			config.ResumeStore = settings
+			s, err := config.newResumeStore(nil)
+			if err != nil {
+				panic(err)
+			}
+			stores[settings.Type] = append(stores[settings.Type], s)
+		}
+	}
+	return stores
+}
+
+func TestLocalResumeStores(t *testing.T) {
+	for _, typ := range []string{fileResumeStoreType, kvResumeStoreType} {
+		t.Run(typ, func(t *testing.T) {
+			stores := localResumeStores(tempDir(t), "default", "other/name")[typ]
+			s, other := stores[0], stores[1]
+
+			if ts, err := s.LoadTimestamp(); err != nil || ts != (primitive.Timestamp{}) {
+				t.Errorf("LoadTimestamp() = %v, %v, want zero", ts, err)
+			}
+			if token, err := s.LoadToken("db.a"); err != nil || token != nil {
+				t.Errorf("LoadToken() = %v, %v, want nil", token, err)
+			}
+			if hb, err := s.LoadHeartbeat(); err != nil || hb != nil {
+				t.Errorf("LoadHeartbeat() = %v, %v, want nil", hb, err)
+			}
+
+			ts := primitive.Timestamp{T: 1600000000, I: 3}
+			if err := s.SaveTimestamp(ts); err != nil {
+				t.Fatal(err)
+			}
+			tokens := bson.M{"db.a": map[string]interface{}{"_data": "a1"}, "db/b": "b1"}
+			if err := s.SaveTokens(tokens); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SaveTokens(bson.M{"db.a": map[string]interface{}{"_data": "a2"}}); err != nil {
+				t.Fatal(err)
+			}
+			hb := &heartbeat{Host: "host", Pid: 42, Heartbeat: time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)}
+			if err := s.SaveHeartbeat(hb); err != nil {
+				t.Fatal(err)
+			}
+			if err := other.SaveTimestamp(primitive.Timestamp{T: 1}); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, err := s.LoadTimestamp(); err != nil || got != ts {
+				t.Errorf("LoadTimestamp() = %v, %v, want %v", got, err, ts)
+			}
+			wantTokens := map[string]interface{}{"db.a": map[string]interface{}{"_data": "a2"}, "db/b": "b1"}
+			if got, err := s.LoadTokens(); err != nil || !reflect.DeepEqual(got, wantTokens) {
+				t.Errorf("LoadTokens() = %v, %v, want %v", got, err, wantTokens)
+			}
+			if got, err := s.LoadToken("db/b"); err != nil || got != "b1" {
+				t.Errorf("LoadToken() = %v, %v, want b1", got, err)
+			}
+			if got, err := s.LoadHeartbeat(); err != nil || !reflect.DeepEqual(got, hb) {
+				t.Errorf("LoadHeartbeat() = %+v, %v, want %+v", got, err, hb)
+			}
+
+			// deleting the resume state keeps the heartbeat and other resume names
+			if err := s.Delete(); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := s.LoadTimestamp(); err != nil || got != (primitive.Timestamp{}) {
+				t.Errorf("LoadTimestamp() after Delete() = %v, %v, want zero", got, err)
+			}
+			if got, err := s.LoadTokens(); err != nil || len(got) != 0 {
+				t.Errorf("LoadTokens() after Delete() = %v, %v, want none", got, err)
+			}
+			if got, err := s.LoadHeartbeat(); err != nil || got == nil {
+				t.Errorf("LoadHeartbeat() after Delete() = %v, %v, want the heartbeat", got, err)
+			}
+			if got, err := other.LoadTimestamp(); err != nil || got.T != 1 {
+				t.Errorf("other LoadTimestamp() = %v, %v, want T 1", got, err)
+			}
+
+			if err := s.DeleteHeartbeat(); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := s.LoadHeartbeat(); err != nil || got != nil {
+				t.Errorf("LoadHeartbeat() after DeleteHeartbeat() = %v, %v, want nil", got, err)
+			}
+		})
+	}
+}
+
+func TestLocalResumeStoreCorrupt(t *testing.T) {
+	dir := tempDir(t)
+	stores := localResumeStores(dir, "default")
+	if err := ioutil.WriteFile(filepath.Join(dir, "resume.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "kv", "default"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "kv", "default", "ts"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for typ, s := range stores {
+		if _, err := s[0].LoadTimestamp(); err == nil {
+			t.Errorf("%s LoadTimestamp() of a corrupt store error = nil, want an error", typ)
+		}
+	}
+}
+
+func TestNewResumeStoreUnknownType(t *testing.T) {
+	config := &configOptions{ResumeStore: resumeStoreSettings{Type: "redis"}}
+	if _, err := config.newResumeStore(nil); err == nil {
+		t.Error("newResumeStore() error = nil, want an error for an unknown type")
+	}
+}
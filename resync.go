@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	resyncIndexed  = "indexed"
+	resyncDeleted  = "deleted"
+	resyncSkipped  = "skipped"
+	resyncFiltered = "filtered"
+	resyncNotFound = "not_found"
+	resyncFailed   = "failed"
+	resyncDropped  = "dropped"
+)
+
+// resyncMaxDocs bounds the ids of a resync request and the docs its filter
+// may match.
+const resyncMaxDocs = 1000
+
+// resyncMaxBody bounds the size of a resync request over http.
+const resyncMaxBody = 1 << 20
+
+type resyncRequest struct {
+	Namespace string      `json:"namespace"`
+	IDs       []string    `json:"ids"`
+	Filter    interface{} `json:"-"` // mongo filter, used when no ids are given
+}
+
+type resyncResult struct {
+	ID          string `json:"id"`                    // the mongo _id
+	AppSearchID string `json:"appSearchId,omitempty"` // the App Search document id
+	Status      string `json:"status"`
+	Reason      string `json:"reason,omitempty"` // why the doc was dropped: schema or stale
+	Error       string `json:"error,omitempty"`
+}
+
+// mongoIDCandidates returns the values an _id given as string may be stored as.
+func mongoIDCandidates(id string) []interface{} {
+	candidates := []interface{}{id}
+	if oid, err := primitive.ObjectIDFromHex(id); err == nil {
+		candidates = append(candidates, oid)
+	}
+	if i, err := strconv.ParseInt(id, 10, 64); err == nil {
+		candidates = append(candidates, i, int32(i))
+	}
+	return candidates
+}
+
+// resync reads the requested docs of a namespace from mongo and indexes them
+// right away through the same mapping and buffers as the sync, reporting a
+// result per doc.
+func (ic *indexClient) resync(req *resyncRequest) ([]*resyncResult, error) {
+	engine := ic.engines[req.Namespace]
+	if engine == nil {
+		return nil, fmt.Errorf("no engine configured for namespace %s", req.Namespace)
+	}
+	var query interface{}
+	if len(req.IDs) > resyncMaxDocs {
+		return nil, fmt.Errorf("resync accepts up to %d ids", resyncMaxDocs)
+	} else if len(req.IDs) > 0 {
+		var in []interface{}
+		for _, id := range req.IDs {
+			in = append(in, mongoIDCandidates(id)...)
+		}
+		query = bson.M{"_id": bson.M{"$in": in}}
+	} else if req.Filter != nil {
+		query = req.Filter
+	} else {
+		return nil, fmt.Errorf("resync requires ids or a filter")
+	}
+
+	filter := ic.config.documentFilter()
+	var results []*resyncResult
+	var ops []*gtm.Op
+	found := make(map[string]bool)
+	read := 0
+	err := ic.findOps(req.Namespace, query, func(op *gtm.Op) error {
+		if read++; read > resyncMaxDocs {
+			return fmt.Errorf("resync matches more than %d docs, narrow the filter", resyncMaxDocs)
+		}
+		id := mongoIDString(op.Id)
+		found[id] = true
+		if !filter(op) {
+			results = append(results, &resyncResult{ID: id, Status: resyncFiltered})
+			return nil
+		}
+		ops = append(ops, op)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range req.IDs {
+		if !found[id] {
+			results = append(results, &resyncResult{ID: id, Status: resyncNotFound})
+		}
+	}
+	for start := 0; start < len(ops); start += verifyBatchSize {
+		end := start + verifyBatchSize
+		if end > len(ops) {
+			end = len(ops)
+		}
+		results = append(results, ic.resyncOps(engine, ops[start:end])...)
+	}
+	return results, nil
+}
+
+func mongoIDString(id interface{}) string {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+	return fmt.Sprint(id)
+}
+
+// resyncOps buffers the mapped ops and flushes them, so that they go through
+// stale write protection and are written to both engines while reindexing.
+func (ic *indexClient) resyncOps(engine *indexEngineCtx, ops []*gtm.Op) []*resyncResult {
+	results := make([]*resyncResult, len(ops))
+	for i, op := range ops {
+		results[i] = &resyncResult{ID: mongoIDString(op.Id)}
+	}
+	fail := func(rs []*resyncResult, err error) {
+		for _, r := range rs {
+			r.Status, r.Error = resyncFailed, err.Error()
+		}
+	}
+	outs, err := ic.mapOps(engine, ops)
+	if err != nil {
+		fail(results, err)
+		return results
+	}
+	ic.indexMutex.Lock()
+	defer ic.indexMutex.Unlock()
+	var buffered []*resyncResult
+	for i, op := range ops {
+		if engine.batchPlugin != nil && outs[i] == nil {
+			results[i].Status = resyncSkipped
+			continue
+		}
+		results[i].AppSearchID, _, _, _ = engine.mapOutput(op, outs[i])
+		outcome, err := ic.bufferOutcome(engine, op, outs[i])
+		switch outcome {
+		case "indexed":
+			if engine.reindexName != "" {
+				// unlike a direct read, a resynced doc corrects the engine
+				// being replaced as well
+				last := len(engine.reindexDocs) - 1
+				engine.docs = append(engine.docs, engine.reindexDocs[last])
+				engine.reindexDocs = engine.reindexDocs[:last]
+			}
+			results[i].Status = resyncIndexed
+			buffered = append(buffered, results[i])
+		case "deleted":
+			results[i].Status = resyncDeleted
+			buffered = append(buffered, results[i])
+		case "skipped":
+			results[i].Status = resyncSkipped
+		case "invalid":
+			fail(results[i:i+1], err)
+		default:
+			results[i].Status, results[i].Reason = resyncDropped, outcome
+		}
+	}
+	if err = ic.flush(); err != nil {
+		fail(buffered, err)
+	}
+	return results
+}
+
+// parseResyncRequest builds a request from the command line, where ids are
+// comma separated and the filter is mongo extended json.
+func parseResyncRequest(namespace, ids, filter string) (*resyncRequest, error) {
+	req := &resyncRequest{Namespace: namespace}
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			req.IDs = append(req.IDs, id)
+		}
+	}
+	return req, req.setFilter(filter)
+}
+
+func (req *resyncRequest) setFilter(filter string) error {
+	if filter == "" {
+		return nil
+	}
+	var f bson.M
+	if err := bson.UnmarshalExtJSON([]byte(filter), false, &f); err != nil {
+		return fmt.Errorf("invalid filter: %s", err)
+	}
+	req.Filter = f
+	return nil
+}
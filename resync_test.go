@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rwynn/gtm"
+)
+
+func TestResyncHandler(t *testing.T) {
+	tooManyIDs := make([]string, resyncMaxDocs+1)
+	for i := range tooManyIDs {
+		tooManyIDs[i] = fmt.Sprintf("%q", fmt.Sprint(i))
+	}
+	tests := []struct {
+		name       string
+		header     string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"unauthorized", "Bearer other", `{"namespace":"db.courses","ids":["1"]}`, 401, ""},
+		{"body too large", "Bearer secret", `{"namespace":"db.courses","ids":["` + strings.Repeat("1", resyncMaxBody) + `"]}`, 400, "Invalid resync request"},
+		{"invalid json", "Bearer secret", `{"namespace":`, 400, "Invalid resync request"},
+		{"too many ids", "Bearer secret", `{"namespace":"db.courses","ids":[` + strings.Join(tooManyIDs, ",") + `]}`, 400, "resync accepts up to 1000 ids"},
+		{"no ids nor filter", "Bearer secret", `{"namespace":"db.courses"}`, 400, "resync requires ids or a filter"},
+		{"unknown namespace", "Bearer secret", `{"namespace":"db.tests","ids":["1"]}`, 400, "no engine configured for namespace db.tests"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ic, _ := newTestIndexClient(t, "")
+			ic.config.ControlToken = "secret"
+			ctx := &httpServerCtx{indexConfig: ic}
+			req := httptest.NewRequest(http.MethodPost, "/control/resync", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", tt.header)
+			w := httptest.NewRecorder()
+			ctx.control(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestResyncOpsWhileReindexing(t *testing.T) {
+	srv := newFakeEngines()
+	server := httptest.NewServer(srv)
+	defer server.Close()
+	srv.add(appSearchEngine{Name: "courses"})
+	srv.add(appSearchEngine{Name: "courses-new"})
+	ic, e := newTestIndexClient(t, server.URL)
+	e.reindexName = "courses-new"
+	// a direct read of the reindex, buffered for the new engine only
+	e.reindexDocs = []interface{}{map[string]interface{}{"id": "read"}}
+	ops := []*gtm.Op{
+		{Id: "1", Namespace: "db.courses", Operation: "i", Source: gtm.DirectQuerySource, Doc: map[string]interface{}{"_id": "1", "title": "go"}},
+		{Id: "2", Namespace: "db.courses", Operation: "i", Source: gtm.DirectQuerySource, Doc: map[string]interface{}{"_id": "2", "title": "rust"}},
+	}
+	results := ic.resyncOps(e, ops)
+	want := []*resyncResult{
+		{ID: "1", AppSearchID: "1", Status: resyncIndexed},
+		{ID: "2", AppSearchID: "2", Status: resyncIndexed},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("resyncOps() = %+v, want %+v", results, want)
+	}
+	if got := srv.engine("courses").docs; len(got) != 2 || got["1"] == nil || got["2"] == nil {
+		t.Errorf("courses docs = %v, want the resynced docs in the engine being replaced", got)
+	}
+	if got := srv.engine("courses-new").docs; len(got) != 3 {
+		t.Errorf("courses-new docs = %v, want the direct read and the resynced docs", got)
+	}
+	if got := srv.engine("courses").docs["read"]; got != nil {
+		t.Error("the direct read of the reindex was moved to the engine being replaced")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// schemaTracker records the field names and inferred types of the documents
+// indexed into an engine and compares them to the live App Search schema.
+type schemaTracker struct {
+	mutex        sync.Mutex
+	declared     map[string]string
+	live         map[string]string
+	observed     map[string]string
+	reported     map[string]bool
+	needsRefresh bool
+	block        bool
+}
+
+type schemaDrift struct {
+	Field    string `json:"field"`
+	Observed string `json:"observed"`
+	Live     string `json:"live,omitempty"`
+	Declared string `json:"declared,omitempty"`
+}
+
+type engineSchemaReport struct {
+	Observed map[string]string `json:"observed"`
+	Live     map[string]string `json:"live"`
+	Drift    []schemaDrift     `json:"drift"`
+}
+
+func newSchemaTracker(declared map[string]string, block bool) *schemaTracker {
+	return &schemaTracker{
+		declared: declared,
+		live:     make(map[string]string),
+		observed: make(map[string]string),
+		reported: make(map[string]bool),
+		block:    block,
+	}
+}
+
+// inferFieldType guesses the App Search type a normalized value is stored as.
+// Strings in the date format are taken for dates and booleans, which
+// normalization turns into "true" and "false", for text.
+func inferFieldType(value interface{}, dateFormat string) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64, float32, int, int32, int64:
+		return "number"
+	case string:
+		if _, err := time.Parse(dateFormat, v); err == nil {
+			return "date"
+		}
+	case []interface{}:
+		for _, elem := range v {
+			if t := inferFieldType(elem, dateFormat); t != "" {
+				return t
+			}
+		}
+		return ""
+	}
+	return "text"
+}
+
+func (t *schemaTracker) expected(field string) (string, bool) {
+	if typ, ok := t.declared[field]; ok {
+		return typ, true
+	}
+	typ, ok := t.live[field]
+	return typ, ok
+}
+
+// compatibleType reports whether values of the inferred type can be stored in
+// a field of the schema type. Geolocations cannot be told apart from text, and
+// text fields take any string, including those that look like dates.
+func compatibleType(inferred, schemaType string) bool {
+	return inferred == schemaType ||
+		(schemaType == "geolocation" && inferred == "text") ||
+		(schemaType == "text" && inferred == "date")
+}
+
+// observe records the fields of doc and returns the drift it introduces. When
+// blocking is enabled ok is false for docs with fields missing from the schema.
+func (t *schemaTracker) observe(doc map[string]interface{}, dateFormat string) (drift []schemaDrift, ok bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ok = true
+	for field, value := range doc {
+		if field == "id" {
+			continue
+		}
+		typ := inferFieldType(value, dateFormat)
+		if typ == "" {
+			continue
+		}
+		want, known := t.expected(field)
+		if !known && t.block {
+			ok = false
+			continue
+		}
+		if !known {
+			t.needsRefresh = true // App Search creates the field on index
+		}
+		t.observed[field] = typ
+		if (!known || !compatibleType(typ, want)) && !t.reported[field] {
+			t.reported[field] = true
+			drift = append(drift, t.drift(field))
+		}
+	}
+	return
+}
+
+func (t *schemaTracker) drift(field string) schemaDrift {
+	return schemaDrift{
+		Field:    field,
+		Observed: t.observed[field],
+		Live:     t.live[field],
+		Declared: t.declared[field],
+	}
+}
+
+func (t *schemaTracker) setLive(schema map[string]string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.live = schema
+	t.needsRefresh = false
+}
+
+func (t *schemaTracker) refreshNeeded() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.needsRefresh
+}
+
+func (t *schemaTracker) report() *engineSchemaReport {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	r := &engineSchemaReport{
+		Observed: make(map[string]string, len(t.observed)),
+		Live:     make(map[string]string, len(t.live)),
+		Drift:    []schemaDrift{},
+	}
+	for k, v := range t.live {
+		r.Live[k] = v
+	}
+	fields := make([]string, 0, len(t.observed))
+	for k, v := range t.observed {
+		r.Observed[k] = v
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		typ := t.observed[field]
+		live, inLive := t.live[field]
+		declared, inDeclared := t.declared[field]
+		if (!inLive && !inDeclared) ||
+			(inLive && !compatibleType(typ, live)) ||
+			(inDeclared && !compatibleType(typ, declared)) ||
+			(inLive && inDeclared && live != declared) {
+			r.Drift = append(r.Drift, t.drift(field))
+		}
+	}
+	return r
+}
+
+// refreshSchemas loads the live schema of the engines that have seen new fields,
+// or of every engine when all is set. It must be called without indexMutex
+// held since App Search may be slow to answer.
+func (ic *indexClient) refreshSchemas(all bool) {
+	names := make(map[*indexEngineCtx]string)
+	ic.indexMutex.Lock()
+	for _, e := range ic.engines {
+		if e.schema != nil && (all || e.schema.refreshNeeded()) {
+			names[e] = e.name
+		}
+	}
+	ic.indexMutex.Unlock()
+	for e, name := range names {
+		schema, err := ic.client.getSchema(name)
+		if err != nil {
+			ic.config.log(engineComponent).Error("Unable to get engine schema", "engine", name, "error", err)
+			continue
+		}
+		e.schema.setLive(schema)
+	}
+}
+
+// requestSchemaRefresh asks the schema refresher to load the schemas of the
+// engines that have seen new fields, without waiting for it.
+func (ic *indexClient) requestSchemaRefresh() {
+	select {
+	case ic.schemaRefresh <- struct{}{}:
+	default:
+	}
+}
+
+// schemaRefresher refreshes the live schemas in the background so that the
+// flushes only read the cached ones.
+func (ic *indexClient) schemaRefresher() {
+	for range ic.schemaRefresh {
+		ic.refreshSchemas(false)
+	}
+}
+
+func (ic *indexClient) startSchemaRefresher() {
+	if ic.config.DetectSchemaDrift {
+		go ic.schemaRefresher()
+	}
+}
+
+// checkSchema tracks the fields of a prepared doc and reports whether it may
+// be indexed.
+func (ic *indexClient) checkSchema(engine *indexEngineCtx, doc map[string]interface{}) bool {
+	if engine.schema == nil {
+		return true
+	}
+	drift, ok := engine.schema.observe(doc, engine.normalize.DateFormat)
+	for _, d := range drift {
+		ic.config.log(engineComponent).Warn("Schema drift", "engine", engine.name, "namespace", engine.namespace,
+			"field", d.Field, "observed", d.Observed, "live", d.Live, "declared", d.Declared)
+	}
+	if !ok {
+		ic.stats.AddBlocked(1)
+		ic.config.log(engineComponent).Debug("Blocking doc with fields missing from the schema", "engine", engine.name, "namespace", engine.namespace, "doc_id", doc["id"])
+	}
+	return ok
+}
+
+func (ic *indexClient) schemaReport() map[string]*engineSchemaReport {
+	reports := make(map[string]*engineSchemaReport)
+	for _, e := range ic.engines {
+		if e.schema != nil {
+			reports[e.name] = e.schema.report()
+		}
+	}
+	return reports
+}
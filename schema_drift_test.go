@@ -0,0 +1,156 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestInferFieldType(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"nil", nil, ""},
+		{"float", 1.5, "number"},
+		{"int", 3, "number"},
+		{"int64", int64(3), "number"},
+		{"text", "intro to go", "text"},
+		{"date string", "2021-03-04T05:06:07Z", "date"},
+		{"date string in another layout", "2021-03-04", "text"},
+		{"normalized bool", "true", "text"},
+		{"bool", true, "text"},
+		{"map", map[string]interface{}{"a": 1}, "text"},
+		{"array of numbers", []interface{}{1.0, 2.0}, "number"},
+		{"array starting with nil", []interface{}{nil, "2021-03-04T05:06:07Z"}, "date"},
+		{"empty array", []interface{}{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inferFieldType(tt.value, time.RFC3339); got != tt.want {
+				t.Errorf("inferFieldType(%v) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchemaTrackerObserve(t *testing.T) {
+	declared := map[string]string{"title": "text", "price": "number", "location": "geolocation"}
+	live := map[string]string{"title": "text", "price": "number", "location": "geolocation", "starts": "date"}
+	tests := []struct {
+		name        string
+		block       bool
+		doc         map[string]interface{}
+		wantOK      bool
+		wantDrift   []string
+		wantRefresh bool
+	}{
+		{
+			name:   "matching fields",
+			doc:    map[string]interface{}{"id": "1", "title": "go", "price": 10.0, "location": "1,2", "starts": "2021-03-04T05:06:07Z"},
+			wantOK: true,
+		},
+		{
+			name:   "date-like string in a text field",
+			doc:    map[string]interface{}{"title": "2021-03-04T05:06:07Z"},
+			wantOK: true,
+		},
+		{
+			name:      "typed differently",
+			doc:       map[string]interface{}{"price": "free", "starts": "soon"},
+			wantOK:    true,
+			wantDrift: []string{"price", "starts"},
+		},
+		{
+			name:        "unknown field",
+			doc:         map[string]interface{}{"title": "go", "level": "beginner"},
+			wantOK:      true,
+			wantDrift:   []string{"level"},
+			wantRefresh: true,
+		},
+		{
+			name:   "unknown field blocked",
+			block:  true,
+			doc:    map[string]interface{}{"title": "go", "level": "beginner"},
+			wantOK: false,
+		},
+		{
+			name:   "empty unknown field not blocked",
+			block:  true,
+			doc:    map[string]interface{}{"title": "go", "level": nil},
+			wantOK: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newSchemaTracker(declared, tt.block)
+			tracker.setLive(live)
+			drift, ok := tracker.observe(tt.doc, time.RFC3339)
+			if ok != tt.wantOK {
+				t.Errorf("observe() ok = %v, want %v", ok, tt.wantOK)
+			}
+			var fields []string
+			for _, d := range drift {
+				fields = append(fields, d.Field)
+			}
+			if !reflect.DeepEqual(sortedStrings(fields), tt.wantDrift) {
+				t.Errorf("observe() drift = %v, want %v", fields, tt.wantDrift)
+			}
+			if got := tracker.refreshNeeded(); got != tt.wantRefresh {
+				t.Errorf("refreshNeeded() = %v, want %v", got, tt.wantRefresh)
+			}
+			if drift, _ = tracker.observe(tt.doc, time.RFC3339); len(drift) != 0 {
+				t.Errorf("drift reported again: %v", drift)
+			}
+		})
+	}
+}
+
+func TestSchemaTrackerReport(t *testing.T) {
+	tracker := newSchemaTracker(map[string]string{"title": "text", "price": "number"}, false)
+	tracker.setLive(map[string]string{"title": "text", "price": "text", "starts": "date"})
+	tracker.observe(map[string]interface{}{
+		"title":  "2021-03-04T05:06:07Z",
+		"price":  10.0,
+		"starts": "2021-03-04T05:06:07Z",
+		"level":  "beginner",
+	}, time.RFC3339)
+	report := tracker.report()
+	want := []schemaDrift{
+		{Field: "level", Observed: "text"},
+		{Field: "price", Observed: "number", Live: "text", Declared: "number"},
+	}
+	if !reflect.DeepEqual(report.Drift, want) {
+		t.Errorf("report() drift = %+v, want %+v", report.Drift, want)
+	}
+	if len(report.Observed) != 4 || len(report.Live) != 3 {
+		t.Errorf("report() observed %v and live %v, want 4 and 3 fields", report.Observed, report.Live)
+	}
+}
+
+func TestCheckSchemaBlocking(t *testing.T) {
+	ic, e := newTestIndexClient(t, "")
+	e.normalize = defaultNormalizeSettings()
+	ic.stats.Enabled = true
+	e.schema = newSchemaTracker(map[string]string{"title": "text"}, true)
+	if !ic.checkSchema(e, map[string]interface{}{"id": "1", "title": "go"}) {
+		t.Error("checkSchema() blocked a doc matching the schema")
+	}
+	if ic.checkSchema(e, map[string]interface{}{"id": "2", "title": "go", "level": "beginner"}) {
+		t.Error("checkSchema() indexed a doc with a field missing from the schema")
+	}
+	if got := ic.stats.Blocked; got != 1 {
+		t.Errorf("blocked = %d, want 1", got)
+	}
+}
+
+func sortedStrings(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	sorted := append([]string(nil), s...)
+	sort.Strings(sorted)
+	return sorted
+}
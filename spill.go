@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const spillRetryInterval = 5 * time.Second
+
+// errSpillFull is returned when a flush would grow a spill file over max-size.
+var errSpillFull = errors.New("spill file is full")
+
+type spillSettings struct {
+	Dir     string `toml:"dir"`      // directory of the spill files of disabled engines
+	MaxSize int64  `toml:"max-size"` // megabytes spilled per engine, consumption pauses beyond
+}
+
+// spillRecord is one line of a spill file: the docs or the deletes of a flush
+// of a disabled engine, in the order they would have been sent.
+type spillRecord struct {
+	Docs    []interface{} `json:"docs,omitempty"`
+	Deletes []string      `json:"deletes,omitempty"`
+	Reindex bool          `json:"reindex,omitempty"` // docs for the new source engine of a reindex
+}
+
+// engineSpill is the spill file of an engine. The fields are guarded by
+// indexMutex.
+type engineSpill struct {
+	path      string
+	size      int64
+	disabled  bool // set while the engine is disabled
+	replaying bool // set while the spill file is sent to the re-enabled engine
+	paused    bool // set when the file being full paused the consumption of ops
+}
+
+// spilling reports whether the flushes of the engine go to its spill file. The
+// caller must hold indexMutex.
+func (e *indexEngineCtx) spilling() bool {
+	return e.spill.disabled || e.spill.replaying
+}
+
+// setupSpill opens the spill state of an engine, replaying a spill file left
+// by a previous run once started unless the engine is disabled.
+func (ic *indexClient) setupSpill(e *indexEngineCtx, m *engineConfig) {
+	e.spill = &engineSpill{
+		path:     filepath.Join(ic.config.Spill.Dir, url.PathEscape(m.Name)+".jsonl"),
+		disabled: m.Disabled,
+	}
+	if info, err := os.Stat(e.spill.path); err == nil && info.Size() > 0 {
+		e.spill.size = info.Size()
+		e.spill.replaying = !m.Disabled
+		ic.config.log(engineComponent).Info("Found ops spilled by a previous run", "engine", m.Name, "bytes", e.spill.size, "path", e.spill.path)
+	}
+}
+
+// startReplays replays the spill files found on startup.
+func (ic *indexClient) startReplays() {
+	for _, e := range ic.engines {
+		if e.spill.replaying {
+			go ic.replaySpill(e)
+		}
+	}
+}
+
+// spillEngine appends the buffered deletes and docs of a disabled engine to
+// its spill file instead of sending them to App Search. When that fails the
+// buffers are kept for the next flush, and a full spill file pauses the
+// consumption of ops until it is replayed. The caller must hold indexMutex.
+func (ic *indexClient) spillEngine(e *indexEngineCtx) error {
+	var records []*spillRecord
+	if len(e.deletes) > 0 {
+		records = append(records, &spillRecord{Deletes: e.deletes})
+	}
+	if len(e.reindexDocs) > 0 {
+		records = append(records, &spillRecord{Docs: e.reindexDocs, Reindex: true})
+	}
+	if len(e.docs) > 0 {
+		records = append(records, &spillRecord{Docs: e.docs})
+	}
+	var docs int
+	for _, r := range records {
+		docs += len(r.Docs) + len(r.Deletes)
+	}
+	if len(records) > 0 {
+		if err := ic.appendSpill(e, records); errors.Is(err, errSpillFull) {
+			if ic.pause.pause(spillPause + e.name) {
+				e.spill.paused = true
+				ic.config.log(engineComponent).Warn("Consumption of ops paused until the spill file is replayed", "engine", e.name, "docs", docs, "error", err)
+			}
+			return err
+		} else if err != nil {
+			ic.config.log(engineComponent).Error("Unable to spill docs of disabled engine, retrying on next flush", "engine", e.name, "docs", docs, "error", err)
+			return err
+		}
+		ic.metrics.docsSpilled.add(float64(docs), e.name)
+	}
+	e.deletes, e.reindexDocs, e.docs = nil, nil, []interface{}{}
+	// spilled docs are replayed in order, so their versions hold
+	ic.storeVersions(e, true, true)
+	// the ops are kept on disk, so the stream may move on
+	ic.trackIndexed(e)
+	for _, a := range e.audits {
+		ic.config.audit.record(a.op, e.name, auditSpilled, "", nil)
+	}
+	e.audits = nil
+	for _, s := range e.traces {
+		s.set("spilled", true)
+	}
+	return nil
+}
+
+func (ic *indexClient) appendSpill(e *indexEngineCtx, records []*spillRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	if max := ic.config.Spill.MaxSize << 20; e.spill.size+int64(buf.Len()) > max {
+		return fmt.Errorf("%w, %s would exceed max-size of %dMB", errSpillFull, e.spill.path, ic.config.Spill.MaxSize)
+	}
+	if err := os.MkdirAll(filepath.Dir(e.spill.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(e.spill.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	n, err := f.Write(buf.Bytes())
+	e.spill.size += int64(n)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// disableEngine stops sending the flushes of an engine to App Search, spilling
+// them to disk instead.
+func (ic *indexClient) disableEngine(e *indexEngineCtx) bool {
+	ic.indexMutex.Lock()
+	defer ic.indexMutex.Unlock()
+	if e.spill.disabled {
+		return false
+	}
+	e.spill.disabled = true
+	ic.config.log(engineComponent).Warn("Engine disabled, its docs are spilled to disk", "engine", e.name, "path", e.spill.path)
+	return true
+}
+
+// enableEngine sends the flushes of an engine to App Search again once its
+// spill file has been replayed.
+func (ic *indexClient) enableEngine(e *indexEngineCtx) bool {
+	ic.indexMutex.Lock()
+	defer ic.indexMutex.Unlock()
+	if !e.spill.disabled {
+		return false
+	}
+	e.spill.disabled = false
+	if e.spill.size > 0 && !e.spill.replaying {
+		e.spill.replaying = true
+		go ic.replaySpill(e)
+	}
+	ic.config.log(engineComponent).Info("Engine enabled", "engine", e.name, "spilled_bytes", e.spill.size)
+	return true
+}
+
+// replaySpill sends the spill file of an engine to App Search record by
+// record, retrying failed requests. Flushes keep being appended to the file
+// until it is replayed to the end, which is checked under indexMutex, so that
+// the engine receives the ops in order. The replay stops, leaving the file in
+// place, when the engine is disabled again; records replayed twice are
+// harmless since indexing and deleting are idempotent.
+func (ic *indexClient) replaySpill(e *indexEngineCtx) {
+	log := ic.config.log(engineComponent).With("engine", e.name, "path", e.spill.path)
+	f, err := os.Open(e.spill.path)
+	if err != nil {
+		log.Error("Unable to open spill file, the spilled docs are lost", "error", err)
+		ic.indexMutex.Lock()
+		e.spill.replaying, e.spill.size = false, 0
+		ic.indexMutex.Unlock()
+		return
+	}
+	defer f.Close()
+	log.Info("Replaying spilled docs", "bytes", e.spill.size)
+	reader := bufio.NewReader(f)
+	var partial []byte
+	records := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			line = append(partial, line...)
+			partial = nil
+			if !ic.replayRecord(e, line, log) {
+				ic.indexMutex.Lock()
+				if e.spill.disabled {
+					log.Warn("Replay stopped, the engine was disabled", "records", records)
+					e.spill.replaying = false
+				} else {
+					// enabled again meanwhile, start over
+					go ic.replaySpill(e)
+				}
+				ic.indexMutex.Unlock()
+				return
+			}
+			records++
+			continue
+		}
+		// a line still being written is completed by the next read
+		partial = append(partial, line...)
+		if err != nil && err != io.EOF {
+			log.Error("Unable to read spill file", "error", err)
+			time.Sleep(spillRetryInterval)
+			continue
+		}
+		ic.indexMutex.Lock()
+		if info, statErr := f.Stat(); statErr == nil {
+			if offset, seekErr := f.Seek(0, io.SeekCurrent); seekErr == nil && offset < info.Size() {
+				ic.indexMutex.Unlock()
+				continue
+			}
+		}
+		if len(partial) > 0 {
+			log.Warn("Skipping truncated spill record", "bytes", len(partial))
+		}
+		if err := os.Remove(e.spill.path); err != nil {
+			log.Error("Unable to remove replayed spill file", "error", err)
+		}
+		e.spill.replaying, e.spill.size = false, 0
+		if e.spill.paused {
+			e.spill.paused = false
+			if ic.pause.resume(spillPause + e.name) {
+				ic.pause.logReleased(log)
+			}
+		}
+		ic.indexMutex.Unlock()
+		log.Info("Spilled docs replayed", "records", records)
+		return
+	}
+}
+
+// replayRecord sends one spill record, retrying until it succeeds or App
+// Search rejects it for good, in which case it is skipped and counted as
+// dropped. It returns false when the engine was disabled before the record
+// could be sent.
+func (ic *indexClient) replayRecord(e *indexEngineCtx, line []byte, log *logger) bool {
+	var r spillRecord
+	if err := json.Unmarshal(line, &r); err != nil {
+		log.Error("Skipping invalid spill record", "error", err)
+		return true
+	}
+	for {
+		ic.indexMutex.Lock()
+		disabled, name, reindexName := e.spill.disabled, e.name, e.reindexName
+		ic.indexMutex.Unlock()
+		if disabled {
+			return false
+		}
+		var err error
+		switch {
+		case len(r.Deletes) > 0:
+			start := time.Now()
+			if err = ic.client.deleteDocuments(name, r.Deletes); err == nil && reindexName != "" {
+				err = ic.client.deleteDocuments(reindexName, r.Deletes)
+			}
+			ic.metrics.requestDuration.since(start, name, "delete")
+			if err == nil {
+				ic.stats.AddDeleted(len(r.Deletes))
+				ic.metrics.docsDeleted.add(float64(len(r.Deletes)), name)
+			}
+		case len(r.Docs) > 0:
+			target := name
+			if r.Reindex && reindexName != "" {
+				target = reindexName
+			}
+			err = ic.replayDocuments(e, target, r.Docs, log)
+		}
+		if err == nil {
+			return true
+		}
+		if isPermanent(err) {
+			docs := len(r.Docs) + len(r.Deletes)
+			log.Error("App Search rejected spilled docs, skipping them", "docs", docs, "error", err)
+			ic.stats.AddFailed(docs)
+			ic.metrics.docsDropped.add(float64(docs), name, e.namespace, "rejected")
+			return true
+		}
+		log.Error("Unable to replay spilled docs, retrying", "error", err)
+		time.Sleep(spillRetryInterval)
+	}
+}
+
+// replayDocuments indexes spilled docs, counting the docs App Search rejects
+// as dropped.
+func (ic *indexClient) replayDocuments(e *indexEngineCtx, engine string, docs []interface{}, log *logger) error {
+	start := time.Now()
+	results, err := ic.client.postDocuments(engine, docs)
+	ic.metrics.requestDuration.since(start, engine, "index")
+	if err != nil {
+		return err
+	}
+	rejected := 0
+	for _, r := range results {
+		if len(r.Errors) > 0 {
+			rejected++
+			log.Debug("App Search rejected spilled doc", "doc_id", r.ID, "errors", r.Errors)
+		}
+	}
+	if rejected > 0 {
+		log.Error("App Search rejected spilled docs, skipping them", "docs", rejected)
+		ic.stats.AddFailed(rejected)
+		ic.metrics.docsDropped.add(float64(rejected), engine, e.namespace, "rejected")
+	}
+	ic.stats.AddCommitted(1)
+	ic.stats.AddIndexed(len(docs) - rejected)
+	ic.metrics.docsIndexed.add(float64(len(docs)-rejected), engine)
+	return nil
+}
+
+type engineStatus struct {
+	Name         string `json:"name"`
+	Namespace    string `json:"namespace"`
+	Enabled      bool   `json:"enabled"`
+	Replaying    bool   `json:"replaying"`
+	SpilledBytes int64  `json:"spilledBytes"`
+}
+
+func (ic *indexClient) engineStatuses() []*engineStatus {
+	ic.indexMutex.Lock()
+	defer ic.indexMutex.Unlock()
+	statuses := make([]*engineStatus, 0, len(ic.config.EngineConfig))
+	for _, m := range ic.config.EngineConfig {
+		e := ic.engines[m.Namespace]
+		if e == nil {
+			continue
+		}
+		statuses = append(statuses, &engineStatus{
+			Name:         m.Name,
+			Namespace:    m.Namespace,
+			Enabled:      !e.spill.disabled,
+			Replaying:    e.spill.replaying,
+			SpilledBytes: e.spill.size,
+		})
+	}
+	return statuses
+}
+
+// engineByName returns the engine configured under name.
+func (ic *indexClient) engineByName(name string) *indexEngineCtx {
+	for _, m := range ic.config.EngineConfig {
+		if m.Name == name {
+			return ic.engines[m.Namespace]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rwynn/gtm"
+)
+
+// fakeAppSearch answers the documents endpoint like App Search, rejecting the
+// doc with id "invalid" and any delete of the id "bad".
+type fakeAppSearch struct {
+	mutex    sync.Mutex
+	requests []string // method, path and body of each request
+}
+
+func (f *fakeAppSearch) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body []interface{}
+	json.NewDecoder(req.Body).Decode(&body)
+	data, _ := json.Marshal(body)
+	f.mutex.Lock()
+	f.requests = append(f.requests, req.Method+" "+req.URL.Path+" "+string(data))
+	f.mutex.Unlock()
+	switch req.Method {
+	case http.MethodDelete:
+		for _, id := range body {
+			if id == "bad" {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"errors":["bad id"]}`))
+				return
+			}
+		}
+		w.Write([]byte(`[]`))
+	case http.MethodPost:
+		var results []*appSearchIndexResult
+		for _, doc := range body {
+			id, _ := doc.(map[string]interface{})["id"].(string)
+			r := &appSearchIndexResult{ID: id, Errors: []string{}}
+			if id == "invalid" {
+				r.Errors = []string{"invalid field"}
+			}
+			results = append(results, r)
+		}
+		json.NewEncoder(w).Encode(results)
+	}
+}
+
+func newSpillTestClient(t *testing.T, url string, maxSize int64) (*indexClient, *indexEngineCtx) {
+	t.Helper()
+	config := newConfig()
+	config.Spill = spillSettings{Dir: tempDir(t), MaxSize: maxSize}
+	config.EngineConfig = []*engineConfig{{Name: "courses", Namespace: "db.courses"}}
+	ic := &indexClient{
+		config:     config,
+		client:     &appSearchClient{baseURL: url, httpClient: http.DefaultClient},
+		indexMutex: &sync.Mutex{},
+		stats:      &bulkProcessorStats{},
+		metrics:    newSyncMetrics(),
+		lag:        newLagTracker(),
+		pause:      newPauseGate(),
+	}
+	e := &indexEngineCtx{name: "courses", namespace: "db.courses", docs: []interface{}{}}
+	ic.engines = map[string]*indexEngineCtx{e.namespace: e}
+	ic.setupSpill(e, &engineConfig{Name: "courses", Disabled: true})
+	return ic, e
+}
+
+func readSpillRecords(t *testing.T, path string) []*spillRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []*spillRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := &spillRecord{}
+		if err = json.Unmarshal(scanner.Bytes(), r); err != nil {
+			t.Fatalf("invalid spill record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestSpillEngine(t *testing.T) {
+	ic, e := newSpillTestClient(t, "", 1)
+	e.deletes = []string{"d1"}
+	e.reindexDocs = []interface{}{map[string]interface{}{"id": "r1"}}
+	e.docs = []interface{}{map[string]interface{}{"id": "1"}, map[string]interface{}{"id": "2"}}
+	if err := ic.spillEngine(e); err != nil {
+		t.Fatalf("spillEngine() error = %v", err)
+	}
+	if e.buffered() != 0 {
+		t.Errorf("buffered() = %d after spilling, want 0", e.buffered())
+	}
+	e.deletes = []string{"d2"}
+	if err := ic.spillEngine(e); err != nil {
+		t.Fatalf("spillEngine() error = %v", err)
+	}
+
+	want := []*spillRecord{
+		{Deletes: []string{"d1"}},
+		{Docs: []interface{}{map[string]interface{}{"id": "r1"}}, Reindex: true},
+		{Docs: []interface{}{map[string]interface{}{"id": "1"}, map[string]interface{}{"id": "2"}}},
+		{Deletes: []string{"d2"}},
+	}
+	if got := readSpillRecords(t, e.spill.path); !reflect.DeepEqual(got, want) {
+		t.Errorf("spill records = %+v, want %+v", got, want)
+	}
+	info, err := os.Stat(e.spill.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.spill.size != info.Size() {
+		t.Errorf("spill size = %d, want the file size %d", e.spill.size, info.Size())
+	}
+	if got := ic.metrics.docsSpilled.values["courses"]; got != 5 {
+		t.Errorf("docs spilled = %v, want 5", got)
+	}
+}
+
+func TestSpillEngineFull(t *testing.T) {
+	ic, e := newSpillTestClient(t, "", 0)
+	e.docs = []interface{}{map[string]interface{}{"id": "1"}}
+	err := ic.spillEngine(e)
+	if !errors.Is(err, errSpillFull) {
+		t.Fatalf("spillEngine() error = %v, want %v", err, errSpillFull)
+	}
+	if len(e.docs) != 1 {
+		t.Errorf("docs = %v, want the buffered doc kept", e.docs)
+	}
+	if _, err = os.Stat(e.spill.path); !os.IsNotExist(err) {
+		t.Errorf("spill file written over max-size: %v", err)
+	}
+	if got := ic.pause.heldBy(); !e.spill.paused || !reflect.DeepEqual(got, []string{"spill:courses"}) {
+		t.Error("a full spill file should pause the consumption of ops")
+	}
+	if err = ic.spillEngine(e); !errors.Is(err, errSpillFull) {
+		t.Errorf("spillEngine() error = %v, want %v", err, errSpillFull)
+	}
+}
+
+func TestReplaySpill(t *testing.T) {
+	srv := &fakeAppSearch{}
+	server := httptest.NewServer(srv)
+	defer server.Close()
+	ic, e := newSpillTestClient(t, server.URL, 1)
+	e.reindexName = "courses-new"
+	e.deletes = []string{"bad"}
+	e.reindexDocs = []interface{}{map[string]interface{}{"id": "r1"}}
+	e.docs = []interface{}{map[string]interface{}{"id": "1"}, map[string]interface{}{"id": "invalid"}}
+	if err := ic.spillEngine(e); err != nil {
+		t.Fatal(err)
+	}
+	e.deletes = []string{"2"}
+	if err := ic.spillEngine(e); err != nil {
+		t.Fatal(err)
+	}
+	// a full spill file paused the consumption of ops meanwhile
+	ic.pause.pause(spillPause + e.name)
+	e.spill.paused = true
+
+	e.spill.disabled, e.spill.replaying = false, true
+	ic.replaySpill(e)
+
+	want := []string{
+		`DELETE /api/as/v1/engines/courses/documents ["bad"]`,
+		`POST /api/as/v1/engines/courses-new/documents [{"id":"r1"}]`,
+		`POST /api/as/v1/engines/courses/documents [{"id":"1"},{"id":"invalid"}]`,
+		`DELETE /api/as/v1/engines/courses/documents ["2"]`,
+		`DELETE /api/as/v1/engines/courses-new/documents ["2"]`,
+	}
+	if !reflect.DeepEqual(srv.requests, want) {
+		t.Errorf("requests =\n%s\nwant\n%s", strings.Join(srv.requests, "\n"), strings.Join(want, "\n"))
+	}
+	if _, err := os.Stat(e.spill.path); !os.IsNotExist(err) {
+		t.Errorf("replayed spill file not removed: %v", err)
+	}
+	if e.spill.replaying || e.spill.size != 0 {
+		t.Errorf("spill = %+v, want replayed", e.spill)
+	}
+	if got := ic.pause.heldBy(); e.spill.paused || len(got) != 0 {
+		t.Error("the consumption of ops was not resumed after the replay")
+	}
+	if got := ic.metrics.docsDropped.values["courses\xffdb.courses\xffrejected"]; got != 2 {
+		t.Errorf("docs dropped = %v, want the rejected delete and doc", got)
+	}
+	if got := ic.metrics.docsIndexed.values["courses"]; got != 1 {
+		t.Errorf("docs indexed = %v, want 1", got)
+	}
+}
+
+func TestReplaySpillKeepsOperatorPause(t *testing.T) {
+	srv := &fakeAppSearch{}
+	server := httptest.NewServer(srv)
+	defer server.Close()
+	ic, e := newSpillTestClient(t, server.URL, 1)
+	e.docs = []interface{}{map[string]interface{}{"id": "1"}}
+	if err := ic.spillEngine(e); err != nil {
+		t.Fatal(err)
+	}
+	ic.pause.pause(spillPause + e.name)
+	e.spill.paused = true
+	// the operator paused the sync while the spill file was full
+	ic.pause.pause(operatorPause)
+
+	e.spill.disabled, e.spill.replaying = false, true
+	ic.replaySpill(e)
+	if got := ic.pause.heldBy(); !reflect.DeepEqual(got, []string{operatorPause}) {
+		t.Errorf("pause held by %v after the replay, want the operator pause kept", got)
+	}
+	if !ic.pause.resume(operatorPause) {
+		t.Error("resume() = false, want the operator pause released")
+	}
+	if c, _ := ic.pause.opChannel(make(chan *gtm.Op)); c == nil {
+		t.Error("consumption of ops still paused once the operator resumed")
+	}
+}
@@ -12,6 +12,8 @@ type bulkProcessorStats struct {
 	Deleted      int64 // # of requests that ES reported as deletes
 	Processed    int64 // # of requests that ES reported as successful
 	Failed       int64 // # of requests that ES reported as failed
+	Stale        int64 // # of docs dropped because a newer version was already indexed
+	Blocked      int64 // # of docs dropped for fields missing from the engine schema
 	LastUpdateTs time.Time
 }
 
@@ -78,3 +80,19 @@ func (s *bulkProcessorStats) AddFailed(c int) {
 	s.Failed += int64(c)
 	s.LastUpdateTs = time.Now()
 }
+
+func (s *bulkProcessorStats) AddStale(c int) {
+	if !s.Enabled {
+		return
+	}
+	s.Stale += int64(c)
+	s.LastUpdateTs = time.Now()
+}
+
+func (s *bulkProcessorStats) AddBlocked(c int) {
+	if !s.Enabled {
+		return
+	}
+	s.Blocked += int64(c)
+	s.LastUpdateTs = time.Now()
+}
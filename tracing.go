@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const (
+	traceQueueSize      = 4096 // finished spans waiting to be exported, more are dropped
+	traceBatchSize      = 512
+	traceExportInterval = 5 * time.Second
+	traceExportTimeout  = 10 * time.Second
+)
+
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+	spanStatusError  = 2
+)
+
+type tracingSettings struct {
+	Enabled     bool              `toml:"enabled"`
+	Endpoint    string            `toml:"endpoint"`     // OTLP/HTTP traces url of the collector
+	ServiceName string            `toml:"service-name"` // defaults to app-search-sync
+	SampleRatio float64           `toml:"sample-ratio"` // share of ops traced, all when unset
+	Headers     map[string]string `toml:"headers"`      // added to every export request
+}
+
+// span is a timed step of the pipeline of one op. Spans are exported once
+// finished and are not safe for concurrent use, except for starting children.
+type span struct {
+	tracer     *tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attrs      map[string]interface{}
+	err        error
+	op         *gtm.Op   // the op of a root span
+	bufferedAt time.Time // when the op of a root span was buffered
+}
+
+func newSpanID() (id [8]byte) {
+	rand.Read(id[:])
+	return
+}
+
+func newTraceID() (id [16]byte) {
+	rand.Read(id[:])
+	return
+}
+
+// child starts a span nested in s. Children of a nil span are nil.
+func (s *span) child(name string, start time.Time) *span {
+	if s == nil {
+		return nil
+	}
+	return &span{
+		tracer:   s.tracer,
+		traceID:  s.traceID,
+		spanID:   newSpanID(),
+		parentID: s.spanID,
+		name:     name,
+		kind:     spanKindInternal,
+		start:    start,
+		attrs:    make(map[string]interface{}),
+	}
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// setError marks the span as failed, keeping the first error.
+func (s *span) setError(err error) {
+	if s != nil && s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *span) finish(err error) {
+	s.finishAt(time.Now(), err)
+}
+
+func (s *span) finishAt(end time.Time, err error) {
+	if s == nil {
+		return
+	}
+	s.end = end
+	s.setError(err)
+	s.tracer.export(s)
+}
+
+type spanContextKey struct{}
+
+// contextWithSpan returns a context carrying s so that the mongo commands run
+// with it are recorded as children of s.
+func contextWithSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, s)
+}
+
+func spanFromContext(ctx context.Context) *span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// tracer samples ops, keeps the root span of each op in flight and exports the
+// finished spans in batches to an OTLP/HTTP collector. A nil tracer traces
+// nothing.
+type tracer struct {
+	settings tracingSettings
+	log      *logger
+	client   *http.Client
+	spans    chan *span
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	ops      sync.Map // *gtm.Op -> root *span
+	commands sync.Map // mongo request id -> *span
+	dropped  int64
+}
+
+func newTracer(settings tracingSettings, log *logger) *tracer {
+	if !settings.Enabled {
+		return nil
+	}
+	t := &tracer{
+		settings: settings,
+		log:      log,
+		client:   &http.Client{Timeout: traceExportTimeout},
+		spans:    make(chan *span, traceQueueSize),
+		stop:     make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.run()
+	return t
+}
+
+func (t *tracer) sampled() bool {
+	return t.settings.SampleRatio <= 0 || t.settings.SampleRatio >= 1 || mathrand.Float64() < t.settings.SampleRatio
+}
+
+// startOp starts the root span of an op received at received, nil when the op
+// is not sampled. For oplog ops the time the op spent reaching the sync is
+// recorded as a gtm.receive child.
+func (t *tracer) startOp(engine *indexEngineCtx, op *gtm.Op, received time.Time) *span {
+	if t == nil || !t.sampled() {
+		return nil
+	}
+	s := &span{
+		tracer:  t,
+		traceID: newTraceID(),
+		spanID:  newSpanID(),
+		name:    "op",
+		kind:    spanKindInternal,
+		start:   received,
+		op:      op,
+		attrs: map[string]interface{}{
+			"engine":    engine.name,
+			"namespace": op.Namespace,
+			"doc_id":    fmt.Sprint(op.Id),
+			"op":        op.Operation,
+			"source":    opSource(op),
+		},
+	}
+	if op.IsSourceOplog() && op.Timestamp.T > 0 {
+		opTime := time.Unix(int64(op.Timestamp.T), 0)
+		if opTime.Before(received) {
+			s.start = opTime
+		}
+		receive := s.child("gtm.receive", s.start)
+		receive.set("stream_id", opStreamID(op))
+		receive.finishAt(received, nil)
+	}
+	t.ops.Store(op, s)
+	return s
+}
+
+// opSpan returns the root span of an op in flight, nil when it is not traced.
+func (t *tracer) opSpan(op *gtm.Op) *span {
+	if t == nil {
+		return nil
+	}
+	if s, ok := t.ops.Load(op); ok {
+		return s.(*span)
+	}
+	return nil
+}
+
+// endOp finishes the root span of an op.
+func (t *tracer) endOp(s *span, err error) {
+	if t == nil || s == nil {
+		return
+	}
+	t.ops.Delete(s.op)
+	s.finish(err)
+}
+
+// commandMonitor records the mongo commands run with a context carrying a
+// span, such as the lookups of the plugins, as children of that span.
+func (t *tracer) commandMonitor() *event.CommandMonitor {
+	if t == nil {
+		return nil
+	}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, evt *event.CommandStartedEvent) {
+			parent := spanFromContext(ctx)
+			if parent == nil {
+				return
+			}
+			s := parent.child("mongo."+evt.CommandName, time.Now())
+			s.kind = spanKindClient
+			s.set("db.system", "mongodb")
+			s.set("db.name", evt.DatabaseName)
+			s.set("db.operation", evt.CommandName)
+			t.commands.Store(evt.RequestID, s)
+		},
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			if s, ok := t.commands.LoadAndDelete(evt.RequestID); ok {
+				s.(*span).finish(nil)
+			}
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			if s, ok := t.commands.LoadAndDelete(evt.RequestID); ok {
+				s.(*span).finish(errors.New(evt.Failure))
+			}
+		},
+	}
+}
+
+// export queues a finished span, dropping it when the collector cannot keep up.
+func (t *tracer) export(s *span) {
+	if t == nil {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+func (t *tracer) run() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-t.stop:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					t.send(batch)
+					return
+				}
+			}
+		}
+		t.send(batch)
+		batch = nil
+	}
+}
+
+// shutdown exports the spans already finished.
+func (t *tracer) shutdown() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	t.wg.Wait()
+}
+
+func (t *tracer) send(spans []*span) {
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(t.request(spans))
+	if err == nil {
+		err = t.post(body)
+	}
+	if err != nil {
+		t.log.Warn("Unable to export spans", "endpoint", t.settings.Endpoint, "spans", len(spans), "error", err)
+	}
+	if dropped := atomic.SwapInt64(&t.dropped, 0); dropped > 0 {
+		t.log.Warn("Dropped spans, the export queue is full", "spans", dropped)
+	}
+}
+
+func (t *tracer) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, t.settings.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.settings.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// request builds an OTLP ExportTraceServiceRequest in its JSON encoding.
+func (t *tracer) request(spans []*span) map[string]interface{} {
+	out := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		m := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			m["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			m["status"] = map[string]interface{}{"code": spanStatusError, "message": s.err.Error()}
+		}
+		out[i] = m
+	}
+	resource := map[string]interface{}{"service.name": t.settings.ServiceName, "service.version": Version}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": otlpAttributes(resource)},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": Name, "version": Version},
+						"spans": out,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	out := make([]interface{}, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(fieldValue(v))}
+		}
+		out = append(out, map[string]interface{}{"key": k, "value": value})
+	}
+	return out
+}
+
+// tracedRequest is an App Search request made while flushing an engine,
+// recorded in the trace of every op of the flush it carried.
+type tracedRequest struct {
+	operation string // index or delete
+	engine    string
+	docs      int
+	start     time.Time
+	end       time.Time
+	err       error
+}
+
+// requestOutcomes maps App Search operations to the outcome of the ops they carry.
+var requestOutcomes = map[string]string{"index": "indexed", "delete": "deleted"}
+
+// bufferTrace remembers the span of an op buffered for the engine until the
+// engine is flushed. The caller must hold indexMutex.
+func (ic *indexClient) bufferTrace(engine *indexEngineCtx, s *span) {
+	if s == nil || !s.bufferedAt.IsZero() {
+		return
+	}
+	s.bufferedAt = time.Now()
+	engine.traces = append(engine.traces, s)
+}
+
+// traceRequest records an App Search request made for the ops buffered for
+// the engine. The caller must hold indexMutex.
+func (ic *indexClient) traceRequest(engine *indexEngineCtx, operation, indexName string, docs int, start time.Time, err error) {
+	if len(engine.traces) == 0 {
+		return
+	}
+	engine.requests = append(engine.requests, &tracedRequest{
+		operation: operation,
+		engine:    indexName,
+		docs:      docs,
+		start:     start,
+		end:       time.Now(),
+		err:       err,
+	})
+}
+
+// finishTraces ends the spans of the ops flushed for the engine with the time
+// they waited in the buffer and the App Search requests that carried them. The
+// caller must hold indexMutex.
+func (ic *indexClient) finishTraces(engine *indexEngineCtx, flushStart time.Time) {
+	for _, s := range engine.traces {
+		s.child("buffer", s.bufferedAt).finishAt(flushStart, nil)
+		outcome, _ := s.attrs["outcome"].(string)
+		var err error
+		for _, r := range engine.requests {
+			if requestOutcomes[r.operation] != outcome {
+				continue
+			}
+			c := s.child("app_search."+r.operation, r.start)
+			c.kind = spanKindClient
+			c.set("app_search.engine", r.engine)
+			c.set("batch_size", r.docs)
+			c.finishAt(r.end, r.err)
+			if r.err != nil {
+				err = r.err
+			}
+		}
+		ic.config.tracer.endOp(s, err)
+	}
+	engine.traces, engine.requests = nil, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rwynn/gtm"
+)
+
+func TestOTLPAttributes(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  map[string]interface{}
+	}{
+		{"bool", true, map[string]interface{}{"boolValue": true}},
+		{"int", 3, map[string]interface{}{"intValue": "3"}},
+		{"int64", int64(1) << 40, map[string]interface{}{"intValue": "1099511627776"}},
+		{"float64", 0.5, map[string]interface{}{"doubleValue": 0.5}},
+		{"string", "db.a", map[string]interface{}{"stringValue": "db.a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := otlpAttributes(map[string]interface{}{"k": tt.value})
+			want := []interface{}{map[string]interface{}{"key": "k", "value": tt.want}}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("otlpAttributes() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTracerRequest(t *testing.T) {
+	tr := &tracer{settings: tracingSettings{ServiceName: "sync"}, spans: make(chan *span, 4)}
+	start := time.Unix(100, 5)
+	root := &span{
+		tracer:  tr,
+		traceID: [16]byte{1},
+		spanID:  [8]byte{2},
+		name:    "op",
+		kind:    spanKindInternal,
+		start:   start,
+		attrs:   map[string]interface{}{"engine": "courses"},
+	}
+	child := root.child("app_search.index", start)
+	child.spanID = [8]byte{3}
+	child.kind = spanKindClient
+	child.finishAt(start.Add(time.Second), errors.New("boom"))
+	root.finishAt(start.Add(2*time.Second), nil)
+	spans := []*span{<-tr.spans, <-tr.spans}
+
+	data, err := json.Marshal(tr.request(spans))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string
+					Value map[string]interface{}
+				}
+			}
+			ScopeSpans []struct {
+				Scope struct{ Name string }
+				Spans []map[string]interface{}
+			}
+		}
+	}
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("request() = %s, want one resource and scope", data)
+	}
+	service := ""
+	for _, a := range got.ResourceSpans[0].Resource.Attributes {
+		if a.Key == "service.name" {
+			service, _ = a.Value["stringValue"].(string)
+		}
+	}
+	if service != "sync" {
+		t.Errorf("service.name = %q, want sync", service)
+	}
+	if name := got.ResourceSpans[0].ScopeSpans[0].Scope.Name; name != Name {
+		t.Errorf("scope name = %q, want %q", name, Name)
+	}
+
+	out := got.ResourceSpans[0].ScopeSpans[0].Spans
+	want := []map[string]interface{}{
+		{
+			"traceId":           "01000000000000000000000000000000",
+			"spanId":            "0300000000000000",
+			"parentSpanId":      "0200000000000000",
+			"name":              "app_search.index",
+			"kind":              float64(spanKindClient),
+			"startTimeUnixNano": "100000000005",
+			"endTimeUnixNano":   "101000000005",
+			"attributes":        []interface{}{},
+			"status":            map[string]interface{}{"code": float64(spanStatusError), "message": "boom"},
+		},
+		{
+			"traceId":           "01000000000000000000000000000000",
+			"spanId":            "0200000000000000",
+			"name":              "op",
+			"kind":              float64(spanKindInternal),
+			"startTimeUnixNano": "100000000005",
+			"endTimeUnixNano":   "102000000005",
+			"attributes": []interface{}{
+				map[string]interface{}{"key": "engine", "value": map[string]interface{}{"stringValue": "courses"}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("spans = %v, want %v", out, want)
+	}
+}
+
+func TestTracerPost(t *testing.T) {
+	var body []byte
+	var header http.Header
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		header = r.Header
+		w.WriteHeader(status)
+		w.Write([]byte("bad request\n"))
+	}))
+	defer srv.Close()
+
+	tr := &tracer{
+		settings: tracingSettings{Endpoint: srv.URL, Headers: map[string]string{"Authorization": "Bearer x"}},
+		client:   srv.Client(),
+	}
+	if err := tr.post([]byte(`{}`)); err != nil {
+		t.Fatalf("post() error = %v", err)
+	}
+	if string(body) != "{}" {
+		t.Errorf("posted body = %q, want {}", body)
+	}
+	if got := header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if got := header.Get("Authorization"); got != "Bearer x" {
+		t.Errorf("Authorization = %q, want the configured header", got)
+	}
+
+	status = http.StatusBadRequest
+	if err := tr.post([]byte(`{}`)); err == nil {
+		t.Error("post() error = nil, want the collector error")
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tr *tracer
+	op := &gtm.Op{Namespace: "db.a"}
+	if s := tr.startOp(&indexEngineCtx{name: "e"}, op, time.Now()); s != nil {
+		t.Errorf("startOp() = %v, want nil", s)
+	}
+	if s := tr.opSpan(op); s != nil {
+		t.Errorf("opSpan() = %v, want nil", s)
+	}
+	var s *span
+	if c := s.child("x", time.Now()); c != nil {
+		t.Errorf("child() = %v, want nil", c)
+	}
+	s.set("k", "v")
+	s.finish(nil)
+	tr.endOp(s, nil)
+	tr.shutdown()
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	verifyBatchSize   = 100 // App Search limit of documents per request
+	appSearchListMax  = 10000
+	verifyListPageMax = appSearchListMax / verifyBatchSize
+)
+
+type verifyReport struct {
+	Engine       string   `json:"engine"`
+	Namespace    string   `json:"namespace"`
+	Mongo        int      `json:"mongo"`     // # of docs mapped from mongo
+	AppSearch    int      `json:"appSearch"` // # of docs in the engine
+	Missing      []string `json:"missing"`
+	Extra        []string `json:"extra"`
+	Differing    []string `json:"differing"`
+	ExtraPartial bool     `json:"extraPartial,omitempty"` // only the first 10000 docs of the engine were listed
+	Unlisted     int      `json:"unlisted,omitempty"`     // # of extra docs beyond the listed ones
+	Repaired     bool     `json:"repaired,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// ok reports whether the engine matches mongo or was repaired. Extra docs
+// beyond the listed ones cannot be repaired since their ids are unknown.
+func (r *verifyReport) ok() bool {
+	return r.Error == "" && r.Unlisted == 0 &&
+		(r.Repaired || len(r.Missing)+len(r.Extra)+len(r.Differing) == 0)
+}
+
+// verify compares the docs mapped from mongo with the docs of each engine and
+// prints a report per engine.
+func (ic *indexClient) verify(engineName string, repair bool) []*verifyReport {
+	var reports []*verifyReport
+	for _, e := range ic.engines {
+		if engineName != "" && e.name != engineName && ic.engineConfig(e.namespace).Name != engineName {
+			continue
+		}
+		report := ic.verifyEngine(e, repair)
+		if out, err := json.MarshalIndent(report, "", "    "); err == nil {
+			fmt.Println(string(out))
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+func (ic *indexClient) verifyEngine(e *indexEngineCtx, repair bool) *verifyReport {
+	report := &verifyReport{
+		Engine:    e.name,
+		Namespace: e.namespace,
+		Missing:   []string{},
+		Extra:     []string{},
+		Differing: []string{},
+	}
+	// the engine is listed before mongo is read so that docs inserted while
+	// verifying are found in mongo rather than reported as extra
+	listed, err := ic.listedDocuments(e, report)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	var drifted []interface{} // mongo _ids of the missing and differing docs
+	err = ic.mappedDocuments(e, func(docs []*mappedDocument) error {
+		ids, err := ic.compareDocuments(e, docs, listed, report)
+		drifted = append(drifted, ids...)
+		return err
+	})
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	ic.extraDocuments(e, listed, report)
+
+	if repair {
+		if err = ic.repair(e, drifted, report.Extra); err != nil {
+			report.Error = err.Error()
+		} else {
+			report.Repaired = true
+		}
+	}
+	return report
+}
+
+// compareDocuments looks up a batch of mapped docs in the engine, recording
+// the missing and differing ones in the report, and returns their mongo _ids.
+// The docs are removed from listed, leaving the extra docs.
+func (ic *indexClient) compareDocuments(e *indexEngineCtx, docs []*mappedDocument, listed map[string]bool, report *verifyReport) ([]interface{}, error) {
+	ids := make([]string, len(docs))
+	for i, d := range docs {
+		ids[i] = d.id
+		delete(listed, d.id)
+	}
+	indexed, err := ic.client.getDocuments(e.name, ids)
+	if err != nil {
+		return nil, err
+	}
+	var drifted []interface{}
+	for i, doc := range indexed {
+		if doc == nil {
+			report.Missing = append(report.Missing, ids[i])
+		} else if !sameDocument(docs[i].doc, doc) {
+			report.Differing = append(report.Differing, ids[i])
+		} else {
+			continue
+		}
+		drifted = append(drifted, docs[i].mongoID)
+	}
+	report.Mongo += len(docs)
+	return drifted, nil
+}
+
+// extraDocuments records the listed docs mongo has no match for. When the
+// engine holds more docs than App Search lists, the extra docs among the
+// unlisted ones are counted from the document total of the engine.
+func (ic *indexClient) extraDocuments(e *indexEngineCtx, listed map[string]bool, report *verifyReport) {
+	for id := range listed {
+		report.Extra = append(report.Extra, id)
+	}
+	sort.Strings(report.Extra)
+	if !report.ExtraPartial {
+		return
+	}
+	matched := report.Mongo - len(report.Missing)
+	if unlisted := report.AppSearch - matched - len(report.Extra); unlisted > 0 {
+		report.Unlisted = unlisted
+	}
+	ic.config.log(mainComponent).Warn("Only the first docs of the engine were listed, extra docs beyond them are counted but not identified",
+		"engine", e.name, "listed", appSearchListMax, "total", report.AppSearch, "unlisted", report.Unlisted)
+}
+
+// listedDocuments returns the ids of the docs App Search lists for the
+// engine, which are at most the first appSearchListMax.
+func (ic *indexClient) listedDocuments(e *indexEngineCtx, report *verifyReport) (map[string]bool, error) {
+	listed := make(map[string]bool)
+	for page := 1; ; page++ {
+		list, err := ic.client.listDocuments(e.name, page, verifyBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		report.AppSearch = list.Meta.Page.TotalResults
+		for _, doc := range list.Results {
+			if id, _ := doc["id"].(string); id != "" {
+				listed[id] = true
+			}
+		}
+		if page >= list.Meta.Page.TotalPages {
+			return listed, nil
+		}
+		if page >= verifyListPageMax {
+			report.ExtraPartial = true
+			return listed, nil
+		}
+	}
+}
+
+type mappedDocument struct {
+	mongoID interface{}
+	id      string // App Search id
+	doc     map[string]interface{}
+}
+
+// mappedDocuments reads the namespace of the engine and maps every doc the
+// way the sync would index it, calling fn with up to verifyBatchSize docs at a
+// time.
+func (ic *indexClient) mappedDocuments(e *indexEngineCtx, fn func([]*mappedDocument) error) error {
+	var query interface{} = bson.M{}
+	if m := ic.engineConfig(e.namespace); m.Filter != nil {
+		query = m.Filter
+	}
+	filter := ic.config.documentFilter()
+	var ops []*gtm.Op
+	mapBatch := func() error {
+		outs, err := ic.mapOps(e, ops)
+		if err != nil {
+			return err
+		}
+		var docs []*mappedDocument
+		for i, op := range ops {
+			if e.batchPlugin != nil && outs[i] == nil {
+				continue
+			}
+			id, doc, _, err := e.mapOutput(op, outs[i])
+			if err != nil {
+				return fmt.Errorf("doc ID: %v: %s", op.Id, err)
+			}
+			if id != "" && doc != nil {
+				docs = append(docs, &mappedDocument{mongoID: op.Id, id: id, doc: doc})
+			}
+		}
+		ops = ops[:0]
+		if len(docs) == 0 {
+			return nil
+		}
+		return fn(docs)
+	}
+	err := ic.findOps(e.namespace, query, func(op *gtm.Op) error {
+		if !filter(op) {
+			return nil
+		}
+		if ops = append(ops, op); len(ops) >= verifyBatchSize {
+			return mapBatch()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return mapBatch()
+}
+
+// findOps reads the docs of the namespace matching the query, calling fn with
+// each of them as a direct read op.
+func (ic *indexClient) findOps(namespace string, query interface{}, fn func(*gtm.Op) error) error {
+	ns, err := parseNamespace(namespace)
+	if err != nil {
+		return err
+	}
+	col := ic.getMongoClient(namespace).Database(ns.db).Collection(ns.col)
+	cursor, err := col.Find(context.Background(), query)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(context.Background()) {
+		data := make(map[string]interface{})
+		if err = cursor.Decode(&data); err != nil {
+			return err
+		}
+		op := &gtm.Op{
+			Id:        data["_id"],
+			Operation: "i",
+			Namespace: namespace,
+			Data:      data,
+			Doc:       data,
+			Source:    gtm.DirectQuerySource,
+		}
+		if err = fn(op); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// repair re-reads the drifted docs from mongo and indexes them through the
+// buffers of the sync, so that they are the current version of the docs and
+// are dropped when stale write protection knows a newer one. Extra docs are
+// deleted.
+func (ic *indexClient) repair(e *indexEngineCtx, mongoIDs []interface{}, extra []string) error {
+	for start := 0; start < len(mongoIDs); start += verifyBatchSize {
+		end := start + verifyBatchSize
+		if end > len(mongoIDs) {
+			end = len(mongoIDs)
+		}
+		var ops []*gtm.Op
+		query := bson.M{"_id": bson.M{"$in": mongoIDs[start:end]}}
+		err := ic.findOps(e.namespace, query, func(op *gtm.Op) error {
+			ops = append(ops, op)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err = ic.indexOps(e, ops); err != nil {
+			return err
+		}
+	}
+	if len(extra) > 0 {
+		return ic.client.deleteDocuments(e.name, extra)
+	}
+	return nil
+}
+
+// indexOps maps ops read outside of the sync and indexes them right away
+// through the buffers of the engine.
+func (ic *indexClient) indexOps(e *indexEngineCtx, ops []*gtm.Op) error {
+	outs, err := ic.mapOps(e, ops)
+	if err != nil {
+		return err
+	}
+	ic.indexMutex.Lock()
+	defer ic.indexMutex.Unlock()
+	for i, op := range ops {
+		if e.batchPlugin != nil && outs[i] == nil {
+			continue
+		}
+		if err = ic.bufferOutput(e, op, outs[i]); err != nil {
+			return err
+		}
+	}
+	return ic.flush()
+}
+
+// sameDocument compares a mapped doc with the doc returned by App Search,
+// which may return numbers as strings. Empty fields are ignored.
+func sameDocument(expected, actual map[string]interface{}) bool {
+	b, err := json.Marshal(expected)
+	if err != nil {
+		return false
+	}
+	want := make(map[string]interface{})
+	if err = json.Unmarshal(b, &want); err != nil {
+		return false
+	}
+	for k := range want {
+		if isEmptyValue(want[k]) && isEmptyValue(actual[k]) {
+			continue
+		}
+		if !sameValue(want[k], actual[k]) {
+			return false
+		}
+	}
+	for k, v := range actual {
+		if _, ok := want[k]; !ok && !isEmptyValue(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func isEmptyValue(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+func sameValue(a, b interface{}) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	as, aok := a.([]interface{})
+	bs, bok := b.([]interface{})
+	if aok || bok {
+		if !aok || !bok || len(as) != len(bs) {
+			return false
+		}
+		for i := range as {
+			if !sameValue(as[i], bs[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return valueString(a) == valueString(b)
+}
+
+func valueString(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	if s, ok := v.(string); ok {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		return s
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSameDocument(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected map[string]interface{}
+		actual   map[string]interface{}
+		want     bool
+	}{
+		{"equal", map[string]interface{}{"id": "1", "title": "go"}, map[string]interface{}{"id": "1", "title": "go"}, true},
+		{"number as string", map[string]interface{}{"price": 10}, map[string]interface{}{"price": "10"}, true},
+		{"float as string", map[string]interface{}{"price": 10.5}, map[string]interface{}{"price": "10.50"}, true},
+		{"array of numbers as strings", map[string]interface{}{"n": []interface{}{1, 2}}, map[string]interface{}{"n": []interface{}{"1", "2"}}, true},
+		{"empty fields ignored", map[string]interface{}{"title": "go", "tags": []interface{}{}}, map[string]interface{}{"title": "go", "level": ""}, true},
+		{"differing value", map[string]interface{}{"title": "go"}, map[string]interface{}{"title": "rust"}, false},
+		{"differing array", map[string]interface{}{"n": []interface{}{1, 2}}, map[string]interface{}{"n": []interface{}{"1"}}, false},
+		{"missing field", map[string]interface{}{"title": "go", "level": "beginner"}, map[string]interface{}{"title": "go"}, false},
+		{"extra field", map[string]interface{}{"title": "go"}, map[string]interface{}{"title": "go", "level": "beginner"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameDocument(tt.expected, tt.actual); got != tt.want {
+				t.Errorf("sameDocument(%v, %v) = %v, want %v", tt.expected, tt.actual, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareDocuments(t *testing.T) {
+	srv := newFakeEngines()
+	server := httptest.NewServer(srv)
+	defer server.Close()
+	srv.add(appSearchEngine{Name: "courses"},
+		map[string]interface{}{"id": "1", "title": "go"},
+		map[string]interface{}{"id": "2", "title": "rust"},
+		map[string]interface{}{"id": "4", "title": "c"},
+		map[string]interface{}{"id": "5", "title": "java"},
+	)
+	ic, e := newTestIndexClient(t, server.URL)
+	report := &verifyReport{Missing: []string{}, Extra: []string{}, Differing: []string{}}
+	listed, err := ic.listedDocuments(e, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := []*mappedDocument{
+		{mongoID: 1, id: "1", doc: map[string]interface{}{"id": "1", "title": "go"}},
+		{mongoID: 2, id: "2", doc: map[string]interface{}{"id": "2", "title": "python"}},
+		{mongoID: 3, id: "3", doc: map[string]interface{}{"id": "3", "title": "go"}},
+	}
+	drifted, err := ic.compareDocuments(e, docs, listed, report)
+	if err != nil {
+		t.Fatalf("compareDocuments() error = %v", err)
+	}
+	ic.extraDocuments(e, listed, report)
+
+	if want := []interface{}{2, 3}; !reflect.DeepEqual(drifted, want) {
+		t.Errorf("drifted = %v, want %v", drifted, want)
+	}
+	want := &verifyReport{
+		Mongo:     3,
+		AppSearch: 4,
+		Missing:   []string{"3"},
+		Extra:     []string{"4", "5"},
+		Differing: []string{"2"},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("report = %+v, want %+v", report, want)
+	}
+	if report.ok() {
+		t.Error("ok() = true for a drifted engine")
+	}
+
+	if err = ic.repair(e, nil, report.Extra); err != nil {
+		t.Fatalf("repair() error = %v", err)
+	}
+	if got := srv.engine("courses").docs; len(got) != 2 || got["4"] != nil || got["5"] != nil {
+		t.Errorf("docs after repair = %v, want the extra docs deleted", got)
+	}
+}
+
+func TestListedDocumentsTruncated(t *testing.T) {
+	srv := newFakeEngines()
+	server := httptest.NewServer(srv)
+	defer server.Close()
+	engine := srv.add(appSearchEngine{Name: "courses"})
+	total := appSearchListMax + 50
+	for i := 0; i < total; i++ {
+		id := strconv.Itoa(100000 + i)
+		engine.docs[id] = map[string]interface{}{"id": id}
+	}
+	ic, e := newTestIndexClient(t, server.URL)
+	report := &verifyReport{Missing: []string{}, Extra: []string{}, Differing: []string{}}
+	listed, err := ic.listedDocuments(e, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != appSearchListMax || !report.ExtraPartial || report.AppSearch != total {
+		t.Fatalf("listed %d of %d docs, partial %v, want %d, partial", len(listed), report.AppSearch, report.ExtraPartial, appSearchListMax)
+	}
+
+	// mongo holds all the listed docs but 10 and 20 docs beyond them
+	listedIDs := make([]string, 0, len(listed))
+	for id := range listed {
+		listedIDs = append(listedIDs, id)
+	}
+	for _, id := range listedIDs[10:] {
+		delete(listed, id)
+	}
+	report.Mongo = appSearchListMax - 10 + 20
+	ic.extraDocuments(e, listed, report)
+	if len(report.Extra) != 10 || report.Unlisted != 30 {
+		t.Errorf("extra = %d, unlisted = %d, want 10 and 30", len(report.Extra), report.Unlisted)
+	}
+	report.Repaired = true
+	if report.ok() {
+		t.Error("ok() = true with unlisted extra docs")
+	}
+}
+
+func TestVerifyReportOK(t *testing.T) {
+	tests := []struct {
+		name   string
+		report verifyReport
+		want   bool
+	}{
+		{"in sync", verifyReport{}, true},
+		{"missing", verifyReport{Missing: []string{"1"}}, false},
+		{"extra", verifyReport{Extra: []string{"1"}}, false},
+		{"differing", verifyReport{Differing: []string{"1"}}, false},
+		{"repaired", verifyReport{Missing: []string{"1"}, Repaired: true}, true},
+		{"partial without unlisted extra docs", verifyReport{ExtraPartial: true}, true},
+		{"unlisted extra docs", verifyReport{ExtraPartial: true, Unlisted: 1, Repaired: true}, false},
+		{"error", verifyReport{Error: "boom"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.report.ok(); got != tt.want {
+				t.Errorf("ok() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// versionStoreCompactMin is the number of stale lines the version file may
+// hold before it is rewritten with the live versions only.
+const versionStoreCompactMin = 10000
+
+// versionStore keeps the last indexed or deleted version of the most recently
+// written documents per engine namespace so that out of order ops cannot
+// overwrite newer data or bring deleted docs back. The changes are appended to
+// a local json lines file which is compacted once most of its lines are stale.
+//
+// Versions come on two scales, oplog timestamps and the versions plugins set,
+// which are never compared with each other: a write on the other scale than
+// the stored version is always accepted.
+type versionStore struct {
+	path     string
+	maxDocs  int // versions kept, deletes included, the least recently written docs are forgotten first
+	mutex    sync.Mutex
+	versions map[versionKey]*list.Element // values are *versionEntry
+	order    *list.List                   // least recently written first
+	changes  []*versionEntry              // set or forgotten since the last save
+	lines    int                          // lines of the file
+}
+
+type versionKey struct {
+	namespace string
+	id        string
+}
+
+// versionEntry is a line of the version file, a zero version forgets the doc.
+type versionEntry struct {
+	Namespace string `json:"ns"`
+	ID        string `json:"id"`
+	Version   int64  `json:"v"`
+	Plugin    bool   `json:"p,omitempty"` // set by the plugin rather than the oplog timestamp
+	Deleted   bool   `json:"d,omitempty"` // the version of the delete of the doc
+}
+
+func newVersionStore(path string, maxDocs int) (*versionStore, error) {
+	s := &versionStore{
+		path:     path,
+		maxDocs:  maxDocs,
+		versions: make(map[versionKey]*list.Element),
+		order:    list.New(),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		e := &versionEntry{}
+		if err = json.Unmarshal(scanner.Bytes(), e); err != nil {
+			// a line cut short by a crash, keep the versions before it and
+			// rewrite the file so that the next changes are not appended after it
+			if err = s.compact(); err != nil {
+				return nil, err
+			}
+			break
+		}
+		s.apply(e)
+		s.lines++
+	}
+	return s, nil
+}
+
+// opVersion orders oplog timestamps the same way mongo does.
+func opVersion(ts primitive.Timestamp) int64 {
+	return int64(ts.T)<<32 | int64(ts.I)
+}
+
+func (s *versionStore) apply(e *versionEntry) {
+	key := versionKey{namespace: e.Namespace, id: e.ID}
+	if elem, ok := s.versions[key]; ok {
+		s.order.Remove(elem)
+		delete(s.versions, key)
+	}
+	if e.Version == 0 {
+		return
+	}
+	s.versions[key] = s.order.PushBack(e)
+	for s.maxDocs > 0 && len(s.versions) > s.maxDocs {
+		oldest := s.order.Front()
+		s.order.Remove(oldest)
+		old := oldest.Value.(*versionEntry)
+		delete(s.versions, versionKey{namespace: old.Namespace, id: old.ID})
+	}
+}
+
+// older reports whether v is older than the version e on the same scale.
+func (e *versionEntry) older(v docVersion) bool {
+	return e.Plugin == v.plugin && v.version < e.Version
+}
+
+// stale reports whether a newer version of the document has been indexed or
+// deleted. Unversioned (zero) writes are never stale.
+func (s *versionStore) stale(namespace, id string, v docVersion) bool {
+	if v.version == 0 {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	elem, ok := s.versions[versionKey{namespace: namespace, id: id}]
+	return ok && elem.Value.(*versionEntry).older(v)
+}
+
+// set records the version of an indexed or deleted document unless a newer
+// one is known. An unversioned delete forgets the document.
+func (s *versionStore) set(namespace, id string, v docVersion) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	elem, ok := s.versions[versionKey{namespace: namespace, id: id}]
+	if v.version == 0 {
+		if !v.deleted || !ok {
+			return
+		}
+	} else if ok && elem.Value.(*versionEntry).older(v) {
+		return
+	}
+	e := &versionEntry{Namespace: namespace, ID: id}
+	if v.version > 0 {
+		e.Version, e.Plugin, e.Deleted = v.version, v.plugin, v.deleted
+	}
+	s.apply(e)
+	s.changes = append(s.changes, e)
+}
+
+// save appends the changes to the version file, or rewrites it with the live
+// versions once it holds more stale lines than versionStoreCompactMin and the
+// live ones.
+func (s *versionStore) save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.changes) == 0 {
+		return nil
+	}
+	if s.lines+len(s.changes)-len(s.versions) > versionStoreCompactMin+len(s.versions) {
+		return s.compact()
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range s.changes {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	s.lines += len(s.changes)
+	s.changes = nil
+	return nil
+}
+
+func (s *versionStore) compact() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for elem := s.order.Front(); elem != nil; elem = elem.Next() {
+		if err := enc.Encode(elem.Value); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(s.path, buf.Bytes()); err != nil {
+		return err
+	}
+	s.lines = len(s.versions)
+	s.changes = nil
+	return nil
+}
+
+// writeFileAtomic writes the data to a temporary file and renames it over path
+// so that readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
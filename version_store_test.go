@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func tempVersionStore(t *testing.T, maxDocs int) *versionStore {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := newVersionStore(filepath.Join(dir, "versions.jsonl"), maxDocs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestOpVersion(t *testing.T) {
+	tests := []struct {
+		a, b primitive.Timestamp
+	}{
+		{primitive.Timestamp{T: 1, I: 0}, primitive.Timestamp{T: 1, I: 1}},
+		{primitive.Timestamp{T: 1, I: 1<<32 - 1}, primitive.Timestamp{T: 2, I: 0}},
+		{primitive.Timestamp{T: 1600000000, I: 5}, primitive.Timestamp{T: 1600000001, I: 0}},
+	}
+	for _, tt := range tests {
+		if opVersion(tt.a) >= opVersion(tt.b) {
+			t.Errorf("opVersion(%v) = %d, want below opVersion(%v) = %d", tt.a, opVersion(tt.a), tt.b, opVersion(tt.b))
+		}
+	}
+}
+
+// written is the version of an indexed doc on the oplog scale.
+func written(version int64) docVersion {
+	return docVersion{version: version}
+}
+
+func TestVersionStoreStale(t *testing.T) {
+	s := tempVersionStore(t, 0)
+	s.set("db.a", "1", written(10))
+	s.set("db.a", "1", written(5)) // older versions never replace newer ones
+	s.set("db.a", "2", written(20))
+	s.set("db.a", "2", docVersion{version: 30, deleted: true})
+	s.set("db.a", "3", written(20))
+	s.set("db.a", "3", docVersion{deleted: true}) // an unversioned delete forgets the doc
+	s.set("db.a", "4", docVersion{version: 50, plugin: true})
+	tests := []struct {
+		name      string
+		namespace string
+		id        string
+		version   docVersion
+		want      bool
+	}{
+		{"older", "db.a", "1", written(9), true},
+		{"same", "db.a", "1", written(10), false},
+		{"newer", "db.a", "1", written(11), false},
+		{"unversioned", "db.a", "1", written(0), false},
+		{"older delete", "db.a", "1", docVersion{version: 9, deleted: true}, true},
+		{"unknown doc", "db.a", "5", written(1), false},
+		{"other namespace", "db.b", "1", written(1), false},
+		{"write older than the delete", "db.a", "2", written(25), true},
+		{"write newer than the delete", "db.a", "2", written(31), false},
+		{"forgotten", "db.a", "3", written(1), false},
+		{"older plugin version", "db.a", "4", docVersion{version: 40, plugin: true}, true},
+		{"oplog version of a plugin versioned doc", "db.a", "4", written(40), false},
+		{"plugin version of an oplog versioned doc", "db.a", "1", docVersion{version: 9, plugin: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.stale(tt.namespace, tt.id, tt.version); got != tt.want {
+				t.Errorf("stale() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionStoreMaxDocs(t *testing.T) {
+	s := tempVersionStore(t, 2)
+	s.set("db.a", "1", written(10))
+	s.set("db.a", "2", docVersion{version: 10, deleted: true})
+	s.set("db.a", "1", written(11)) // indexed again, so "2" is now the least recent
+	s.set("db.a", "3", written(10))
+	if !s.stale("db.a", "1", written(10)) {
+		t.Error("recently indexed doc 1 was forgotten")
+	}
+	if s.stale("db.a", "2", written(9)) {
+		t.Error("least recently deleted doc 2 was kept over max-docs")
+	}
+	if !s.stale("db.a", "3", written(9)) {
+		t.Error("doc 3 was forgotten")
+	}
+}
+
+func TestVersionStoreSaveAndLoad(t *testing.T) {
+	s := tempVersionStore(t, 0)
+	s.set("db.a", "1", written(10))
+	s.set("db.a", "2", written(20))
+	s.set("db.a", "3", written(20))
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	s.set("db.a", "1", docVersion{version: 11, plugin: true})
+	s.set("db.a", "2", docVersion{version: 21, deleted: true})
+	s.set("db.a", "3", docVersion{deleted: true})
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.changes) != 0 {
+		t.Errorf("changes left after save: %d", len(s.changes))
+	}
+
+	loaded, err := newVersionStore(s.path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.stale("db.a", "1", docVersion{version: 10, plugin: true}) || loaded.stale("db.a", "1", written(10)) {
+		t.Error("the last plugin version of doc 1 was not loaded")
+	}
+	if !loaded.stale("db.a", "2", written(20)) {
+		t.Error("the delete of doc 2 was not loaded")
+	}
+	if loaded.stale("db.a", "3", written(1)) {
+		t.Error("forgotten doc 3 was loaded")
+	}
+	if loaded.lines != 6 {
+		t.Errorf("loaded lines = %d, want the 6 appended", loaded.lines)
+	}
+}
+
+func TestVersionStoreCompact(t *testing.T) {
+	s := tempVersionStore(t, 0)
+	for v := int64(1); v <= versionStoreCompactMin+3; v++ {
+		s.set("db.a", "1", written(v))
+	}
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Errorf("compacted file holds %d lines, want 1", lines)
+	}
+	if s.lines != 1 {
+		t.Errorf("lines = %d, want 1", s.lines)
+	}
+}
+
+func TestVersionStoreCorruptLine(t *testing.T) {
+	s := tempVersionStore(t, 0)
+	s.set("db.a", "1", written(10))
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"ns":"db.a","id":"2","v":`)
+	f.Close()
+
+	loaded, err := newVersionStore(s.path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.stale("db.a", "1", written(9)) {
+		t.Error("version before the corrupt line was not loaded")
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), `"id":"2"`) {
+		t.Errorf("corrupt line kept in the rewritten file: %s", data)
+	}
+}